@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	purposeEmailVerify   = "email_verify"
+	purposePasswordReset = "password_reset"
+
+	emailVerifyTTL   = 48 * time.Hour
+	passwordResetTTL = time.Hour
+)
+
+var errInvalidAccountToken = errors.New("invalid or expired token")
+
+// AccountToken records every signed single-use token handed out by email so
+// it can be burned on first use.
+type AccountToken struct {
+	ID        string     `json:"id" gorm:"primaryKey;type:varchar(32)"`
+	UserID    int        `json:"user_id" gorm:"index;not null"`
+	Purpose   string     `json:"purpose" gorm:"type:varchar(32);not null"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+}
+
+type accountTokenClaims struct {
+	Purpose string `json:"purpose"`
+	Email   string `json:"email,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Routes an account with an unverified email address may not use.
+var verifiedOnlyPrefixes = []string{
+	"/friends",
+	"/chat",
+	"/activity",
+	"/feed",
+	"/users/search",
+	"/streaks/rankings",
+}
+
+func requiresVerifiedEmail(path string) bool {
+	for _, prefix := range verifiedOnlyPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func issueAccountToken(user User, purpose string, ttl time.Duration) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	record := AccountToken{
+		ID:        hex.EncodeToString(buf),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return "", err
+	}
+	claims := accountTokenClaims{
+		Purpose: purpose,
+		Email:   user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        record.ID,
+			Subject:   strconv.Itoa(user.ID),
+			Audience:  jwt.ClaimStrings{purpose},
+			Issuer:    keys.issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(record.ExpiresAt),
+		},
+	}
+	return keys.sign(claims)
+}
+
+// parseAccountToken checks the signature and purpose of a token without
+// using it up.
+func parseAccountToken(tokenString, purpose string) (*accountTokenClaims, int, error) {
+	claims := &accountTokenClaims{}
+	token, err := keys.parse(tokenString, claims, jwt.WithAudience(purpose))
+	if err != nil || !token.Valid || claims.Purpose != purpose {
+		return nil, 0, errInvalidAccountToken
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, 0, errInvalidAccountToken
+	}
+	return claims, userID, nil
+}
+
+// markAccountTokenUsed burns the token; it fails if it was already used.
+func markAccountTokenUsed(claims *accountTokenClaims, userID int) error {
+	res := db.Model(&AccountToken{}).
+		Where("id = ? AND user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", claims.ID, userID, claims.Purpose, time.Now()).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return errInvalidAccountToken
+	}
+	return nil
+}
+
+// consumeAccountToken verifies the signature and purpose, then marks the
+// token used. A token can only ever be consumed once.
+func consumeAccountToken(tokenString, purpose string) (*accountTokenClaims, int, error) {
+	claims, userID, err := parseAccountToken(tokenString, purpose)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := markAccountTokenUsed(claims, userID); err != nil {
+		return nil, 0, err
+	}
+	return claims, userID, nil
+}
+
+func appLink(path, token string) string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return strings.TrimRight(base, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+func sendVerificationEmail(user User) error {
+	token, err := issueAccountToken(user, purposeEmailVerify, emailVerifyTTL)
+	if err != nil {
+		return err
+	}
+	sendMail(Mail{
+		To:      user.Email,
+		Subject: "Confirm your HealthySummer email",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"Please confirm your email address by opening this link:\n" +
+			appLink("/verify-email", token) + "\n\n" +
+			"The link expires in 48 hours.",
+	})
+	return nil
+}
+
+func verifyEmail(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+	claims, userID, err := consumeAccountToken(req.Token, purposeEmailVerify)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	var user User
+	if err := db.First(&user, userID).Error; err != nil || user.Email != claims.Email {
+		// The address changed after this link was sent.
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err := db.Model(&user).Update("email_verified", true).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+func resendVerificationEmail(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email already verified"})
+		return
+	}
+	if err := sendVerificationEmail(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+func forgotPassword(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+	// Same answer whether or not the account exists.
+	response := gin.H{"message": "If the account exists, a reset link has been sent"}
+	var user User
+	if err := db.Where("email = ?", req.Email).First(&user).Error; err != nil {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	token, err := issueAccountToken(user, purposePasswordReset, passwordResetTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	sendMail(Mail{
+		To:      user.Email,
+		Subject: "Reset your HealthySummer password",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"Someone asked to reset the password for this account. If it was you, open this link:\n" +
+			appLink("/reset-password", token) + "\n\n" +
+			"The link expires in 1 hour. If you did not ask for a reset you can ignore this email.",
+	})
+	c.JSON(http.StatusOK, response)
+}
+
+func resetPassword(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=6"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+	_, userID, err := consumeAccountToken(req.Token, purposePasswordReset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+	// The link proves control of the mailbox, so it also verifies the address.
+	if err := db.Model(&User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"password": string(hash), "email_verified": true}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	db.Model(&AccountToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purposePasswordReset).
+		Update("used_at", time.Now())
+	revokeAllSessions(userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated, please log in again"})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultRestingHR = 60
+	acuteDays        = 7
+	chronicDays      = 28
+	// Gaps between heart-rate samples longer than this are pauses and are
+	// not counted.
+	maxSampleGap = 30 * time.Second
+)
+
+// hrZoneBounds are the lower edges of zones 1-5 as fractions of heart-rate
+// reserve (Karvonen). Anything below zone 1 is zone 0.
+var hrZoneBounds = [5]float64{0.5, 0.6, 0.7, 0.8, 0.9}
+
+// Heart-rate reserve assumed for workouts without heart-rate data.
+var intensityReserve = [3]float64{0.5, 0.65, 0.8}
+
+// heartRates are the values zones and loads are computed from, with where
+// they came from.
+type heartRates struct {
+	Max           int    `json:"max"`
+	Resting       int    `json:"resting"`
+	MaxSource     string `json:"max_source"`     // profile, age
+	RestingSource string `json:"resting_source"` // profile, metric, default
+}
+
+// WorkoutLoad caches the zone times and TRIMP of a workout, along with the
+// heart rates used; a change to those makes it stale.
+type WorkoutLoad struct {
+	WorkoutID  int       `json:"workout_id" gorm:"primaryKey;autoIncrement:false"`
+	UserID     int       `json:"user_id" gorm:"index;not null"`
+	TRIMP      float64   `json:"trimp" gorm:"column:trimp;not null"`
+	HRBased    bool      `json:"hr_based" gorm:"column:hr_based;not null"`
+	Zone0      int       `json:"-" gorm:"column:zone0;not null;default:0"` // seconds
+	Zone1      int       `json:"-" gorm:"column:zone1;not null;default:0"`
+	Zone2      int       `json:"-" gorm:"column:zone2;not null;default:0"`
+	Zone3      int       `json:"-" gorm:"column:zone3;not null;default:0"`
+	Zone4      int       `json:"-" gorm:"column:zone4;not null;default:0"`
+	Zone5      int       `json:"-" gorm:"column:zone5;not null;default:0"`
+	MaxHR      int       `json:"-" gorm:"column:max_hr;not null"`
+	RestingHR  int       `json:"-" gorm:"column:resting_hr;not null"`
+	ComputedAt time.Time `json:"-" gorm:"autoUpdateTime"`
+}
+
+func (l WorkoutLoad) zones() [6]int {
+	return [6]int{l.Zone0, l.Zone1, l.Zone2, l.Zone3, l.Zone4, l.Zone5}
+}
+
+func (l *WorkoutLoad) setZones(z [6]int) {
+	l.Zone0, l.Zone1, l.Zone2, l.Zone3, l.Zone4, l.Zone5 = z[0], z[1], z[2], z[3], z[4], z[5]
+}
+
+// normalizeHeartRates validates the user-set values. Nil means "estimate
+// it"; sending 0 clears a value back to nil.
+func normalizeHeartRates(u *User) error {
+	if u.MaxHeartRate != nil && *u.MaxHeartRate == 0 {
+		u.MaxHeartRate = nil
+	}
+	if u.RestingHeartRate != nil && *u.RestingHeartRate == 0 {
+		u.RestingHeartRate = nil
+	}
+	if u.MaxHeartRate != nil && (*u.MaxHeartRate < 100 || *u.MaxHeartRate > 230) {
+		return errors.New("max_heart_rate must be between 100 and 230")
+	}
+	if u.RestingHeartRate != nil && (*u.RestingHeartRate < 25 || *u.RestingHeartRate > 120) {
+		return errors.New("resting_heart_rate must be between 25 and 120")
+	}
+	if u.MaxHeartRate != nil && u.RestingHeartRate != nil && *u.RestingHeartRate >= *u.MaxHeartRate {
+		return errors.New("resting_heart_rate must be below max_heart_rate")
+	}
+	return nil
+}
+
+// userHeartRates prefers the values on the profile. Max otherwise comes
+// from age (Tanaka: 208 - 0.7 × age), resting from the average of resting
+// heart-rate readings in the last 30 days.
+func userHeartRates(u User) heartRates {
+	hr := heartRates{MaxSource: "profile", RestingSource: "profile"}
+	if u.MaxHeartRate != nil {
+		hr.Max = *u.MaxHeartRate
+	} else {
+		hr.Max = int(math.Round(208 - 0.7*float64(u.Age)))
+		hr.MaxSource = "age"
+	}
+	if u.RestingHeartRate != nil {
+		hr.Resting = *u.RestingHeartRate
+	} else {
+		var avg *float64
+		since := localDate(time.Now().AddDate(0, 0, -30), userLocation(u.ID))
+		db.Model(&HealthRecord{}).Select("AVG(numeric_value)").
+			Where("user_id = ? AND type = ? AND date >= ?", u.ID, "resting_heart_rate", since).Scan(&avg)
+		if avg != nil && *avg > 0 {
+			hr.Resting = int(math.Round(*avg))
+			hr.RestingSource = "metric"
+		} else {
+			hr.Resting = defaultRestingHR
+			hr.RestingSource = "default"
+		}
+	}
+	if hr.Resting >= hr.Max {
+		hr.Resting = hr.Max - 1
+	}
+	return hr
+}
+
+// zoneRanges lists the bpm range of each zone, 0 to 5.
+func zoneRanges(hr heartRates) []gin.H {
+	reserve := float64(hr.Max - hr.Resting)
+	bpm := func(f float64) int { return int(math.Round(float64(hr.Resting) + f*reserve)) }
+	zones := []gin.H{{"zone": 0, "min": 0, "max": bpm(hrZoneBounds[0]) - 1}}
+	for i, lo := range hrZoneBounds {
+		hi := hr.Max
+		if i+1 < len(hrZoneBounds) {
+			hi = bpm(hrZoneBounds[i+1]) - 1
+		}
+		zones = append(zones, gin.H{"zone": i + 1, "min": bpm(lo), "max": hi})
+	}
+	return zones
+}
+
+func reserveFraction(bpm float64, hr heartRates) float64 {
+	f := (bpm - float64(hr.Resting)) / float64(hr.Max-hr.Resting)
+	return math.Max(0, math.Min(1, f))
+}
+
+func zoneOf(fraction float64) int {
+	zone := 0
+	for i, lo := range hrZoneBounds {
+		if fraction >= lo {
+			zone = i + 1
+		}
+	}
+	return zone
+}
+
+// banisterTRIMP is the load of minutes spent at a heart-rate reserve
+// fraction. The weighting differs for men and women.
+func banisterTRIMP(minutes, fraction float64, sex string) float64 {
+	f := sexFactor(sex)
+	weight := f*0.64*math.Exp(1.92*fraction) + (1-f)*0.86*math.Exp(1.67*fraction)
+	return minutes * fraction * weight
+}
+
+// computeWorkoutLoad works out time in zone and TRIMP from the recorded
+// heart rate when there is any, else from the average heart rate, else from
+// the intensity the user picked.
+func computeWorkoutLoad(w Workout, u User, hr heartRates) WorkoutLoad {
+	load := WorkoutLoad{WorkoutID: w.ID, UserID: w.UserID, MaxHR: hr.Max, RestingHR: hr.Resting}
+	var zones [6]int
+
+	var points []TrackPoint
+	db.Select("time", "heart_rate").
+		Where("workout_id = ? AND heart_rate IS NOT NULL AND time IS NOT NULL", w.ID).
+		Order("seq").Find(&points)
+	for i := 0; i+1 < len(points); i++ {
+		gap := points[i+1].Time.Sub(*points[i].Time)
+		if gap <= 0 || gap > maxSampleGap {
+			continue
+		}
+		f := reserveFraction(float64(*points[i].HeartRate), hr)
+		zones[zoneOf(f)] += int(gap.Seconds())
+		load.TRIMP += banisterTRIMP(gap.Minutes(), f, u.Sex)
+		load.HRBased = true
+	}
+
+	if !load.HRBased && w.Duration > 0 {
+		var f float64
+		if w.AvgHeartRate > 0 {
+			f = reserveFraction(float64(w.AvgHeartRate), hr)
+			load.HRBased = true
+		} else {
+			f = intensityReserve[intensityIndex(w.Intensity)]
+		}
+		zones[zoneOf(f)] = w.Duration * 60
+		load.TRIMP = banisterTRIMP(float64(w.Duration), f, u.Sex)
+	}
+	load.TRIMP = math.Round(load.TRIMP*10) / 10
+	load.setZones(zones)
+	return load
+}
+
+// workoutLoads returns the load of each workout, from the cache where it is
+// still valid; new results are written back.
+func workoutLoads(workouts []Workout, u User, hr heartRates) map[int]WorkoutLoad {
+	ids := make([]int, 0, len(workouts))
+	for _, w := range workouts {
+		ids = append(ids, w.ID)
+	}
+	var cached []WorkoutLoad
+	db.Where("workout_id IN ?", ids).Find(&cached)
+	loads := map[int]WorkoutLoad{}
+	for _, l := range cached {
+		if l.MaxHR == hr.Max && l.RestingHR == hr.Resting {
+			loads[l.WorkoutID] = l
+		}
+	}
+	var fresh []WorkoutLoad
+	for _, w := range workouts {
+		if _, ok := loads[w.ID]; ok {
+			continue
+		}
+		l := computeWorkoutLoad(w, u, hr)
+		loads[w.ID] = l
+		fresh = append(fresh, l)
+	}
+	if len(fresh) > 0 {
+		db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&fresh)
+	}
+	return loads
+}
+
+// invalidateTrainingLoads drops every cached load of a user, for changes
+// such as sex that alter TRIMP but are not stored with it.
+func invalidateTrainingLoads(userID int) {
+	db.Where("user_id = ?", userID).Delete(&WorkoutLoad{})
+}
+
+// invalidateWorkoutLoad drops the cached load of an edited or deleted
+// workout.
+func invalidateWorkoutLoad(workoutID int) {
+	db.Delete(&WorkoutLoad{}, workoutID)
+}
+
+// getTrainingLoad reports heart-rate zones, time in zone and TRIMP per
+// workout, and the daily load with its acute (7 day) and chronic (28 day)
+// averages and their ratio, between start and end (default last 28 days).
+func getTrainingLoad(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	loc := userLocation(userID)
+	startTime, _ := dayBounds(time.Now(), loc, -(chronicDays - 1))
+	endTime := startOfDay(time.Now(), loc)
+	var err error
+	if start := c.Query("start"); start != "" {
+		if startTime, err = time.ParseInLocation(dateLayout, start, loc); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date"})
+			return
+		}
+	}
+	if end := c.Query("end"); end != "" {
+		if endTime, err = time.ParseInLocation(dateLayout, end, loc); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date"})
+			return
+		}
+	}
+	if endTime.Before(startTime) || endTime.Sub(startTime) > 366*24*time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Range must be between 1 and 366 days"})
+		return
+	}
+	// The chronic average of the first day needs the 27 days before it.
+	from, _ := dayBounds(startTime, loc, -(chronicDays - 1))
+	_, rangeEnd := dayBounds(endTime, loc, 0)
+
+	var workouts []Workout
+	if err := db.Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, from, rangeEnd).
+		Order("created_at").Find(&workouts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	hr := userHeartRates(user)
+	loads := workoutLoads(workouts, user, hr)
+
+	loadByDay := map[string]float64{}
+	var zoneTotals [6]int
+	perWorkout := []gin.H{}
+	for _, w := range workouts {
+		l := loads[w.ID]
+		date := localDate(w.CreatedAt, loc)
+		loadByDay[date] += l.TRIMP
+		if w.CreatedAt.Before(startTime) {
+			continue
+		}
+		zones := l.zones()
+		for i, s := range zones {
+			zoneTotals[i] += s
+		}
+		perWorkout = append(perWorkout, gin.H{
+			"workout_id":   w.ID,
+			"date":         date,
+			"type":         w.Type,
+			"duration":     w.Duration,
+			"trimp":        l.TRIMP,
+			"hr_based":     l.HRBased,
+			"zone_seconds": zones,
+		})
+	}
+
+	// Rolling sums over the whole window, then report from startTime on.
+	var window []float64
+	for d := from; d.Before(rangeEnd); d, _ = dayBounds(d, loc, 1) {
+		window = append(window, loadByDay[d.Format(dateLayout)])
+	}
+	daily := []gin.H{}
+	i := 0
+	var acute, chronic float64
+	for d := from; d.Before(rangeEnd); d, _ = dayBounds(d, loc, 1) {
+		acute += window[i]
+		chronic += window[i]
+		if i >= acuteDays {
+			acute -= window[i-acuteDays]
+		}
+		if i >= chronicDays {
+			chronic -= window[i-chronicDays]
+		}
+		if !d.Before(startTime) {
+			acuteAvg := acute / acuteDays
+			chronicAvg := chronic / chronicDays
+			day := gin.H{
+				"date":    d.Format(dateLayout),
+				"load":    math.Round(window[i]*10) / 10,
+				"acute":   math.Round(acuteAvg*10) / 10,
+				"chronic": math.Round(chronicAvg*10) / 10,
+				"acwr":    nil,
+			}
+			if chronicAvg > 0 {
+				day["acwr"] = math.Round(acuteAvg/chronicAvg*100) / 100
+			}
+			daily = append(daily, day)
+		}
+		i++
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"heart_rate":   hr,
+		"zones":        zoneRanges(hr),
+		"zone_seconds": zoneTotals,
+		"workouts":     perWorkout,
+		"daily":        daily,
+	})
+}
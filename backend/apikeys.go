@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiKeyPrefix     = "hsk_"
+	maxAPIKeysActive = 25
+)
+
+// Scopes a device key can be granted.
+var apiKeyScopes = map[string]bool{
+	"healthrecords:read":  true,
+	"healthrecords:write": true,
+	"workouts:read":       true,
+	"workouts:write":      true,
+	"water:read":          true,
+	"water:write":         true,
+	"diet:read":           true,
+	"diet:write":          true,
+}
+
+// Routes reachable with an API key and the scope each one needs. Anything
+// not listed here (account settings including nutrition goals, key
+// management, social features) is JWT only.
+var apiKeyRouteScopes = map[string]string{
+	"GET /healthrecords":             "healthrecords:read",
+	"GET /healthrecords/:id":         "healthrecords:read",
+	"POST /healthrecords":            "healthrecords:write",
+	"PUT /healthrecords/:id":         "healthrecords:write",
+	"DELETE /healthrecords/:id":      "healthrecords:write",
+	"GET /metrics":                   "healthrecords:read",
+	"GET /metrics/:type/daily":       "healthrecords:read",
+	"GET /workouts":                  "workouts:read",
+	"GET /workouts/:id":              "workouts:read",
+	"GET /workouts/estimate":         "workouts:read",
+	"GET /workouts/:id/route":        "workouts:read",
+	"POST /workouts":                 "workouts:write",
+	"POST /workouts/import":          "workouts:write",
+	"GET /workouts/:id/exercises":    "workouts:read",
+	"PUT /workouts/:id/exercises":    "workouts:write",
+	"GET /records":                   "workouts:read",
+	"GET /summary/training-load":     "workouts:read",
+	"GET /exercises":                 "workouts:read",
+	"POST /exercises":                "workouts:write",
+	"GET /exercises/:id/history":     "workouts:read",
+	"GET /exercises/:id/progression": "workouts:read",
+	"PUT /workouts/:id":              "workouts:write",
+	"DELETE /workouts/:id":           "workouts:write",
+	"GET /water":                     "water:read",
+	"GET /water/:id":                 "water:read",
+	"POST /water":                    "water:write",
+	"PUT /water/:id":                 "water:write",
+	"DELETE /water/:id":              "water:write",
+	"GET /diet":                      "diet:read",
+	"GET /diet/:id":                  "diet:read",
+	"POST /diet":                     "diet:write",
+	"PUT /diet/:id":                  "diet:write",
+	"DELETE /diet/:id":               "diet:write",
+	"GET /foods":                     "diet:read",
+	"GET /foods/:id":                 "diet:read",
+	"GET /foods/barcode/:ean":        "diet:read",
+	"POST /foods":                    "diet:write",
+	"PUT /foods/:id":                 "diet:write",
+	"DELETE /foods/:id":              "diet:write",
+	"GET /recipes":                   "diet:read",
+	"GET /recipes/:id":               "diet:read",
+	"POST /recipes":                  "diet:write",
+	"PUT /recipes/:id":               "diet:write",
+	"DELETE /recipes/:id":            "diet:write",
+	"GET /nutrition/goals":           "diet:read",
+	"GET /nutrition/daily":           "diet:read",
+	"GET /meal-plan":                 "diet:read",
+	"POST /meal-plan":                "diet:write",
+	"PUT /meal-plan/:id":             "diet:write",
+	"DELETE /meal-plan/:id":          "diet:write",
+	"POST /meal-plan/log":            "diet:write",
+	"GET /meal-plan/shopping-list":   "diet:read",
+}
+
+// APIKey lets a device or script act for a user within a fixed set of
+// scopes. Only a SHA-256 hash of the secret part is stored; Prefix is the
+// public lookup handle shown in listings.
+type APIKey struct {
+	ID         int        `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID     int        `json:"user_id" gorm:"index;not null"`
+	Name       string     `json:"name" gorm:"not null"`
+	Prefix     string     `json:"prefix" gorm:"uniqueIndex;type:varchar(16);not null"`
+	KeyHash    string     `json:"-" gorm:"not null"`
+	Scopes     string     `json:"-" gorm:"type:text;not null"` // comma separated
+	CreatedAt  time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k APIKey) scopeList() []string {
+	if k.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+func (k APIKey) hasScope(scope string) bool {
+	for _, s := range k.scopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k APIKey) view() gin.H {
+	return gin.H{
+		"id":           k.ID,
+		"name":         k.Name,
+		"prefix":       k.Prefix,
+		"scopes":       k.scopeList(),
+		"created_at":   k.CreatedAt,
+		"expires_at":   k.ExpiresAt,
+		"last_used_at": k.LastUsedAt,
+		"last_used_ip": k.LastUsedIP,
+	}
+}
+
+func splitAPIKey(raw string) (prefix, secret string, ok bool) {
+	if !strings.HasPrefix(raw, apiKeyPrefix) {
+		return "", "", false
+	}
+	return strings.Cut(strings.TrimPrefix(raw, apiKeyPrefix), "_")
+}
+
+// authenticateAPIKey validates the key and the scope the current route needs.
+// On failure it aborts the request and returns false.
+func authenticateAPIKey(c *gin.Context, raw string) (*APIKey, bool) {
+	prefix, secret, ok := splitAPIKey(raw)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+	var key APIKey
+	if err := db.Where("prefix = ?", prefix).First(&key).Error; err != nil ||
+		subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(key.KeyHash)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+	now := time.Now()
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key revoked or expired"})
+		return nil, false
+	}
+	scope, allowed := apiKeyRouteScopes[c.Request.Method+" "+c.FullPath()]
+	if !allowed || !key.hasScope(scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key not allowed for this endpoint"})
+		return nil, false
+	}
+	// Keep writes down for chatty devices: last use is tracked to the minute.
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > time.Minute {
+		db.Model(&APIKey{}).Where("id = ?", key.ID).Updates(map[string]interface{}{
+			"last_used_at": now,
+			"last_used_ip": c.ClientIP(),
+		})
+	}
+	return &key, true
+}
+
+func getAPIKeys(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var apiKeys []APIKey
+	if err := db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("created_at desc").Find(&apiKeys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result := []gin.H{}
+	for _, k := range apiKeys {
+		result = append(result, k.view())
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func createAPIKey(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var req struct {
+		Name          string   `json:"name" binding:"required"`
+		Scopes        []string `json:"scopes" binding:"required"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	seen := map[string]bool{}
+	for _, s := range req.Scopes {
+		if !apiKeyScopes[s] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + s})
+			return
+		}
+		seen[s] = true
+	}
+	scopes := make([]string, 0, len(seen))
+	for s := range seen {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+
+	var active int64
+	db.Model(&APIKey{}).Where("user_id = ? AND revoked_at IS NULL", userID).Count(&active)
+	if active >= maxAPIKeysActive {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many active API keys, revoke one first"})
+		return
+	}
+
+	prefixBytes := make([]byte, 4)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key"})
+		return
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key"})
+		return
+	}
+	prefix := hex.EncodeToString(prefixBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	key := APIKey{
+		UserID:  userID,
+		Name:    req.Name,
+		Prefix:  prefix,
+		KeyHash: hashToken(secret),
+		Scopes:  strings.Join(scopes, ","),
+	}
+	if req.ExpiresInDays > 0 {
+		expires := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		key.ExpiresAt = &expires
+	}
+	if err := db.Create(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	view := key.view()
+	// The full key is only ever shown here.
+	view["key"] = apiKeyPrefix + prefix + "_" + secret
+	c.JSON(http.StatusCreated, view)
+}
+
+func deleteAPIKey(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+	res := db.Model(&APIKey{}).Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).Update("revoked_at", time.Now())
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const FoodSourceOFF = "off"
+
+// normalizeBarcode checks an EAN-8, EAN-13, UPC-A or GTIN-14 code and returns
+// it in the form it is stored: UPC-A gains the leading zero that makes it the
+// equivalent EAN-13 and a GTIN-14 with a leading zero loses it, so every
+// spelling finds the product. Other GTIN-14s name cases, not items.
+func normalizeBarcode(code string) (string, error) {
+	code = strings.TrimSpace(code)
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return "", errors.New("barcode must contain digits only")
+		}
+	}
+	switch len(code) {
+	case 12:
+		code = "0" + code
+	case 14:
+		if code[0] != '0' {
+			return "", errors.New("GTIN-14 barcodes of cases and pallets are not supported")
+		}
+		code = code[1:]
+	case 8, 13:
+	default:
+		return "", errors.New("barcode must be an EAN-8, EAN-13, UPC-A or GTIN-14 code")
+	}
+	if !validBarcodeChecksum(code) {
+		return "", errors.New("barcode check digit is wrong")
+	}
+	return code, nil
+}
+
+// validBarcodeChecksum applies the GS1 mod-10 check: digits are weighted
+// 3, 1, 3, ... from the right, not counting the check digit itself.
+func validBarcodeChecksum(code string) bool {
+	sum := 0
+	for i := len(code) - 2; i >= 0; i-- {
+		d := int(code[i] - '0')
+		if (len(code)-2-i)%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return (10-sum%10)%10 == int(code[len(code)-1]-'0')
+}
+
+// offProduct is the part of an Open Food Facts product the catalog uses,
+// read from either the JSONL or the CSV export. Nutriments keep the export's
+// keys, such as "proteins_100g" and "proteins_serving".
+type offProduct struct {
+	Code            string                 `json:"code"`
+	ProductName     string                 `json:"product_name"`
+	ProductNameEN   string                 `json:"product_name_en"`
+	GenericName     string                 `json:"generic_name"`
+	Brands          string                 `json:"brands"`
+	Categories      string                 `json:"categories"`
+	ServingSize     string                 `json:"serving_size"`
+	ServingQuantity interface{}            `json:"serving_quantity"`
+	Nutriments      map[string]interface{} `json:"nutriments"`
+}
+
+// offNutrients maps Food fields to Open Food Facts nutriment names.
+var offNutrients = map[string]string{
+	"protein": "proteins", "carbs": "carbohydrates", "fat": "fat", "fiber": "fiber",
+	"sugar": "sugars",
+}
+
+func offNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// per100g reads a nutriment per 100 g, working it out from the per-serving
+// value when the product only states that.
+func (p offProduct) per100g(name string, serving float64) (float64, bool) {
+	if v, ok := offNumber(p.Nutriments[name+"_100g"]); ok {
+		return v, true
+	}
+	if v, ok := offNumber(p.Nutriments[name+"_serving"]); ok && serving > 0 {
+		return v * 100 / serving, true
+	}
+	return 0, false
+}
+
+func (p offProduct) food() (Food, error) {
+	code, err := normalizeBarcode(p.Code)
+	if err != nil {
+		return Food{}, err
+	}
+	f := Food{Barcode: code, SourceID: code, ServingName: strings.TrimSpace(p.ServingSize)}
+	for _, name := range []string{p.ProductName, p.ProductNameEN, p.GenericName} {
+		if f.Name = strings.TrimSpace(name); f.Name != "" {
+			break
+		}
+	}
+	f.Brand = strings.TrimSpace(strings.Split(p.Brands, ",")[0])
+	if cats := strings.Split(p.Categories, ","); len(cats) > 0 {
+		f.Category = strings.TrimSpace(cats[len(cats)-1])
+	}
+	serving, _ := offNumber(p.ServingQuantity)
+	if serving > 0 {
+		f.ServingSize = serving
+	}
+	kcal, ok := p.per100g("energy-kcal", serving)
+	if !ok {
+		kj, ok := p.per100g("energy", serving)
+		if !ok {
+			return f, errors.New("product has no energy value")
+		}
+		kcal = kj / 4.184
+	}
+	f.Calories = roundTo(kcal, 1)
+	values := map[string]float64{}
+	for field, name := range offNutrients {
+		v, _ := p.per100g(name, serving)
+		values[field] = roundTo(v, 2)
+	}
+	f.Protein, f.Carbs, f.Fat, f.Fiber = values["protein"], values["carbs"], values["fat"], values["fiber"]
+	f.Sugar = values["sugar"]
+	// Open Food Facts gives sodium in grams, or only salt (2.5 × sodium).
+	sodium, ok := p.per100g("sodium", serving)
+	if !ok {
+		if salt, ok := p.per100g("salt", serving); ok {
+			sodium = salt / 2.5
+		}
+	}
+	f.Sodium = roundTo(sodium*1000, 0)
+	return f, nil
+}
+
+// offProductFromRecord reads a row of the tab-separated CSV export, whose
+// nutriment columns are named like the JSON nutriments.
+func offProductFromRecord(rec map[string]string) offProduct {
+	p := offProduct{
+		Code:            rec["code"],
+		ProductName:     rec["product_name"],
+		GenericName:     rec["generic_name"],
+		Brands:          rec["brands"],
+		Categories:      rec["main_category_en"],
+		ServingSize:     rec["serving_size"],
+		ServingQuantity: rec["serving_quantity"],
+		Nutriments:      map[string]interface{}{},
+	}
+	if p.Categories == "" {
+		p.Categories = rec["categories_en"]
+	}
+	for col, v := range rec {
+		if v != "" && (strings.HasSuffix(col, "_100g") || strings.HasSuffix(col, "_serving")) {
+			p.Nutriments[col] = v
+		}
+	}
+	return p
+}
+
+func (imp *foodImporter) addOFF(p offProduct) error {
+	f, err := p.food()
+	if err != nil {
+		imp.skipped++
+		return nil
+	}
+	return imp.add(f)
+}
+
+// importOFFJSONL streams the JSONL export, one product per line.
+func (imp *foodImporter) importOFFJSONL(dec *json.Decoder) error {
+	for dec.More() {
+		var p offProduct
+		if err := dec.Decode(&p); err != nil {
+			return err
+		}
+		if err := imp.addOFF(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// foodNutrition is the nutrients of grams of food.
+func foodNutrition(food Food, grams float64) gin.H {
+	f := grams / 100
+	return gin.H{
+		"grams":    roundTo(grams, 1),
+		"calories": roundTo(food.Calories*f, 0),
+		"protein":  roundTo(food.Protein*f, 1),
+		"carbs":    roundTo(food.Carbs*f, 1),
+		"fat":      roundTo(food.Fat*f, 1),
+		"fiber":    roundTo(food.Fiber*f, 1),
+		"sugar":    roundTo(food.Sugar*f, 1),
+		"sodium":   roundTo(food.Sodium*f, 0),
+	}
+}
+
+func findFoodByBarcode(userID int, code string) (Food, error) {
+	var food Food
+	err := visibleFoods(db, userID).Where("barcode = ?", code).
+		Order("user_id IS NULL, id").First(&food).Error
+	return food, err
+}
+
+// getFoodByBarcode looks up a packaged food by its EAN or UPC code, the
+// user's own foods first, and returns its nutrients per 100 g and per
+// serving.
+func getFoodByBarcode(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	code, err := normalizeBarcode(c.Param("ean"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	food, err := findFoodByBarcode(userID, code)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No food with barcode %s", code)})
+		return
+	}
+	var perServing gin.H
+	if food.ServingSize > 0 {
+		perServing = foodNutrition(food, food.ServingSize)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"food":        food,
+		"per_100g":    foodNutrition(food, 100),
+		"per_serving": perServing,
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metTable holds MET values (low, medium, high intensity) per workout type,
+// after the Compendium of Physical Activities.
+var metTable = map[string][3]float64{
+	"running":    {7.0, 9.8, 12.3},
+	"jogging":    {6.0, 7.0, 8.8},
+	"walking":    {2.8, 3.5, 5.0},
+	"hiking":     {5.3, 6.0, 7.8},
+	"cycling":    {4.0, 6.8, 10.0},
+	"swimming":   {5.8, 8.3, 10.0},
+	"rowing":     {4.8, 7.0, 8.5},
+	"elliptical": {4.6, 5.0, 6.2},
+	"gym":        {3.5, 5.0, 6.0},
+	"strength":   {3.5, 5.0, 6.0},
+	"hiit":       {6.0, 8.0, 10.0},
+	"yoga":       {2.5, 3.0, 4.0},
+	"pilates":    {3.0, 3.8, 4.5},
+	"dancing":    {4.5, 5.5, 7.3},
+	"football":   {7.0, 8.0, 10.0},
+	"basketball": {4.5, 6.5, 8.0},
+	"tennis":     {5.0, 7.3, 8.0},
+	"boxing":     {5.5, 7.8, 12.8},
+	"climbing":   {5.8, 7.5, 8.0},
+	"skiing":     {4.3, 5.3, 8.0},
+}
+
+var metAliases = map[string]string{
+	"run":             "running",
+	"walk":            "walking",
+	"bike":            "cycling",
+	"biking":          "cycling",
+	"swim":            "swimming",
+	"weight_training": "strength",
+	"weights":         "strength",
+	"soccer":          "football",
+	"dance":           "dancing",
+	"bouldering":      "climbing",
+}
+
+// Used when the type is unknown, keyed by workout category.
+var metByCategory = map[string][3]float64{
+	"cardio":      {4.0, 6.0, 8.0},
+	"strength":    {3.5, 5.0, 6.0},
+	"flexibility": {2.3, 2.5, 3.0},
+	"balance":     {2.0, 2.5, 3.0},
+	"":            {3.0, 4.5, 6.0},
+}
+
+func normalizeKey(s string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(s)), " ", "_")
+}
+
+func intensityIndex(intensity string) int {
+	switch normalizeKey(intensity) {
+	case "low", "light", "easy":
+		return 0
+	case "high", "vigorous", "hard":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// lookupMET finds the MET value for a workout, falling back to its category
+// and then to a generic value.
+func lookupMET(workoutType, category, intensity string) float64 {
+	key := normalizeKey(workoutType)
+	if alias, ok := metAliases[key]; ok {
+		key = alias
+	}
+	row, ok := metTable[key]
+	if !ok {
+		if row, ok = metByCategory[normalizeKey(category)]; !ok {
+			row = metByCategory[""]
+		}
+	}
+	return row[intensityIndex(intensity)]
+}
+
+// restingKcalPerMinute is the Mifflin-St Jeor BMR spread over the day.
+func restingKcalPerMinute(u User) float64 {
+	return mifflinBMR(u.Weight, u.Height, u.Age, u.Sex) / 1440
+}
+
+// estimateCalories applies the corrected MET method: the 3.5 ml/kg/min that
+// one MET assumes is replaced by the user's own resting rate, so age, sex and
+// height count alongside weight.
+func estimateCalories(u User, workoutType, category, intensity string, minutes int) int {
+	if minutes <= 0 || u.Weight <= 0 {
+		return 0
+	}
+	met := lookupMET(workoutType, category, intensity)
+	resting := restingKcalPerMinute(u)
+	if resting <= 0 {
+		// Profile values too odd for the formula; fall back to plain METs.
+		resting = 3.5 * u.Weight / 200
+	}
+	return int(math.Round(met * resting * float64(minutes)))
+}
+
+// applyCalorieEstimate fills in Calories when the client left them out. On
+// updates prev is the stored workout: an estimate echoed back unchanged is
+// recomputed so edits to duration or intensity carry through.
+func applyCalorieEstimate(w *Workout, prev *Workout, u User) {
+	omitted := w.Calories == 0
+	if prev != nil && prev.CaloriesEstimated && w.Calories == prev.Calories {
+		omitted = true
+	}
+	if !omitted {
+		w.CaloriesEstimated = false
+		return
+	}
+	w.Calories = estimateCalories(u, w.Type, w.Category, w.Intensity, w.Duration)
+	w.CaloriesEstimated = w.Calories > 0
+}
+
+// recalculateEstimatedCalories refreshes every estimated workout of a user
+// who opted in, after their profile weight changed.
+func recalculateEstimatedCalories(userID int) {
+	var settings Settings
+	if err := db.Where("user_id = ?", userID).Limit(1).Find(&settings).Error; err != nil || !settings.RecalculateCalories {
+		return
+	}
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		return
+	}
+	var workouts []Workout
+	db.Where("user_id = ? AND calories_estimated = ?", userID, true).Find(&workouts)
+	for _, w := range workouts {
+		calories := estimateCalories(user, w.Type, w.Category, w.Intensity, w.Duration)
+		if calories == w.Calories {
+			continue
+		}
+		if err := db.Model(&Workout{}).Where("id = ?", w.ID).Update("calories", calories).Error; err != nil {
+			log.Printf("failed to recalculate calories for workout %d: %v", w.ID, err)
+		}
+	}
+}
+
+// getCalorieEstimate previews the estimate for a workout that has not been
+// saved yet.
+func getCalorieEstimate(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	minutes, err := strconv.Atoi(c.Query("duration"))
+	if err != nil || minutes <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duration must be a positive number of minutes"})
+		return
+	}
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	workoutType := c.Query("type")
+	category := c.Query("category")
+	intensity := c.DefaultQuery("intensity", "medium")
+	c.JSON(http.StatusOK, gin.H{
+		"calories": estimateCalories(user, workoutType, category, intensity, minutes),
+		"met":      lookupMET(workoutType, category, intensity),
+	})
+}
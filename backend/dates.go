@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const dateLayout = "2006-01-02"
+
+// parseTimeParam accepts either a plain date, taken as midnight in loc, or an
+// RFC 3339 timestamp. A plain date used as the upper bound of a range covers
+// that whole day, so the returned bound is exclusive in that case.
+func parseTimeParam(value string, upper bool, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(dateLayout, value, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// filterByTimeRange applies the optional start/end query parameters to
+// column, reading plain dates in the user's time zone. It returns false
+// (after answering 400) on a malformed value.
+func filterByTimeRange(c *gin.Context, query *gorm.DB, column string) (*gorm.DB, bool) {
+	loc := userLocation(c.GetInt("user_id"))
+	if start := c.Query("start"); start != "" {
+		t, err := parseTimeParam(start, false, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date"})
+			return nil, false
+		}
+		query = query.Where(column+" >= ?", t)
+	}
+	if end := c.Query("end"); end != "" {
+		t, err := parseTimeParam(end, true, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date"})
+			return nil, false
+		}
+		if len(end) == len(dateLayout) {
+			query = query.Where(column+" < ?", t)
+		} else {
+			query = query.Where(column+" <= ?", t)
+		}
+	}
+	return query, true
+}
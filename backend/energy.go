@@ -0,0 +1,308 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FormulaMifflin        = "mifflin"
+	FormulaHarrisBenedict = "harris_benedict"
+
+	GoalLose     = "lose"
+	GoalMaintain = "maintain"
+	GoalGain     = "gain"
+
+	kcalPerKg         = 7700 // energy in one kg of body weight change
+	maxWeeklyRateKg   = 1.0
+	minCalorieTarget  = 1200
+	activityWindow    = 28 // days of workouts averaged into TDEE
+	sedentaryActivity = 1.2
+	minutesPerDay     = 24 * 60
+)
+
+// CalorieTarget keeps every value Settings.CaloriesGoal has taken, with the
+// inputs that produced it.
+type CalorieTarget struct {
+	ID         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID     int       `json:"user_id" gorm:"index;not null"`
+	Calories   int       `json:"calories" gorm:"not null"`
+	BMR        float64   `json:"bmr"`
+	TDEE       float64   `json:"tdee"`
+	GoalMode   string    `json:"goal_mode" gorm:"type:varchar(16)"`
+	WeeklyRate float64   `json:"weekly_rate"`                    // kg per week
+	Reason     string    `json:"reason" gorm:"type:varchar(32)"` // manual, settings, profile, weight, workout
+	CreatedAt  time.Time `json:"created_at" gorm:"autoCreateTime;index"`
+}
+
+// sexFactor picks between the male and female variant of a formula; any
+// other value gets the midpoint.
+func sexFactor(sex string) float64 {
+	switch normalizeKey(sex) {
+	case "man", "male", "m":
+		return 1
+	case "woman", "female", "f":
+		return 0
+	default:
+		return 0.5
+	}
+}
+
+func mifflinBMR(weight, height float64, age int, sex string) float64 {
+	base := 10*weight + 6.25*height - 5*float64(age)
+	return base + 5 - 166*(1-sexFactor(sex))
+}
+
+// harrisBenedictBMR is the Roza and Shizgal revision.
+func harrisBenedictBMR(weight, height float64, age int, sex string) float64 {
+	male := 88.362 + 13.397*weight + 4.799*height - 5.677*float64(age)
+	female := 447.593 + 9.247*weight + 3.098*height - 4.330*float64(age)
+	f := sexFactor(sex)
+	return f*male + (1-f)*female
+}
+
+func computeBMR(formula string, weight, height float64, age int, sex string) float64 {
+	if formula == FormulaHarrisBenedict {
+		return harrisBenedictBMR(weight, height, age, sex)
+	}
+	return mifflinBMR(weight, height, age, sex)
+}
+
+// currentWeight is the latest weight record, or the profile weight when
+// nothing has been logged.
+func currentWeight(u User) float64 {
+	var rec HealthRecord
+	err := db.Where("user_id = ? AND type = ? AND numeric_value IS NOT NULL", u.ID, "weight").
+		Order("date desc, id desc").Limit(1).Find(&rec).Error
+	if err == nil && rec.NumericValue != nil {
+		return *rec.NumericValue
+	}
+	return u.Weight
+}
+
+// energyReport holds everything the calorie target is derived from.
+type energyReport struct {
+	Weight        float64
+	BMR           float64
+	ActivityKcal  float64 // average workout calories per day above the sedentary baseline
+	TDEE          float64
+	Target        int
+	GoalMode      string
+	WeeklyRate    float64
+	Formula       string
+	TargetClamped bool
+}
+
+func buildEnergyReport(u User, settings Settings) energyReport {
+	r := energyReport{
+		Weight:     currentWeight(u),
+		GoalMode:   settings.GoalMode,
+		WeeklyRate: settings.WeeklyRate,
+		Formula:    settings.BMRFormula,
+	}
+	if r.Formula != FormulaHarrisBenedict {
+		r.Formula = FormulaMifflin
+	}
+	r.BMR = computeBMR(r.Formula, r.Weight, u.Height, u.Age, u.Sex)
+
+	// Workout calories are gross; the sedentary baseline already covers the
+	// resting share of each workout minute, so only the excess is added.
+	var burned float64
+	restingPerMinute := r.BMR * sedentaryActivity / minutesPerDay
+	since := time.Now().AddDate(0, 0, -activityWindow)
+	db.Model(&Workout{}).Select("COALESCE(SUM(GREATEST(calories - ? * duration, 0)), 0)", restingPerMinute).
+		Where("user_id = ? AND created_at >= ?", u.ID, since).Scan(&burned)
+	r.ActivityKcal = burned / activityWindow
+	r.TDEE = r.BMR*sedentaryActivity + r.ActivityKcal
+
+	delta := r.WeeklyRate * kcalPerKg / 7
+	target := r.TDEE
+	switch r.GoalMode {
+	case GoalLose:
+		target -= delta
+	case GoalGain:
+		target += delta
+	}
+	if target < minCalorieTarget {
+		target = minCalorieTarget
+		r.TargetClamped = true
+	}
+	r.Target = int(math.Round(target))
+	return r
+}
+
+// profileChanged reports whether anything the BMR depends on changed.
+func profileChanged(a, b User) bool {
+	return a.Weight != b.Weight || a.Height != b.Height || a.Age != b.Age || a.Sex != b.Sex
+}
+
+func loadSettings(userID int) Settings {
+	settings := Settings{UserID: userID, NotificationsEnabled: true, Theme: "light", WaterGoal: 2000, CaloriesGoal: 2000, StepsGoal: 10000, Units: UnitsMetric, GoalMode: GoalMaintain, BMRFormula: FormulaMifflin}
+	if err := db.FirstOrCreate(&settings, Settings{UserID: userID}).Error; err != nil {
+		log.Printf("failed to load settings for user %d: %v", userID, err)
+	}
+	return settings
+}
+
+// recordCalorieTarget appends to the history when the goal actually changed.
+func recordCalorieTarget(userID, previous int, r energyReport, reason string) {
+	if previous == r.Target {
+		return
+	}
+	entry := CalorieTarget{
+		UserID:     userID,
+		Calories:   r.Target,
+		BMR:        math.Round(r.BMR),
+		TDEE:       math.Round(r.TDEE),
+		GoalMode:   r.GoalMode,
+		WeeklyRate: r.WeeklyRate,
+		Reason:     reason,
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("failed to record calorie target: %v", err)
+	}
+}
+
+// refreshCalorieGoal recomputes CaloriesGoal for users who turned on
+// automatic targets. reason says what changed.
+func refreshCalorieGoal(userID int, reason string) {
+	settings := loadSettings(userID)
+	if !settings.AutoCaloriesGoal {
+		return
+	}
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		return
+	}
+	r := buildEnergyReport(user, settings)
+	if r.Target == settings.CaloriesGoal {
+		return
+	}
+	if err := db.Model(&Settings{}).Where("user_id = ?", userID).Update("calories_goal", r.Target).Error; err != nil {
+		log.Printf("failed to update calorie goal: %v", err)
+		return
+	}
+	recordCalorieTarget(userID, settings.CaloriesGoal, r, reason)
+}
+
+func energyView(r energyReport, u User, settings Settings, units string) gin.H {
+	weight, weightUnit := massUnits.display(r.Weight, units)
+	rate, _ := massUnits.display(r.WeeklyRate, units)
+	return gin.H{
+		"weight":             weight,
+		"weight_unit":        weightUnit,
+		"formula":            r.Formula,
+		"bmr":                math.Round(r.BMR),
+		"bmr_mifflin":        math.Round(mifflinBMR(r.Weight, u.Height, u.Age, u.Sex)),
+		"bmr_harris":         math.Round(harrisBenedictBMR(r.Weight, u.Height, u.Age, u.Sex)),
+		"activity_kcal":      math.Round(r.ActivityKcal),
+		"tdee":               math.Round(r.TDEE),
+		"goal_mode":          r.GoalMode,
+		"weekly_rate":        rate,
+		"target":             r.Target,
+		"target_clamped":     r.TargetClamped,
+		"calories_goal":      settings.CaloriesGoal,
+		"auto_calories_goal": settings.AutoCaloriesGoal,
+	}
+}
+
+func getEnergy(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	settings := loadSettings(userID)
+	c.JSON(http.StatusOK, energyView(buildEnergyReport(user, settings), user, settings, userUnits(userID)))
+}
+
+// updateEnergyGoal sets the goal mode, weekly rate (in the user's units
+// unless weekly_rate_unit says otherwise), BMR formula and whether
+// CaloriesGoal follows the computed target.
+func updateEnergyGoal(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var req struct {
+		GoalMode       string   `json:"goal_mode"`
+		WeeklyRate     *float64 `json:"weekly_rate"`
+		WeeklyRateUnit string   `json:"weekly_rate_unit"`
+		Formula        string   `json:"formula"`
+		Auto           *bool    `json:"auto_calories_goal"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	settings := loadSettings(userID)
+	units := userUnits(userID)
+	if req.GoalMode != "" {
+		if req.GoalMode != GoalLose && req.GoalMode != GoalMaintain && req.GoalMode != GoalGain {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "goal_mode must be lose, maintain or gain"})
+			return
+		}
+		settings.GoalMode = req.GoalMode
+	}
+	if req.WeeklyRate != nil {
+		rate, err := massUnits.toCanonical(*req.WeeklyRate, req.WeeklyRateUnit, units)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if rate < 0 || rate > maxWeeklyRateKg {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "weekly_rate must be between 0 and 1 kg per week"})
+			return
+		}
+		settings.WeeklyRate = rate
+	}
+	if req.Formula != "" {
+		if req.Formula != FormulaMifflin && req.Formula != FormulaHarrisBenedict {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "formula must be mifflin or harris_benedict"})
+			return
+		}
+		settings.BMRFormula = req.Formula
+	}
+	if req.Auto != nil {
+		settings.AutoCaloriesGoal = *req.Auto
+	}
+	if settings.GoalMode == GoalMaintain {
+		settings.WeeklyRate = 0
+	}
+	previous := settings.CaloriesGoal
+	r := buildEnergyReport(user, settings)
+	if settings.AutoCaloriesGoal {
+		settings.CaloriesGoal = r.Target
+	}
+	if err := db.Model(&Settings{}).Where("user_id = ?", userID).Updates(map[string]interface{}{
+		"goal_mode":          settings.GoalMode,
+		"weekly_rate":        settings.WeeklyRate,
+		"bmr_formula":        settings.BMRFormula,
+		"auto_calories_goal": settings.AutoCaloriesGoal,
+		"calories_goal":      settings.CaloriesGoal,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if settings.AutoCaloriesGoal {
+		recordCalorieTarget(userID, previous, r, "settings")
+	}
+	c.JSON(http.StatusOK, energyView(r, user, settings, units))
+}
+
+func getCalorieTargets(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var targets []CalorieTarget
+	if err := db.Where("user_id = ?", userID).Order("created_at desc").Limit(365).Find(&targets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, targets)
+}
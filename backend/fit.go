@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// A minimal reader for Garmin FIT activity files: only record (track point)
+// and session messages are decoded, everything else is skipped by size.
+
+const (
+	fitMesgSession = 18
+	fitMesgRecord  = 20
+
+	fitFieldTimestamp = 253
+)
+
+// FIT timestamps count seconds from 1989-12-31T00:00:00Z.
+var fitEpoch = time.Date(1989, 12, 31, 0, 0, 0, 0, time.UTC)
+
+var errFITCorrupt = errors.New("FIT file is corrupt or truncated")
+
+// fitSports maps the FIT sport enum to workout types.
+var fitSports = map[int64]string{
+	1:  "running",
+	2:  "cycling",
+	4:  "fitness_equipment",
+	5:  "swimming",
+	10: "strength",
+	11: "walking",
+	13: "skiing",
+	15: "rowing",
+	17: "hiking",
+	31: "climbing",
+}
+
+type fitField struct {
+	num      byte
+	size     int
+	baseType byte
+}
+
+type fitDefinition struct {
+	global    uint16
+	bigEndian bool
+	fields    []fitField
+	devSize   int // bytes of developer fields, skipped
+}
+
+// fitCRC is the checksum from the FIT SDK, computed nibble by nibble.
+func fitCRC(data []byte) uint16 {
+	table := [16]uint16{
+		0x0000, 0xCC01, 0xD801, 0x1400, 0xF001, 0x3C00, 0x2800, 0xE401,
+		0xA001, 0x6C00, 0x7800, 0xB401, 0x5000, 0x9C01, 0x8801, 0x4400,
+	}
+	var crc uint16
+	for _, b := range data {
+		tmp := table[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ table[b&0xF]
+		tmp = table[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ table[(b>>4)&0xF]
+	}
+	return crc
+}
+
+func fitBaseSize(baseType byte) int {
+	switch baseType & 0x1F {
+	case 0x00, 0x01, 0x02, 0x0A, 0x0D:
+		return 1
+	case 0x03, 0x04, 0x0B:
+		return 2
+	case 0x05, 0x06, 0x0C:
+		return 4
+	}
+	return 0
+}
+
+// fitValue decodes an integer field, reporting false for the base type's
+// "invalid" marker or for types it does not handle.
+func fitValue(b []byte, baseType byte, bigEndian bool) (int64, bool) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	switch baseType & 0x1F {
+	case 0x00, 0x02, 0x0D: // enum, uint8, byte
+		return int64(b[0]), b[0] != 0xFF
+	case 0x01: // sint8
+		return int64(int8(b[0])), b[0] != 0x7F
+	case 0x0A: // uint8z
+		return int64(b[0]), b[0] != 0
+	case 0x03: // sint16
+		v := order.Uint16(b)
+		return int64(int16(v)), v != 0x7FFF
+	case 0x04: // uint16
+		v := order.Uint16(b)
+		return int64(v), v != 0xFFFF
+	case 0x0B: // uint16z
+		v := order.Uint16(b)
+		return int64(v), v != 0
+	case 0x05: // sint32
+		v := order.Uint32(b)
+		return int64(int32(v)), v != 0x7FFFFFFF
+	case 0x06: // uint32
+		v := order.Uint32(b)
+		return int64(v), v != 0xFFFFFFFF
+	case 0x0C: // uint32z
+		v := order.Uint32(b)
+		return int64(v), v != 0
+	}
+	return 0, false
+}
+
+func semicirclesToDegrees(v int64) float64 {
+	return float64(v) * (180 / math.Pow(2, 31))
+}
+
+// parseFIT reads the track points and sport of a FIT activity.
+func parseFIT(data []byte) (*parsedTrack, error) {
+	if len(data) < 12 || string(data[8:12]) != ".FIT" {
+		return nil, errors.New("not a FIT file")
+	}
+	headerSize := int(data[0])
+	dataSize := int(binary.LittleEndian.Uint32(data[4:8]))
+	end := headerSize + dataSize
+	if headerSize < 12 || end+2 > len(data) {
+		return nil, errFITCorrupt
+	}
+	if fitCRC(data[:end]) != binary.LittleEndian.Uint16(data[end:end+2]) {
+		return nil, errFITCorrupt
+	}
+
+	track := &parsedTrack{}
+	defs := map[byte]*fitDefinition{}
+	var lastTimestamp int64
+	pos := headerSize
+	for pos < end {
+		header := data[pos]
+		pos++
+		var local byte
+		var compressedTime int64 = -1
+		switch {
+		case header&0x80 != 0:
+			// Compressed timestamp header: a 5 bit offset from the last
+			// full timestamp, for local types 0-3.
+			local = (header >> 5) & 0x03
+			offset := int64(header & 0x1F)
+			ts := lastTimestamp&^0x1F + offset
+			if offset < lastTimestamp&0x1F {
+				ts += 0x20
+			}
+			compressedTime = ts
+			lastTimestamp = ts
+		case header&0x40 != 0:
+			if pos+5 > end {
+				return nil, errFITCorrupt
+			}
+			def := &fitDefinition{bigEndian: data[pos+1] == 1}
+			if def.bigEndian {
+				def.global = binary.BigEndian.Uint16(data[pos+2 : pos+4])
+			} else {
+				def.global = binary.LittleEndian.Uint16(data[pos+2 : pos+4])
+			}
+			n := int(data[pos+4])
+			pos += 5
+			if pos+3*n > end {
+				return nil, errFITCorrupt
+			}
+			for i := 0; i < n; i++ {
+				def.fields = append(def.fields, fitField{num: data[pos], size: int(data[pos+1]), baseType: data[pos+2]})
+				pos += 3
+			}
+			if header&0x20 != 0 {
+				if pos >= end {
+					return nil, errFITCorrupt
+				}
+				devFields := int(data[pos])
+				pos++
+				if pos+3*devFields > end {
+					return nil, errFITCorrupt
+				}
+				for i := 0; i < devFields; i++ {
+					def.devSize += int(data[pos+1])
+					pos += 3
+				}
+			}
+			defs[header&0x0F] = def
+			continue
+		default:
+			local = header & 0x0F
+		}
+
+		def, ok := defs[local]
+		if !ok {
+			return nil, errFITCorrupt
+		}
+		values := map[byte]int64{}
+		for _, f := range def.fields {
+			if pos+f.size > end {
+				return nil, errFITCorrupt
+			}
+			// Arrays and strings are skipped; nothing read here needs them.
+			if f.size == fitBaseSize(f.baseType) {
+				if v, valid := fitValue(data[pos:pos+f.size], f.baseType, def.bigEndian); valid {
+					values[f.num] = v
+				}
+			}
+			pos += f.size
+		}
+		pos += def.devSize
+		if pos > end {
+			return nil, errFITCorrupt
+		}
+		if ts, ok := values[fitFieldTimestamp]; ok {
+			lastTimestamp = ts
+		} else if compressedTime >= 0 {
+			values[fitFieldTimestamp] = compressedTime
+		}
+
+		switch def.global {
+		case fitMesgRecord:
+			track.Points = append(track.Points, fitTrackPoint(values))
+		case fitMesgSession:
+			if sport, ok := values[5]; ok && track.Sport == "" {
+				track.Sport = fitSports[sport]
+			}
+		}
+	}
+	return track, nil
+}
+
+func fitTrackPoint(values map[byte]int64) TrackPoint {
+	var p TrackPoint
+	if ts, ok := values[fitFieldTimestamp]; ok {
+		t := fitEpoch.Add(time.Duration(ts) * time.Second)
+		p.Time = &t
+	}
+	lat, okLat := values[0]
+	lon, okLon := values[1]
+	if okLat && okLon {
+		la, lo := semicirclesToDegrees(lat), semicirclesToDegrees(lon)
+		p.Lat, p.Lon = &la, &lo
+	}
+	// enhanced_altitude (78) supersedes altitude (2); both are m*5 + 500.
+	if alt, ok := values[78]; ok {
+		e := float64(alt)/5 - 500
+		p.Elevation = &e
+	} else if alt, ok := values[2]; ok {
+		e := float64(alt)/5 - 500
+		p.Elevation = &e
+	}
+	if hr, ok := values[3]; ok {
+		v := int(hr)
+		p.HeartRate = &v
+	}
+	if cad, ok := values[4]; ok {
+		v := int(cad)
+		p.Cadence = &v
+	}
+	if dist, ok := values[5]; ok {
+		d := float64(dist) / 100
+		p.Distance = &d
+	}
+	return p
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm/clause"
+)
+
+const foodsUsage = `usage: foods <command>
+  import [-source name] <file>  load a nutrition dataset into the food catalog:
+                                a USDA FoodData Central JSON download, an Open
+                                Food Facts JSONL or CSV export, or a CSV or
+                                JSON array with name, brand, category,
+                                calories, protein, carbs, fat, fiber, sugar,
+                                sodium (mg), serving_size, serving_name,
+                                barcode and id columns`
+
+const foodImportBatch = 1000
+
+// foodColumns maps the column names accepted in CSV and JSON datasets to
+// the Food field they fill. Values are per 100 g.
+var foodColumns = map[string]string{
+	"name": "name", "description": "name", "food": "name",
+	"brand": "brand", "brand_owner": "brand",
+	"category": "category", "food_category": "category",
+	"calories": "calories", "kcal": "calories", "energy_kcal": "calories",
+	"protein": "protein", "proteins": "protein",
+	"carbs": "carbs", "carbohydrate": "carbs", "carbohydrates": "carbs",
+	"fat": "fat", "total_fat": "fat",
+	"fiber": "fiber", "fibre": "fiber",
+	"sugar": "sugar", "sugars": "sugar",
+	"sodium": "sodium", "sodium_mg": "sodium",
+	"serving_size": "serving_size", "serving_g": "serving_size",
+	"serving_name": "serving_name", "household_serving": "serving_name",
+	"id": "id", "source_id": "id", "fdc_id": "id",
+	"barcode": "barcode", "ean": "barcode", "gtin": "barcode", "upc": "barcode",
+}
+
+// USDA nutrient numbers. Foundation foods often only carry the Atwater
+// energy values, so those are read when 208 is missing.
+var usdaNutrients = map[string]string{
+	"208": "calories", "957": "calories_atwater", "958": "calories_atwater", "268": "kj",
+	"203": "protein", "205": "carbs", "204": "fat", "291": "fiber",
+	"269": "sugar", "307": "sodium",
+}
+
+type usdaFood struct {
+	FdcID               int    `json:"fdcId"`
+	Description         string `json:"description"`
+	BrandOwner          string `json:"brandOwner"`
+	BrandName           string `json:"brandName"`
+	BrandedFoodCategory string `json:"brandedFoodCategory"`
+	FoodCategory        *struct {
+		Description string `json:"description"`
+	} `json:"foodCategory"`
+	WweiaFoodCategory *struct {
+		Description string `json:"wweiaFoodCategoryDescription"`
+	} `json:"wweiaFoodCategory"`
+	GtinUpc          string  `json:"gtinUpc"`
+	ServingSize      float64 `json:"servingSize"`
+	ServingSizeUnit  string  `json:"servingSizeUnit"`
+	HouseholdServing string  `json:"householdServingFullText"`
+	FoodNutrients    []struct {
+		Nutrient struct {
+			Number string `json:"number"`
+		} `json:"nutrient"`
+		Amount float64 `json:"amount"`
+	} `json:"foodNutrients"`
+	FoodPortions []struct {
+		GramWeight         float64 `json:"gramWeight"`
+		Amount             float64 `json:"amount"`
+		PortionDescription string  `json:"portionDescription"`
+		Modifier           string  `json:"modifier"`
+		MeasureUnit        struct {
+			Name string `json:"name"`
+		} `json:"measureUnit"`
+	} `json:"foodPortions"`
+}
+
+func (u usdaFood) food() Food {
+	f := Food{
+		Name:     u.Description,
+		Brand:    u.BrandName,
+		Category: u.BrandedFoodCategory,
+		SourceID: strconv.Itoa(u.FdcID),
+	}
+	if f.Brand == "" {
+		f.Brand = u.BrandOwner
+	}
+	if code, err := normalizeBarcode(u.GtinUpc); err == nil {
+		f.Barcode = code
+	}
+	if u.FoodCategory != nil && f.Category == "" {
+		f.Category = u.FoodCategory.Description
+	}
+	if u.WweiaFoodCategory != nil && f.Category == "" {
+		f.Category = u.WweiaFoodCategory.Description
+	}
+	values := map[string]float64{}
+	for _, n := range u.FoodNutrients {
+		if key, ok := usdaNutrients[n.Nutrient.Number]; ok {
+			values[key] = n.Amount
+		}
+	}
+	f.Calories = values["calories"]
+	if f.Calories == 0 {
+		f.Calories = values["calories_atwater"]
+	}
+	if f.Calories == 0 {
+		f.Calories = values["kj"] / 4.184
+	}
+	f.Calories = roundTo(f.Calories, 1)
+	f.Protein, f.Carbs, f.Fat, f.Fiber = values["protein"], values["carbs"], values["fat"], values["fiber"]
+	f.Sugar, f.Sodium = values["sugar"], values["sodium"]
+
+	// Branded foods state their serving; the others list household portions.
+	switch unit := strings.ToLower(u.ServingSizeUnit); {
+	case u.ServingSize > 0 && (unit == "g" || unit == "grm"):
+		f.ServingSize, f.ServingName = u.ServingSize, u.HouseholdServing
+	case u.ServingSize == 0:
+		for _, p := range u.FoodPortions {
+			if p.GramWeight <= 0 {
+				continue
+			}
+			f.ServingSize = p.GramWeight
+			f.ServingName = p.PortionDescription
+			if f.ServingName == "" {
+				parts := []string{strconv.FormatFloat(p.Amount, 'f', -1, 64)}
+				if p.MeasureUnit.Name != "" && p.MeasureUnit.Name != "undetermined" {
+					parts = append(parts, p.MeasureUnit.Name)
+				}
+				if p.Modifier != "" {
+					parts = append(parts, p.Modifier)
+				}
+				f.ServingName = strings.Join(parts, " ")
+			}
+			break
+		}
+	}
+	return f
+}
+
+// foodFromRecord reads one CSV row or JSON object, keyed by column name.
+func foodFromRecord(rec map[string]string) (Food, error) {
+	var f Food
+	for col, raw := range rec {
+		field, ok := foodColumns[normalizeKey(col)]
+		raw = strings.TrimSpace(raw)
+		if !ok || raw == "" {
+			continue
+		}
+		switch field {
+		case "name":
+			f.Name = raw
+		case "brand":
+			f.Brand = raw
+		case "category":
+			f.Category = raw
+		case "serving_name":
+			f.ServingName = raw
+		case "id":
+			f.SourceID = raw
+		case "barcode":
+			f.Barcode = raw
+		default:
+			v, err := strconv.ParseFloat(strings.Replace(raw, ",", ".", 1), 64)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s %q", col, raw)
+			}
+			switch field {
+			case "calories":
+				f.Calories = v
+			case "protein":
+				f.Protein = v
+			case "carbs":
+				f.Carbs = v
+			case "fat":
+				f.Fat = v
+			case "fiber":
+				f.Fiber = v
+			case "sugar":
+				f.Sugar = v
+			case "sodium":
+				f.Sodium = v
+			case "serving_size":
+				f.ServingSize = v
+			}
+		}
+	}
+	return f, nil
+}
+
+// foodImporter validates foods and upserts them into the catalog in
+// batches, keyed by source and source ID so re-running an import updates
+// rather than duplicates.
+type foodImporter struct {
+	source   string
+	batch    map[string]Food
+	imported int
+	skipped  int
+}
+
+func (imp *foodImporter) add(f Food) error {
+	f.Source = imp.source
+	f.UserID = nil
+	if err := validateFood(&f); err != nil {
+		imp.skipped++
+		return nil
+	}
+	if f.SourceID == "" {
+		f.SourceID = f.SearchName
+	}
+	// Names longer than the column are stored by hash so that foods sharing
+	// a long prefix keep distinct keys.
+	if len(f.SourceID) > 64 {
+		f.SourceID = fmt.Sprintf("%x", sha1.Sum([]byte(f.SourceID)))
+	}
+	imp.batch[f.SourceID] = f
+	if len(imp.batch) >= foodImportBatch {
+		return imp.flush()
+	}
+	return nil
+}
+
+func (imp *foodImporter) flush() error {
+	if len(imp.batch) == 0 {
+		return nil
+	}
+	foods := make([]Food, 0, len(imp.batch))
+	for _, f := range imp.batch {
+		foods = append(foods, f)
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:     []clause.Column{{Name: "source"}, {Name: "source_id"}},
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "user_id IS NULL"}}},
+		DoUpdates: clause.AssignmentColumns([]string{"name", "brand", "category", "barcode", "search_name",
+			"calories", "protein", "carbs", "fat", "fiber", "sugar", "sodium", "serving_size", "serving_name"}),
+	}).Create(&foods).Error
+	if err != nil {
+		return err
+	}
+	imp.imported += len(foods)
+	imp.batch = map[string]Food{}
+	return nil
+}
+
+// importUSDA streams a FoodData Central download ({"FoundationFoods": [...]},
+// "SRLegacyFoods", "SurveyFoods" or "BrandedFoods") without holding the
+// whole file in memory.
+func (imp *foodImporter) importUSDA(dec *json.Decoder) error {
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		if !strings.HasSuffix(key, "Foods") {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return fmt.Errorf("%s is not a list of foods", key)
+		}
+		for dec.More() {
+			var u usdaFood
+			if err := dec.Decode(&u); err != nil {
+				return err
+			}
+			if err := imp.add(u.food()); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (imp *foodImporter) importJSONArray(dec *json.Decoder) error {
+	for dec.More() {
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil {
+			return err
+		}
+		rec := make(map[string]string, len(obj))
+		for k, v := range obj {
+			if v != nil {
+				rec[k] = fmt.Sprint(v)
+			}
+		}
+		f, err := foodFromRecord(rec)
+		if err != nil {
+			imp.skipped++
+			continue
+		}
+		if err := imp.add(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importCSV reads a header row and then one food per row. The delimiter
+// (comma, tab or semicolon) is taken from the header. Open Food Facts
+// exports are recognised by their code and product_name columns.
+func (imp *foodImporter) importCSV(r *bufio.Reader, off bool) error {
+	header, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	delim := ','
+	for _, d := range []rune{'\t', ';'} {
+		if strings.Count(header, string(d)) > strings.Count(header, string(delim)) {
+			delim = d
+		}
+	}
+	cr := csv.NewReader(io.MultiReader(strings.NewReader(header), r))
+	cr.Comma = delim
+	cr.LazyQuotes = true
+	cr.FieldsPerRecord = -1
+	columns, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("reading header: %v", err)
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec := make(map[string]string, len(columns))
+		for i, col := range columns {
+			if i < len(row) {
+				rec[col] = row[i]
+			}
+		}
+		if off {
+			if err := imp.addOFF(offProductFromRecord(rec)); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := foodFromRecord(rec)
+		if err != nil {
+			imp.skipped++
+			continue
+		}
+		if err := imp.add(f); err != nil {
+			return err
+		}
+	}
+}
+
+var usdaHead = regexp.MustCompile(`^\{\s*"\w+Foods"\s*:`)
+
+// foodFileFormat tells the dataset formats apart from the start of the file.
+func foodFileFormat(head []byte) string {
+	line := string(head)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	switch {
+	case head[0] == '[':
+		return "json"
+	case usdaHead.Match(head):
+		return "usda"
+	case head[0] == '{':
+		return "off-jsonl"
+	case strings.Contains(line, "product_name") && strings.Contains(line, "code"):
+		return "off-csv"
+	default:
+		return "csv"
+	}
+}
+
+// importFoods detects the format of r from its first bytes. Without a
+// source name, FoodData Central files are stored as "usda", Open Food Facts
+// exports as "off" and anything else as "import".
+func importFoods(r io.Reader, source string) (imported, skipped int, err error) {
+	imp := &foodImporter{source: source, batch: map[string]Food{}}
+	br := bufio.NewReaderSize(r, 1<<20)
+	if bom, _ := br.Peek(3); string(bom) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+	for {
+		first, err := br.ReadByte()
+		if err != nil {
+			return 0, 0, errors.New("file is empty")
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(first)) {
+			break
+		}
+	}
+	if err := br.UnreadByte(); err != nil {
+		return 0, 0, err
+	}
+	head, _ := br.Peek(64 << 10)
+	format := foodFileFormat(head)
+	if imp.source == "" {
+		switch format {
+		case "usda":
+			imp.source = FoodSourceUSDA
+		case "off-jsonl", "off-csv":
+			imp.source = FoodSourceOFF
+		default:
+			imp.source = "import"
+		}
+	}
+	switch format {
+	case "usda", "json":
+		dec := json.NewDecoder(br)
+		if _, err = dec.Token(); err != nil {
+			return 0, 0, err
+		}
+		if format == "usda" {
+			err = imp.importUSDA(dec)
+		} else {
+			err = imp.importJSONArray(dec)
+		}
+	case "off-jsonl":
+		err = imp.importOFFJSONL(json.NewDecoder(br))
+	default:
+		err = imp.importCSV(br, format == "off-csv")
+	}
+	if err == nil {
+		err = imp.flush()
+	}
+	return imp.imported, imp.skipped, err
+}
+
+// runFoodsCommand handles "foods ..." on the command line and returns the
+// process exit code.
+func runFoodsCommand(args []string) int {
+	if len(args) == 0 || args[0] != "import" {
+		fmt.Fprintln(os.Stderr, foodsUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("foods import", flag.ContinueOnError)
+	source := fs.String("source", "", "source name stored on the foods (default: usda or off for those datasets, import otherwise)")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, foodsUsage)
+		return 2
+	}
+	if *source == FoodSourceCustom {
+		fmt.Fprintln(os.Stderr, "foods: source \"custom\" is reserved for user foods")
+		return 2
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "foods:", err)
+		return 1
+	}
+	defer f.Close()
+	connectDB()
+	if err := requireCurrentSchema(); err != nil {
+		fmt.Fprintln(os.Stderr, "foods:", err)
+		return 1
+	}
+	imported, skipped, err := importFoods(f, *source)
+	fmt.Printf("imported %d foods, skipped %d invalid rows\n", imported, skipped)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "foods:", err)
+		return 1
+	}
+	return 0
+}
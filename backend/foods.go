@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	FoodSourceCustom = "custom"
+	FoodSourceUSDA   = "usda"
+	maxFoodResults   = 50
+)
+
+var portionUnits = quantity{
+	name: "portion", canonical: "g", metric: "g", imperial: "oz", precision: 1,
+	factors: map[string]float64{"g": 1, "kg": 1000, "oz": 28.349523125, "lb": 453.59237},
+}
+
+// Food is a catalog entry (no user) or a user's own custom food. Nutrients
+// are per 100 g; energy in kcal, sodium in mg, the rest in grams.
+type Food struct {
+	ID          int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID      *int      `json:"user_id" gorm:"index"`
+	Name        string    `json:"name" gorm:"not null"`
+	Brand       string    `json:"brand"`
+	Category    string    `json:"category"`
+	Source      string    `json:"source" gorm:"type:varchar(32);not null"`
+	SourceID    string    `json:"source_id,omitempty" gorm:"type:varchar(64)"`
+	Barcode     string    `json:"barcode,omitempty" gorm:"type:varchar(13);index"` // EAN-8 or EAN-13
+	SearchName  string    `json:"-" gorm:"not null"`
+	Calories    float64   `json:"calories" gorm:"not null;default:0"`
+	Protein     float64   `json:"protein" gorm:"not null;default:0"`
+	Carbs       float64   `json:"carbs" gorm:"not null;default:0"`
+	Fat         float64   `json:"fat" gorm:"not null;default:0"`
+	Fiber       float64   `json:"fiber" gorm:"not null;default:0"`
+	Sugar       float64   `json:"sugar" gorm:"not null;default:0"`
+	Sodium      float64   `json:"sodium" gorm:"not null;default:0"` // mg
+	ServingSize float64   `json:"serving_size"`                     // grams, 0 when the source has none
+	ServingName string    `json:"serving_name"`
+	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+func foodSearchName(name, brand string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name+" "+brand), " "))
+}
+
+// validateFood tidies a food before it is stored and checks its values are
+// plausible per 100 g.
+func validateFood(f *Food) error {
+	f.Name = strings.TrimSpace(f.Name)
+	f.Brand = strings.TrimSpace(f.Brand)
+	f.Category = strings.TrimSpace(f.Category)
+	if f.Name == "" || len(f.Name) > 200 {
+		return errors.New("food name is required and must be at most 200 characters")
+	}
+	if f.Calories < 0 || f.Calories > 900 {
+		return errors.New("calories must be between 0 and 900 per 100 g")
+	}
+	for _, g := range []float64{f.Protein, f.Carbs, f.Fat, f.Fiber, f.Sugar} {
+		if g < 0 || g > 100 {
+			return errors.New("nutrients must be between 0 and 100 g per 100 g")
+		}
+	}
+	if f.Sodium < 0 || f.Sodium > 40000 {
+		return errors.New("sodium must be between 0 and 40000 mg per 100 g")
+	}
+	if f.Protein+f.Carbs+f.Fat > 100.5 {
+		return errors.New("protein, carbs and fat add up to more than 100 g per 100 g")
+	}
+	if f.ServingSize < 0 {
+		return errors.New("serving_size cannot be negative")
+	}
+	if f.Barcode != "" {
+		code, err := normalizeBarcode(f.Barcode)
+		if err != nil {
+			return err
+		}
+		f.Barcode = code
+	}
+	f.SearchName = foodSearchName(f.Name, f.Brand)
+	return nil
+}
+
+func visibleFoods(query *gorm.DB, userID int) *gorm.DB {
+	return query.Where("user_id IS NULL OR user_id = ?", userID)
+}
+
+func findFood(c *gin.Context, userID int) (Food, bool) {
+	var food Food
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid food ID"})
+		return food, false
+	}
+	if err := visibleFoods(db, userID).Where("id = ?", id).First(&food).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Food not found"})
+		return food, false
+	}
+	return food, true
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// searchFoods ranks foods whose name and brand contain q or contain a word
+// close to it (pg_trgm word similarity, so "chiken brest" still finds
+// chicken breast). The user's own foods come first.
+func searchFoods(userID int, q string, limit int) ([]Food, error) {
+	q = foodSearchName(q, "")
+	var foods []Food
+	err := visibleFoods(db, userID).
+		Where("(? <% search_name OR search_name LIKE ?)", q, "%"+escapeLike(q)+"%").
+		Order(clause.OrderBy{Expression: clause.Expr{
+			SQL:                "user_id IS NULL, word_similarity(?, search_name) DESC, length(search_name), id",
+			Vars:               []interface{}{q},
+			WithoutParentheses: true,
+		}}).
+		Limit(limit).Find(&foods).Error
+	return foods, err
+}
+
+// getFoods searches the catalog and the user's foods with q, or lists the
+// user's own foods without it.
+func getFoods(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	limit := 20
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 {
+		limit = int(math.Min(float64(n), maxFoodResults))
+	}
+	var foods []Food
+	var err error
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		foods, err = searchFoods(userID, q, limit)
+	} else {
+		err = db.Where("user_id = ?", userID).Order("name").Find(&foods).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, foods)
+}
+
+func getFood(c *gin.Context) {
+	food, ok := findFood(c, c.GetInt("user_id"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, food)
+}
+
+func createFood(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var food Food
+	if err := c.ShouldBindJSON(&food); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	food.ID = 0
+	food.UserID = &userID
+	food.Source = FoodSourceCustom
+	food.SourceID = ""
+	if err := validateFood(&food); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Create(&food).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, food)
+}
+
+// updateFood edits one of the user's own foods. Diet entries already logged
+// keep the nutrients they were logged with.
+func updateFood(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	food, ok := findFood(c, userID)
+	if !ok {
+		return
+	}
+	if food.UserID == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Catalog foods cannot be edited"})
+		return
+	}
+	stored := food
+	if err := c.ShouldBindJSON(&food); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	food.ID, food.UserID, food.Source, food.SourceID = stored.ID, stored.UserID, stored.Source, stored.SourceID
+	food.CreatedAt = stored.CreatedAt
+	if err := validateFood(&food); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Save(&food).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, food)
+}
+
+func deleteFood(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	food, ok := findFood(c, userID)
+	if !ok {
+		return
+	}
+	if food.UserID == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Catalog foods cannot be deleted"})
+		return
+	}
+	var inRecipes int64
+	db.Model(&RecipeIngredient{}).Where("food_id = ?", food.ID).Count(&inRecipes)
+	if inRecipes > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Food is used in a recipe"})
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&DietEntry{}).Where("food_id = ?", food.ID).Update("food_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("food_id = ?", food.ID).Delete(&PlannedMeal{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&food).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Food deleted"})
+}
+
+// applyFood fills a diet entry's name, calories and macros from amount grams
+// of food.
+func applyFood(entry *DietEntry, food Food) {
+	entry.Food = food.Name
+	if food.Brand != "" {
+		entry.Food += " (" + food.Brand + ")"
+	}
+	var n Nutrition
+	n.addFood(food, entry.Amount)
+	entry.setNutrition(n.rounded())
+}
+
+// resolveDietFood works out the portion of an entry that references a food,
+// by food_id or by barcode, given as amount (in amount_unit or the user's
+// unit) or as servings, and computes its nutrients. Entries for a recipe are
+// handed to resolveDietRecipe. On updates the nutrients are only recomputed
+// when the food or portion changed, so later edits to a custom food do not
+// rewrite what was logged. Entries without a food keep what the client sent.
+func resolveDietFood(entry *DietEntry, stored *DietEntry, units string) error {
+	if entry.RecipeID != nil {
+		entry.FoodID, entry.Amount = nil, 0
+		return resolveDietRecipe(entry, stored)
+	}
+	var food Food
+	if entry.FoodID == nil && entry.Barcode != "" {
+		code, err := normalizeBarcode(entry.Barcode)
+		if err != nil {
+			return err
+		}
+		if food, err = findFoodByBarcode(entry.UserID, code); err != nil {
+			return fmt.Errorf("no food with barcode %s", code)
+		}
+		entry.FoodID = &food.ID
+	} else if entry.FoodID == nil {
+		entry.Amount, entry.Servings = 0, 0
+		return nil
+	} else if err := visibleFoods(db, entry.UserID).Where("id = ?", *entry.FoodID).First(&food).Error; err != nil {
+		return errors.New("food not found")
+	}
+	var storedAmount *float64
+	if stored != nil && stored.FoodID != nil && *stored.FoodID == *entry.FoodID {
+		storedAmount = &stored.Amount
+	}
+	switch {
+	case entry.Servings > 0:
+		if food.ServingSize <= 0 {
+			return errors.New("this food has no serving size, give amount instead")
+		}
+		// For foods servings is only a way to give the amount.
+		entry.Amount, entry.Servings = entry.Servings*food.ServingSize, 0
+	case entry.Amount > 0:
+		amount, err := portionUnits.fromInput(entry.Amount, entry.AmountUnit, units, storedAmount)
+		if err != nil {
+			return err
+		}
+		entry.Amount = amount
+	case food.ServingSize > 0:
+		entry.Amount = food.ServingSize
+	default:
+		return errors.New("amount or servings is required")
+	}
+	if entry.Amount > 10000 {
+		return errors.New("amount must be at most 10 kg")
+	}
+	if storedAmount != nil && *storedAmount == entry.Amount {
+		entry.Food = stored.Food
+		entry.setNutrition(stored.nutrition())
+		return nil
+	}
+	applyFood(entry, food)
+	return nil
+}
+
+// displayDietEntry shows the portion of a food entry in the user's unit.
+func displayDietEntry(entry *DietEntry, units string) {
+	if entry.FoodID != nil && entry.Amount > 0 {
+		entry.Amount, entry.AmountUnit = portionUnits.display(entry.Amount, units)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is one entry of the key ring. Verify-only keys have no private half
+// and are kept around after a rotation so tokens they signed stay valid until
+// they expire.
+type jwtKey struct {
+	KID     string
+	Method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+type keyRing struct {
+	signing *jwtKey
+	byKID   map[string]*jwtKey
+	issuer  string
+}
+
+var keys *keyRing
+
+// minHMACSecret is the shortest HMAC secret accepted from any source.
+const minHMACSecret = 16
+
+var errShortHMACSecret = errors.New("HMAC secret must be at least 16 bytes")
+
+// keyFileEntry is the on-disk format used by JWT_KEYS_FILE:
+//
+//	{
+//	  "signing_kid": "2025-06",
+//	  "keys": [
+//	    {"kid": "2025-06", "alg": "EdDSA", "private_key_file": "keys/2025-06.pem"},
+//	    {"kid": "2025-01", "alg": "RS256", "public_key_file": "keys/2025-01.pub.pem"},
+//	    {"kid": "legacy", "alg": "HS256", "secret": "..."}
+//	  ]
+//	}
+type keyFileEntry struct {
+	KID            string `json:"kid"`
+	Alg            string `json:"alg"`
+	Secret         string `json:"secret"`
+	SecretFile     string `json:"secret_file"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
+}
+
+type keyFile struct {
+	SigningKID string         `json:"signing_kid"`
+	Keys       []keyFileEntry `json:"keys"`
+}
+
+// loadKeys builds the key ring from configuration. In order of precedence:
+// JWT_KEYS_FILE (JSON, any algorithm), JWT_KEYS ("kid:secret,kid:secret",
+// HS256) or JWT_SECRET (single HS256 key). JWT_SIGNING_KID picks the key new
+// tokens are signed with; it defaults to the first one listed.
+func loadKeys() (*keyRing, error) {
+	ring := &keyRing{byKID: map[string]*jwtKey{}, issuer: os.Getenv("JWT_ISSUER")}
+	signingKID := os.Getenv("JWT_SIGNING_KID")
+	var order []string
+
+	switch {
+	case os.Getenv("JWT_KEYS_FILE") != "":
+		raw, err := os.ReadFile(os.Getenv("JWT_KEYS_FILE"))
+		if err != nil {
+			return nil, err
+		}
+		var kf keyFile
+		if err := json.Unmarshal(raw, &kf); err != nil {
+			return nil, fmt.Errorf("parse JWT_KEYS_FILE: %w", err)
+		}
+		if signingKID == "" {
+			signingKID = kf.SigningKID
+		}
+		for _, e := range kf.Keys {
+			k, err := parseKeyEntry(e)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", e.KID, err)
+			}
+			if err := ring.add(k); err != nil {
+				return nil, err
+			}
+			order = append(order, k.KID)
+		}
+	case os.Getenv("JWT_KEYS") != "":
+		for _, pair := range strings.Split(os.Getenv("JWT_KEYS"), ",") {
+			kid, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || kid == "" || secret == "" {
+				return nil, errors.New("JWT_KEYS entries must look like kid:secret")
+			}
+			if len(secret) < minHMACSecret {
+				return nil, fmt.Errorf("JWT_KEYS key %q: %w", kid, errShortHMACSecret)
+			}
+			if err := ring.add(&jwtKey{KID: kid, Method: jwt.SigningMethodHS256, private: []byte(secret), public: []byte(secret)}); err != nil {
+				return nil, err
+			}
+			order = append(order, kid)
+		}
+	case os.Getenv("JWT_SECRET") != "":
+		kid := os.Getenv("JWT_KID")
+		if kid == "" {
+			kid = "default"
+		}
+		secret := []byte(os.Getenv("JWT_SECRET"))
+		if len(secret) < minHMACSecret {
+			return nil, fmt.Errorf("JWT_SECRET: %w", errShortHMACSecret)
+		}
+		ring.add(&jwtKey{KID: kid, Method: jwt.SigningMethodHS256, private: secret, public: secret})
+		order = append(order, kid)
+	default:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		log.Println("WARNING: no JWT keys configured, using a random key; tokens will not survive a restart")
+		ring.add(&jwtKey{KID: "ephemeral", Method: jwt.SigningMethodHS256, private: secret, public: secret})
+		order = append(order, "ephemeral")
+	}
+
+	if signingKID == "" && len(order) > 0 {
+		signingKID = order[0]
+	}
+	signing, ok := ring.byKID[signingKID]
+	if !ok {
+		return nil, fmt.Errorf("signing key %q is not configured", signingKID)
+	}
+	if signing.private == nil {
+		return nil, fmt.Errorf("signing key %q has no private key", signingKID)
+	}
+	ring.signing = signing
+	return ring, nil
+}
+
+func (r *keyRing) add(k *jwtKey) error {
+	if _, dup := r.byKID[k.KID]; dup {
+		return fmt.Errorf("duplicate key id %q", k.KID)
+	}
+	r.byKID[k.KID] = k
+	return nil
+}
+
+func parseKeyEntry(e keyFileEntry) (*jwtKey, error) {
+	if e.KID == "" {
+		return nil, errors.New("kid is required")
+	}
+	k := &jwtKey{KID: e.KID}
+	switch e.Alg {
+	case "HS256", "HS384", "HS512":
+		k.Method = jwt.GetSigningMethod(e.Alg)
+		secret := []byte(e.Secret)
+		if e.SecretFile != "" {
+			raw, err := os.ReadFile(e.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			secret = []byte(strings.TrimSpace(string(raw)))
+		}
+		if len(secret) < minHMACSecret {
+			return nil, errShortHMACSecret
+		}
+		k.private, k.public = secret, secret
+		return k, nil
+	case "RS256", "RS384", "RS512", "EdDSA":
+		k.Method = jwt.GetSigningMethod(e.Alg)
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", e.Alg)
+	}
+
+	if e.PrivateKeyFile != "" {
+		priv, err := readPrivateKey(e.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("private key cannot sign")
+		}
+		k.private = priv
+		k.public = signer.Public()
+	} else if e.PublicKeyFile != "" {
+		pub, err := readPublicKey(e.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		k.public = pub
+	} else {
+		return nil, errors.New("private_key_file or public_key_file is required")
+	}
+
+	switch k.public.(type) {
+	case *rsa.PublicKey:
+		if e.Alg == "EdDSA" {
+			return nil, errors.New("EdDSA requires an Ed25519 key")
+		}
+	case ed25519.PublicKey:
+		if e.Alg != "EdDSA" {
+			return nil, errors.New("Ed25519 keys must use alg EdDSA")
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	return k, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
+
+func readPrivateKey(path string) (interface{}, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+func readPublicKey(path string) (interface{}, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func (r *keyRing) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(r.signing.Method, claims)
+	token.Header["kid"] = r.signing.KID
+	return token.SignedString(r.signing.private)
+}
+
+// keyFunc resolves the verification key from the token's kid header and
+// refuses tokens whose alg does not match the key they claim to use.
+func (r *keyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k, ok := r.byKID[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+	}
+	return k.public, nil
+}
+
+func (r *keyRing) parse(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	if r.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(r.issuer))
+	}
+	return jwt.ParseWithClaims(tokenString, claims, r.keyFunc, opts...)
+}
+
+func (r *keyRing) jwks() []gin.H {
+	kids := make([]string, 0, len(r.byKID))
+	for kid := range r.byKID {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	set := []gin.H{}
+	for _, kid := range kids {
+		k := r.byKID[kid]
+		switch pub := k.public.(type) {
+		case *rsa.PublicKey:
+			set = append(set, gin.H{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": k.Method.Alg(),
+				"kid": k.KID,
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set = append(set, gin.H{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"use": "sig",
+				"alg": "EdDSA",
+				"kid": k.KID,
+				"x":   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	return set
+}
+
+// getJWKS publishes the asymmetric verification keys; HMAC secrets are never
+// exposed.
+func getJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys.jwks()})
+}
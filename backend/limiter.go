@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LimitPolicy describes how failed attempts against one key are throttled:
+// after FreeAttempts failures every further failure doubles the wait starting
+// at BaseDelay, and LockoutAfter failures lock the key for LockoutFor.
+// Failures older than Window are forgotten.
+type LimitPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int
+	LockoutFor   time.Duration
+	Window       time.Duration
+}
+
+type LimitState struct {
+	Failures     int
+	BlockedUntil time.Time
+	Locked       bool
+}
+
+func (s LimitState) Blocked(now time.Time) bool {
+	return now.Before(s.BlockedUntil)
+}
+
+func (s LimitState) RetryAfter(now time.Time) time.Duration {
+	return s.BlockedUntil.Sub(now)
+}
+
+// apply works out the block that follows the given number of failures.
+func (p LimitPolicy) apply(failures int, now time.Time) LimitState {
+	state := LimitState{Failures: failures}
+	if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+		state.Locked = true
+		state.BlockedUntil = now.Add(p.LockoutFor)
+		return state
+	}
+	if failures > p.FreeAttempts {
+		exp := float64(failures - p.FreeAttempts - 1)
+		delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, exp))
+		if delay > p.MaxDelay || delay <= 0 {
+			delay = p.MaxDelay
+		}
+		state.BlockedUntil = now.Add(delay)
+	}
+	return state
+}
+
+// AttemptLimiter counts failures per key. Keys are namespaced by the caller
+// (e.g. "login:ip:1.2.3.4"), so one store can back several policies.
+type AttemptLimiter interface {
+	Check(key string) (LimitState, error)
+	Fail(key string) (LimitState, error)
+	Reset(key string) error
+}
+
+var (
+	loginIPLimiter      AttemptLimiter
+	loginAccountLimiter AttemptLimiter
+	signupIPLimiter     AttemptLimiter
+	mfaLimiter          AttemptLimiter
+)
+
+var (
+	loginIPPolicy = LimitPolicy{
+		FreeAttempts: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: 100,
+		LockoutFor:   time.Hour,
+		Window:       time.Hour,
+	}
+	loginAccountPolicy = LimitPolicy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		LockoutAfter: 10,
+		LockoutFor:   15 * time.Minute,
+		Window:       time.Hour,
+	}
+	// Every signup or reset request counts, successful or not.
+	signupIPPolicy = LimitPolicy{
+		FreeAttempts: 10,
+		BaseDelay:    10 * time.Second,
+		MaxDelay:     10 * time.Minute,
+		Window:       time.Hour,
+	}
+)
+
+// initLimiters picks the backing store from LOGIN_LIMITER: "postgres" (the
+// default, shared by every backend instance) or "memory".
+func initLimiters() error {
+	switch os.Getenv("LOGIN_LIMITER") {
+	case "", "postgres":
+		loginIPLimiter = &PostgresLimiter{db: db, policy: loginIPPolicy}
+		loginAccountLimiter = &PostgresLimiter{db: db, policy: loginAccountPolicy}
+		signupIPLimiter = &PostgresLimiter{db: db, policy: signupIPPolicy}
+		mfaLimiter = &PostgresLimiter{db: db, policy: mfaPolicy}
+	case "memory":
+		loginIPLimiter = NewMemoryLimiter(loginIPPolicy)
+		loginAccountLimiter = NewMemoryLimiter(loginAccountPolicy)
+		signupIPLimiter = NewMemoryLimiter(signupIPPolicy)
+		mfaLimiter = NewMemoryLimiter(mfaPolicy)
+	default:
+		return fmt.Errorf("unknown LOGIN_LIMITER %q", os.Getenv("LOGIN_LIMITER"))
+	}
+	return nil
+}
+
+type memoryEntry struct {
+	state       LimitState
+	lastFailure time.Time
+}
+
+type MemoryLimiter struct {
+	policy  LimitPolicy
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+func NewMemoryLimiter(policy LimitPolicy) *MemoryLimiter {
+	return &MemoryLimiter{policy: policy, entries: map[string]*memoryEntry{}}
+}
+
+func (m *MemoryLimiter) Check(key string) (LimitState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return LimitState{}, nil
+	}
+	return e.state, nil
+}
+
+func (m *MemoryLimiter) Fail(key string) (LimitState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e, ok := m.entries[key]
+	if !ok || (now.Sub(e.lastFailure) > m.policy.Window && !e.state.Blocked(now)) {
+		e = &memoryEntry{}
+		m.entries[key] = e
+	}
+	e.lastFailure = now
+	e.state = m.policy.apply(e.state.Failures+1, now)
+	if len(m.entries) > 10000 {
+		m.prune(now)
+	}
+	return e.state, nil
+}
+
+func (m *MemoryLimiter) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *MemoryLimiter) prune(now time.Time) {
+	for key, e := range m.entries {
+		if now.Sub(e.lastFailure) > m.policy.Window && !e.state.Blocked(now) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// LoginAttempt is the shared counter row used by PostgresLimiter.
+type LoginAttempt struct {
+	Key           string    `gorm:"primaryKey;type:varchar(255)"`
+	Failures      int       `gorm:"not null;default:0"`
+	LastFailureAt time.Time `gorm:"not null"`
+	BlockedUntil  time.Time `gorm:"not null"`
+	Locked        bool      `gorm:"not null;default:false"`
+}
+
+type PostgresLimiter struct {
+	db     *gorm.DB
+	policy LimitPolicy
+}
+
+func (p *PostgresLimiter) Check(key string) (LimitState, error) {
+	var row LoginAttempt
+	err := p.db.Where("key = ?", key).Limit(1).Find(&row).Error
+	if err != nil {
+		return LimitState{}, err
+	}
+	return LimitState{Failures: row.Failures, BlockedUntil: row.BlockedUntil, Locked: row.Locked}, nil
+}
+
+func (p *PostgresLimiter) Fail(key string) (LimitState, error) {
+	var state LimitState
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&LoginAttempt{Key: key, LastFailureAt: now, BlockedUntil: now}).Error; err != nil {
+			return err
+		}
+		var row LoginAttempt
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&row).Error; err != nil {
+			return err
+		}
+		failures := row.Failures
+		if now.Sub(row.LastFailureAt) > p.policy.Window && !now.Before(row.BlockedUntil) {
+			failures = 0
+		}
+		state = p.policy.apply(failures+1, now)
+		blockedUntil := state.BlockedUntil
+		if blockedUntil.IsZero() {
+			blockedUntil = now
+		}
+		return tx.Model(&LoginAttempt{}).Where("key = ?", key).Updates(map[string]interface{}{
+			"failures":        state.Failures,
+			"last_failure_at": now,
+			"blocked_until":   blockedUntil,
+			"locked":          state.Locked,
+		}).Error
+	})
+	return state, err
+}
+
+func (p *PostgresLimiter) Reset(key string) error {
+	return p.db.Where("key = ?", key).Delete(&LoginAttempt{}).Error
+}
+
+// LoginLockout records each time an account hit the lockout threshold.
+type LoginLockout struct {
+	ID          int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID      int       `json:"user_id" gorm:"index;not null"`
+	IP          string    `json:"ip"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+func accountLimitKey(email string) string {
+	return "login:account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// rejectIfBlocked answers 423 for a locked account and 429 for anything that
+// is merely backing off. It returns true when the request was rejected.
+func rejectIfBlocked(c *gin.Context, state LimitState) bool {
+	now := time.Now()
+	if !state.Blocked(now) {
+		return false
+	}
+	retry := int(math.Ceil(state.RetryAfter(now).Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retry))
+	if state.Locked {
+		c.JSON(http.StatusLocked, gin.H{
+			"error":        "Account temporarily locked after too many failed attempts",
+			"locked_until": state.BlockedUntil,
+			"retry_after":  retry,
+		})
+	} else {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "Too many attempts, try again later",
+			"retry_after": retry,
+		})
+	}
+	return true
+}
+
+// throttleByIP counts every call from the client's address against the
+// signup policy; used for endpoints that create accounts or send email.
+func throttleByIP(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := action + ":ip:" + c.ClientIP()
+		state, err := signupIPLimiter.Check(key)
+		if err == nil && rejectIfBlocked(c, state) {
+			c.Abort()
+			return
+		}
+		signupIPLimiter.Fail(key)
+		c.Next()
+	}
+}
+
+func getUserLockouts(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	var lockouts []LoginLockout
+	if err := db.Where("user_id = ?", id).Order("created_at desc").Find(&lockouts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, lockouts)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Mailer delivers transactional email (verification links, password resets).
+type Mailer interface {
+	Send(msg Mail) error
+}
+
+var mailer Mailer
+
+// newMailer picks the implementation from MAIL_DRIVER: "smtp", "file" or
+// "log" (the default, for local development). Left unset it warns at startup,
+// since the log driver writes live reset and verification links to the log.
+func newMailer() (Mailer, error) {
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		m := &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		if m.Host == "" || m.From == "" {
+			return nil, fmt.Errorf("SMTP_HOST and MAIL_FROM are required for the smtp mail driver")
+		}
+		if m.Port == "" {
+			m.Port = "587"
+		}
+		return m, nil
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.jsonl"
+		}
+		return &FileMailer{Path: path}, nil
+	case "":
+		log.Println("WARNING: MAIL_DRIVER is not set, mail including password reset links is only logged; set MAIL_DRIVER=smtp in production")
+		return LogMailer{}, nil
+	case "log":
+		return LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_DRIVER %q", os.Getenv("MAIL_DRIVER"))
+	}
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Mail) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	var b strings.Builder
+	b.WriteString("From: " + m.From + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{msg.To}, []byte(b.String()))
+}
+
+// FileMailer appends each message as a JSON line, so tests and local setups
+// can read back the links that would have been emailed.
+type FileMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *FileMailer) Send(msg Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(struct {
+		Mail
+		SentAt time.Time `json:"sent_at"`
+	}{msg, time.Now()})
+}
+
+type LogMailer struct{}
+
+func (LogMailer) Send(msg Mail) error {
+	log.Printf("[Mail] To: %s Subject: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+func sendMail(msg Mail) {
+	if err := mailer.Send(msg); err != nil {
+		log.Printf("failed to send mail to %s: %v", msg.To, err)
+	}
+}
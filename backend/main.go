@@ -7,11 +7,12 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"time"
-	"sync"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"log"
 	"os"
+	"strings"
 	"github.com/joho/godotenv"
 	"github.com/gin-contrib/cors"
 )
@@ -25,6 +26,21 @@ type User struct {
 	Age    int     `json:"age" gorm:"default:18"`
 	Sex    string  `json:"sex" gorm:"default:'other'"`
 	Height float64 `json:"height" gorm:"default:170"`
+	Role   string  `json:"role" gorm:"type:varchar(16);not null;default:'user'"` // user, coach, admin
+	EmailVerified bool `json:"email_verified" gorm:"not null;default:false"`
+	TOTPEnabled       bool   `json:"totp_enabled" gorm:"column:totp_enabled;not null;default:false"`
+	TOTPSecret        string `json:"-" gorm:"column:totp_secret"`
+	TOTPPendingSecret string `json:"-" gorm:"column:totp_pending_secret"`
+	TOTPLastStep      int64  `json:"-" gorm:"column:totp_last_step;not null;default:0"`
+	TimeZone string `json:"time_zone" gorm:"type:varchar(64);not null;default:'UTC'"` // IANA name
+	MaxHeartRate     *int `json:"max_heart_rate"`     // bpm; estimated from age when nil
+	RestingHeartRate *int `json:"resting_heart_rate"` // bpm; taken from metrics when nil
+	// Unit annotations. Weight and Height are stored in kg and cm.
+	WeightUnit string  `json:"weight_unit,omitempty" gorm:"-"`
+	HeightUnit string  `json:"height_unit,omitempty" gorm:"-"`
+	HeightFtIn string  `json:"height_ft_in,omitempty" gorm:"-"`
+	HeightFt   float64 `json:"height_ft,omitempty" gorm:"-"`
+	HeightIn   float64 `json:"height_in,omitempty" gorm:"-"`
 }
 
 type Workout struct {
@@ -37,20 +53,52 @@ type Workout struct {
 	Location  string    `json:"location"`
 	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
 	Category  string    `json:"category"`
+	CaloriesEstimated bool `json:"calories_estimated" gorm:"not null;default:false"`
+	Distance     float64 `json:"distance"` // stored in metres
+	DistanceUnit string  `json:"distance_unit,omitempty" gorm:"-"`
+	ElevationGain float64    `json:"elevation_gain"` // stored in metres
+	ElevationUnit string     `json:"elevation_unit,omitempty" gorm:"-"`
+	ElapsedTime   int        `json:"elapsed_time"` // seconds, from imported recordings
+	AvgHeartRate  int        `json:"avg_heart_rate"`
+	MaxHeartRate  int        `json:"max_heart_rate"`
+	Pace          float64    `json:"pace,omitempty" gorm:"-"` // seconds per km or mi
+	PaceUnit      string     `json:"pace_unit,omitempty" gorm:"-"`
+	Source        string     `json:"source" gorm:"type:varchar(16);not null;default:'manual'"` // manual, gpx, tcx, fit
+	StartedAt     *time.Time `json:"started_at"`
 }
 
 type WaterIntake struct {
-	ID     int `json:"id" gorm:"primaryKey;autoIncrement"`
-	UserID int `json:"user_id" gorm:"index;not null"`
-	Amount int `json:"amount"`
+	ID         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID     int       `json:"user_id" gorm:"index;not null"`
+	Amount     float64   `json:"amount"` // stored in ml
+	Unit       string    `json:"unit,omitempty" gorm:"-"`
+	ConsumedAt time.Time `json:"consumed_at" gorm:"index;not null;default:CURRENT_TIMESTAMP"`
+	CreatedAt  time.Time `json:"created_at" gorm:"autoCreateTime"`
 }
 
 type DietEntry struct {
-	ID       int    `json:"id" gorm:"primaryKey;autoIncrement"`
-	UserID   int    `json:"user_id" gorm:"index;not null"`
-	Meal     string `json:"meal"`
-	Food     string `json:"food"`
-	Calories int    `json:"calories"`
+	ID         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID     int       `json:"user_id" gorm:"index;not null"`
+	Meal       string    `json:"meal"`
+	Food       string    `json:"food"`
+	Calories   int       `json:"calories"`
+	// With a food the portion is stored in grams, with a recipe in servings,
+	// and the nutrients below are computed from it; without either they are
+	// whatever the client sent.
+	FoodID     *int      `json:"food_id" gorm:"index"`
+	Amount     float64   `json:"amount" gorm:"not null;default:0"`
+	AmountUnit string    `json:"amount_unit,omitempty" gorm:"-"`
+	RecipeID   *int      `json:"recipe_id" gorm:"index"`
+	Servings   float64   `json:"servings,omitempty" gorm:"not null;default:0"`
+	Barcode    string    `json:"barcode,omitempty" gorm:"-"` // looks up FoodID when none is given
+	Protein    float64   `json:"protein" gorm:"not null;default:0"` // grams
+	Carbs      float64   `json:"carbs" gorm:"not null;default:0"`
+	Fat        float64   `json:"fat" gorm:"not null;default:0"`
+	Fiber      float64   `json:"fiber" gorm:"not null;default:0"`
+	Sugar      float64   `json:"sugar" gorm:"not null;default:0"`
+	Sodium     float64   `json:"sodium" gorm:"not null;default:0"` // mg
+	ConsumedAt time.Time `json:"consumed_at" gorm:"index;not null;default:CURRENT_TIMESTAMP"`
+	CreatedAt  time.Time `json:"created_at" gorm:"autoCreateTime"`
 }
 
 type Period struct {
@@ -77,9 +125,12 @@ type Journey struct {
 type HealthRecord struct {
 	ID     int    `json:"id" gorm:"primaryKey;autoIncrement"`
 	UserID int    `json:"user_id" gorm:"index;not null"`
-	Type   string `json:"type"`
+	Type   string `json:"type"` // a key of metricRegistry
 	Value  string `json:"value"`
 	Date   string `json:"date"`
+	NumericValue   *float64 `json:"numeric_value"`
+	SecondaryValue *float64 `json:"secondary_value,omitempty"` // diastolic for blood pressure
+	Unit           string   `json:"unit"`
 }
 
 type Settings struct {
@@ -89,6 +140,22 @@ type Settings struct {
 	WaterGoal             int    `json:"water_goal" gorm:"default:2000"`
 	CaloriesGoal          int    `json:"calories_goal" gorm:"default:2000"`
 	StepsGoal             int    `json:"steps_goal" gorm:"default:10000"`
+	Units                 string `json:"units" gorm:"type:varchar(16);not null;default:'metric'"` // metric, imperial
+	RecalculateCalories   bool   `json:"recalculate_calories" gorm:"not null;default:false"` // re-estimate workouts when weight changes
+	GoalMode              string  `json:"goal_mode" gorm:"type:varchar(16);not null;default:'maintain'"` // lose, maintain, gain
+	WeeklyRate            float64 `json:"weekly_rate" gorm:"not null;default:0"` // kg per week
+	BMRFormula            string  `json:"bmr_formula" gorm:"column:bmr_formula;type:varchar(32);not null;default:'mifflin'"`
+	AutoCaloriesGoal      bool    `json:"auto_calories_goal" gorm:"not null;default:false"` // CaloriesGoal follows the computed target
+	MacroMode             string  `json:"macro_mode" gorm:"type:varchar(16);not null;default:'percent'"` // percent of CaloriesGoal, or grams
+	ProteinGoal           float64 `json:"protein_goal" gorm:"not null;default:20"`
+	CarbsGoal             float64 `json:"carbs_goal" gorm:"not null;default:50"`
+	FatGoal               float64 `json:"fat_goal" gorm:"not null;default:30"`
+	FiberGoal             float64 `json:"fiber_goal" gorm:"not null;default:30"` // grams, a minimum
+	SugarGoal             float64 `json:"sugar_goal" gorm:"not null;default:50"` // grams, a limit
+	SodiumGoal            float64 `json:"sodium_goal" gorm:"not null;default:2300"` // mg, a limit
+	DietStreakMode        string  `json:"diet_streak_mode" gorm:"type:varchar(16);not null;default:'calories'"` // calories, macros
+	TimeZone              string `json:"time_zone" gorm:"-"` // stored on User
+	WaterGoalUnit         string `json:"water_goal_unit,omitempty" gorm:"-"`
 }
 
 type Reminder struct {
@@ -151,14 +218,9 @@ type Streak struct {
 	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
 }
 
-var triggeredReminders = struct {
-	m map[int]bool
-	sync.Mutex
-}{m: make(map[int]bool)}
-
 var db *gorm.DB
 
-func initDB() {
+func connectDB() {
 	dbHost := os.Getenv("DB_HOST")
 	dbPort := os.Getenv("DB_PORT")
 	dbUser := os.Getenv("DB_USER")
@@ -171,51 +233,72 @@ func initDB() {
 		log.Fatalf("failed to connect to database: %v", err)
 	}
 	log.Println("Connected to PostgreSQL database!")
+}
+
+func initDB() {
+	connectDB()
+	if err := requireCurrentSchema(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	log.Println("Database schema is up to date!")
+}
 
-	err = db.AutoMigrate(
-		&User{},
-		&Workout{},
-		&WaterIntake{},
-		&DietEntry{},
-		&Period{},
-		&Award{},
-		&Journey{},
-		&HealthRecord{},
-		&Settings{},
-		&Reminder{},
-		&FriendRequest{},
-		&Friendship{},
-		&Activity{},
-		&Message{},
-		&Badge{},
-		&Streak{},
-	)
+// reminderDue reports whether a reminder's time falls in (since, now]. Time
+// is either "2006-01-02 15:04" for a one-off reminder or "15:04" for a daily
+// one, read as wall-clock time in loc. A daily time that does not exist on a
+// DST change day fires at the shifted instant time.Date normalises it to.
+func reminderDue(r Reminder, loc *time.Location, since, now time.Time) bool {
+	if at, err := time.ParseInLocation("2006-01-02 15:04", r.Time, loc); err == nil {
+		return at.After(since) && !at.After(now)
+	}
+	clock, err := time.Parse("15:04", r.Time)
 	if err != nil {
-		log.Fatalf("failed to auto-migrate models: %v", err)
+		return false
+	}
+	// Look at today and yesterday in case the window spans local midnight.
+	for offset := -1; offset <= 0; offset++ {
+		day, _ := dayBounds(now, loc, offset)
+		at := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+		if at.After(since) && !at.After(now) {
+			return true
+		}
 	}
-	log.Println("Database auto-migration complete!")
+	return false
 }
 
 func startReminderChecker() {
 	go func() {
+		lastCheck := time.Now()
 		for {
-			now := time.Now().Format("2006-01-02 15:04")
-			triggeredReminders.Lock()
+			time.Sleep(time.Minute)
+			now := time.Now()
 			var reminders []Reminder
 			if err := db.Find(&reminders).Error; err != nil {
 				log.Printf("failed to load reminders: %v", err)
+				continue
+			}
+			userIDs := []int{}
+			for _, r := range reminders {
+				userIDs = append(userIDs, r.UserID)
+			}
+			zones := map[int]*time.Location{}
+			if len(userIDs) > 0 {
+				var users []User
+				db.Select("id", "time_zone").Where("id IN ?", userIDs).Find(&users)
+				for _, u := range users {
+					zones[u.ID] = locationOf(u.TimeZone)
+				}
 			}
 			for _, r := range reminders {
-				if triggeredReminders.m[r.ID] {
-					continue
+				loc := zones[r.UserID]
+				if loc == nil {
+					loc = time.UTC
 				}
-				if r.Time == now {
-					triggeredReminders.m[r.ID] = true
+				if reminderDue(r, loc, lastCheck, now) {
 					println("[Reminder] User:", r.UserID, "Message:", r.Message, "Type:", r.Type, "Time:", r.Time)
 				}
 			}
-			triggeredReminders.Unlock()
-			time.Sleep(time.Minute)
+			lastCheck = now
 		}
 	}()
 }
@@ -226,6 +309,11 @@ func getUsers(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	units := userUnits(c.GetInt("user_id"))
+	for i := range users {
+		displayUser(&users[i], units)
+	}
+	recordAudit(c, "user.list", "user", 0, nil)
 	c.JSON(http.StatusOK, users)
 }
 
@@ -240,6 +328,8 @@ func getUserByID(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	displayUser(&user, userUnits(c.GetInt("user_id")))
+	recordAudit(c, "user.view", "user", user.ID, nil)
 	c.JSON(http.StatusOK, user)
 }
 
@@ -249,6 +339,11 @@ func createUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	units := userUnits(c.GetInt("user_id"))
+	if err := canonicalUser(&newUser, nil, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if newUser.Weight == 0 {
 		newUser.Weight = 70
 	}
@@ -261,10 +356,30 @@ func createUser(c *gin.Context) {
 	if newUser.Height == 0 {
 		newUser.Height = 175
 	}
+	if newUser.Role == "" {
+		newUser.Role = RoleUser
+	}
+	if newUser.TimeZone == "" {
+		newUser.TimeZone = defaultTimeZone
+	}
+	if !validTimeZone(newUser.TimeZone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time zone"})
+		return
+	}
+	if !validRole(newUser.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+	if newUser.Role != RoleUser && !hasPermission(c.GetString("role"), PermRolesWrite) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to assign roles"})
+		return
+	}
 	if err := db.Create(&newUser).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, "user.create", "user", newUser.ID, gin.H{"email": newUser.Email, "role": newUser.Role})
+	displayUser(&newUser, units)
 	c.JSON(http.StatusCreated, newUser)
 }
 
@@ -279,10 +394,35 @@ func updateUser(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	before := user
+	units := userUnits(c.GetInt("user_id"))
+	displayUser(&user, units)
 	if err := c.ShouldBindJSON(&user); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := canonicalUser(&user, &before, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user.ID = before.ID
+	if user.Role == "" {
+		user.Role = before.Role
+	}
+	if user.Role != before.Role {
+		if !validRole(user.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+		if !hasPermission(c.GetString("role"), PermRolesWrite) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to change roles"})
+			return
+		}
+		if before.Role == RoleAdmin && isLastAdmin(before.ID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot demote the last admin"})
+			return
+		}
+	}
 	if user.Weight == 0 {
 		user.Weight = 70
 	}
@@ -295,10 +435,32 @@ func updateUser(c *gin.Context) {
 	if user.Height == 0 {
 		user.Height = 170
 	}
+	if user.TimeZone == "" {
+		user.TimeZone = before.TimeZone
+	}
+	if user.TimeZone != before.TimeZone && !validTimeZone(user.TimeZone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time zone"})
+		return
+	}
+	if err := normalizeHeartRates(&user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err := db.Save(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, "user.update", "user", user.ID, userChanges(before, user))
+	if user.Weight != before.Weight {
+		recalculateEstimatedCalories(user.ID)
+	}
+	if profileChanged(before, user) {
+		refreshCalorieGoal(user.ID, "profile")
+	}
+	if user.Sex != before.Sex {
+		invalidateTrainingLoads(user.ID)
+	}
+	displayUser(&user, units)
 	c.JSON(http.StatusOK, user)
 }
 
@@ -308,10 +470,16 @@ func deleteUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
+	if isLastAdmin(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot delete the last admin"})
+		return
+	}
 	if err := db.Delete(&User{}, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	revokeAllSessions(id)
+	recordAudit(c, "user.delete", "user", id, nil)
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
 }
 
@@ -319,18 +487,12 @@ func getWorkouts(c *gin.Context) {
 	userID := c.GetInt("user_id")
 	var workouts []Workout
 
-	start := c.Query("start")
-	end := c.Query("end")
 	category := c.Query("category")
 	typeParam := c.Query("type")
 
-	dbQuery := db.Where("user_id = ?", userID)
-
-	if start != "" {
-		dbQuery = dbQuery.Where("created_at >= ?", start)
-	}
-	if end != "" {
-		dbQuery = dbQuery.Where("created_at <= ?", end)
+	dbQuery, ok := filterByTimeRange(c, db.Where("user_id = ?", userID), "created_at")
+	if !ok {
+		return
 	}
 	if category != "" {
 		dbQuery = dbQuery.Where("category = ?", category)
@@ -343,6 +505,10 @@ func getWorkouts(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	units := userUnits(userID)
+	for i := range workouts {
+		displayWorkout(&workouts[i], units)
+	}
 	c.JSON(http.StatusOK, workouts)
 }
 func getWorkoutByID(c *gin.Context) {
@@ -357,6 +523,7 @@ func getWorkoutByID(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Workout not found"})
 		return
 	}
+	displayWorkout(&workout, userUnits(userID))
 	c.JSON(http.StatusOK, workout)
 }
 func createWorkout(c *gin.Context) {
@@ -367,17 +534,31 @@ func createWorkout(c *gin.Context) {
 		return
 	}
 	newWorkout.UserID = userID
+	newWorkout.Source = "manual"
+	units := userUnits(userID)
+	if err := canonicalWorkout(&newWorkout, nil, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if newWorkout.Intensity == "" {
 		newWorkout.Intensity = "medium"
 	}
 	if newWorkout.Location == "" {
 		newWorkout.Location = "unspecified"
 	}
+	var user User
+	if err := db.First(&user, userID).Error; err == nil {
+		applyCalorieEstimate(&newWorkout, nil, user)
+	}
 	if err := db.Create(&newWorkout).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	checkAndAwardBadges(userID) // Award badges after successful workout
+	updatePersonalRecords(userID, newWorkout.ID)
+	refreshCalorieGoal(userID, "workout")
+	linkScheduledSession(newWorkout)
+	displayWorkout(&newWorkout, units)
 	c.JSON(http.StatusCreated, newWorkout)
 }
 func updateWorkout(c *gin.Context) {
@@ -392,21 +573,37 @@ func updateWorkout(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Workout not found"})
 		return
 	}
+	stored := workout
+	units := userUnits(userID)
+	displayWorkout(&workout, units)
 	if err := c.ShouldBindJSON(&workout); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := canonicalWorkout(&workout, &stored, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	workout.UserID = userID
+	workout.Source = stored.Source
 	if workout.Intensity == "" {
 		workout.Intensity = "medium"
 	}
 	if workout.Location == "" {
 		workout.Location = "unspecified"
 	}
+	var user User
+	if err := db.First(&user, userID).Error; err == nil {
+		applyCalorieEstimate(&workout, &stored, user)
+	}
 	if err := db.Save(&workout).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	invalidateWorkoutLoad(workout.ID)
+	updatePersonalRecords(userID, workout.ID)
+	refreshCalorieGoal(userID, "workout")
+	displayWorkout(&workout, units)
 	c.JSON(http.StatusOK, workout)
 }
 func deleteWorkout(c *gin.Context) {
@@ -416,20 +613,53 @@ func deleteWorkout(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workout ID"})
 		return
 	}
-	if err := db.Where("id = ? AND user_id = ?", id, userID).Delete(&Workout{}).Error; err != nil {
+	// The workout and everything hanging off it go together or not at all.
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND user_id = ?", id, userID).Delete(&Workout{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if err := tx.Where("workout_id = ?", id).Delete(&TrackPoint{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("workout_id = ?", id).Delete(&WorkoutEffort{}).Error; err != nil {
+			return err
+		}
+		if err := deleteWorkoutExercises(tx, id); err != nil {
+			return err
+		}
+		if err := unlinkScheduledSessions(tx, id); err != nil {
+			return err
+		}
+		if err := tx.Delete(&WorkoutLoad{}, id).Error; err != nil {
+			return err
+		}
+		_, _, err := syncPersonalRecords(tx, userID, 0)
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	refreshCalorieGoal(userID, "workout")
 	c.JSON(http.StatusOK, gin.H{"message": "Workout deleted"})
 }
 
 func getWaterIntakes(c *gin.Context) {
 	userID := c.GetInt("user_id")
 	var waterIntakes []WaterIntake
-	if err := db.Where("user_id = ?", userID).Find(&waterIntakes).Error; err != nil {
+	query, ok := filterByTimeRange(c, db.Where("user_id = ?", userID), "consumed_at")
+	if !ok {
+		return
+	}
+	if err := query.Order("consumed_at").Find(&waterIntakes).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	units := userUnits(userID)
+	for i := range waterIntakes {
+		displayWater(&waterIntakes[i], units)
+	}
 	c.JSON(http.StatusOK, waterIntakes)
 }
 func getWaterIntakeByID(c *gin.Context) {
@@ -444,6 +674,7 @@ func getWaterIntakeByID(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Water intake not found"})
 		return
 	}
+	displayWater(&waterIntake, userUnits(userID))
 	c.JSON(http.StatusOK, waterIntake)
 }
 func createWaterIntake(c *gin.Context) {
@@ -454,6 +685,14 @@ func createWaterIntake(c *gin.Context) {
 		return
 	}
 	newWater.UserID = userID
+	units := userUnits(userID)
+	if err := canonicalWater(&newWater, nil, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if newWater.ConsumedAt.IsZero() {
+		newWater.ConsumedAt = time.Now()
+	}
 	if err := db.Create(&newWater).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -462,6 +701,7 @@ func createWaterIntake(c *gin.Context) {
 	// Update streak after creating water intake
 	updateStreak(userID, "water")
 
+	displayWater(&newWater, units)
 	c.JSON(http.StatusCreated, newWater)
 }
 func updateWaterIntake(c *gin.Context) {
@@ -476,15 +716,26 @@ func updateWaterIntake(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Water intake not found"})
 		return
 	}
+	stored := waterIntake
+	units := userUnits(userID)
+	displayWater(&waterIntake, units)
 	if err := c.ShouldBindJSON(&waterIntake); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := canonicalWater(&waterIntake, &stored, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	waterIntake.UserID = userID
+	if waterIntake.ConsumedAt.IsZero() {
+		waterIntake.ConsumedAt = waterIntake.CreatedAt
+	}
 	if err := db.Save(&waterIntake).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	displayWater(&waterIntake, units)
 	c.JSON(http.StatusOK, waterIntake)
 }
 func deleteWaterIntake(c *gin.Context) {
@@ -504,10 +755,21 @@ func deleteWaterIntake(c *gin.Context) {
 func getDietEntries(c *gin.Context) {
 	userID := c.GetInt("user_id")
 	var dietEntries []DietEntry
-	if err := db.Where("user_id = ?", userID).Find(&dietEntries).Error; err != nil {
+	query, ok := filterByTimeRange(c, db.Where("user_id = ?", userID), "consumed_at")
+	if !ok {
+		return
+	}
+	if meal := c.Query("meal"); meal != "" {
+		query = query.Where("meal = ?", meal)
+	}
+	if err := query.Order("consumed_at").Find(&dietEntries).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	units := userUnits(userID)
+	for i := range dietEntries {
+		displayDietEntry(&dietEntries[i], units)
+	}
 	c.JSON(http.StatusOK, dietEntries)
 }
 func getDietEntryByID(c *gin.Context) {
@@ -522,6 +784,7 @@ func getDietEntryByID(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Diet entry not found"})
 		return
 	}
+	displayDietEntry(&dietEntry, userUnits(userID))
 	c.JSON(http.StatusOK, dietEntry)
 }
 func createDietEntry(c *gin.Context) {
@@ -532,6 +795,14 @@ func createDietEntry(c *gin.Context) {
 		return
 	}
 	newDiet.UserID = userID
+	if newDiet.ConsumedAt.IsZero() {
+		newDiet.ConsumedAt = time.Now()
+	}
+	units := userUnits(userID)
+	if err := resolveDietFood(&newDiet, nil, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err := db.Create(&newDiet).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -540,6 +811,7 @@ func createDietEntry(c *gin.Context) {
 	// Update streak after creating diet entry
 	updateStreak(userID, "diet")
 
+	displayDietEntry(&newDiet, units)
 	c.JSON(http.StatusCreated, newDiet)
 }
 func updateDietEntry(c *gin.Context) {
@@ -554,15 +826,26 @@ func updateDietEntry(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Diet entry not found"})
 		return
 	}
+	stored := dietEntry
+	units := userUnits(userID)
+	displayDietEntry(&dietEntry, units)
 	if err := c.ShouldBindJSON(&dietEntry); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	dietEntry.UserID = userID
+	if dietEntry.ConsumedAt.IsZero() {
+		dietEntry.ConsumedAt = dietEntry.CreatedAt
+	}
+	if err := resolveDietFood(&dietEntry, &stored, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err := db.Save(&dietEntry).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	displayDietEntry(&dietEntry, units)
 	c.JSON(http.StatusOK, dietEntry)
 }
 func deleteDietEntry(c *gin.Context) {
@@ -572,10 +855,14 @@ func deleteDietEntry(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid diet entry ID"})
 		return
 	}
-	if err := db.Where("id = ? AND user_id = ?", id, userID).Delete(&DietEntry{}).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	result := db.Where("id = ? AND user_id = ?", id, userID).Delete(&DietEntry{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
 		return
 	}
+	if result.RowsAffected > 0 {
+		unlinkPlannedMeals(id)
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "Diet entry deleted"})
 }
 
@@ -803,11 +1090,42 @@ func deleteJourney(c *gin.Context) {
 
 func getHealthRecords(c *gin.Context) {
 	userID := c.GetInt("user_id")
+	units := userUnits(userID)
+	query := db.Where("user_id = ?", userID)
+	def, typed := lookupMetric(c.Query("type"))
+	if typed {
+		query = query.Where("type = ?", def.Type)
+	} else if t := c.Query("type"); t != "" {
+		query = query.Where("type = ?", normalizeKey(t))
+	}
+	if start := c.Query("start"); start != "" {
+		query = query.Where("date >= ?", start)
+	}
+	if end := c.Query("end"); end != "" {
+		query = query.Where("date <= ?", end)
+	}
+	for param, op := range map[string]string{"min": ">=", "max": "<="} {
+		if raw := c.Query(param); raw != "" {
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " value"})
+				return
+			}
+			// Bounds are given in the units the values are displayed in.
+			if typed && def.convert != nil {
+				v, _ = def.convert.toCanonical(v, "", units)
+			}
+			query = query.Where("numeric_value "+op+" ?", v)
+		}
+	}
 	var healthRecords []HealthRecord
-	if err := db.Where("user_id = ?", userID).Find(&healthRecords).Error; err != nil {
+	if err := query.Order("date, id").Find(&healthRecords).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	for i := range healthRecords {
+		displayHealthRecord(&healthRecords[i], units)
+	}
 	c.JSON(http.StatusOK, healthRecords)
 }
 func getHealthRecordByID(c *gin.Context) {
@@ -822,6 +1140,7 @@ func getHealthRecordByID(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Health record not found"})
 		return
 	}
+	displayHealthRecord(&healthRecord, userUnits(userID))
 	c.JSON(http.StatusOK, healthRecord)
 }
 func createHealthRecord(c *gin.Context) {
@@ -832,8 +1151,10 @@ func createHealthRecord(c *gin.Context) {
 		return
 	}
 	newRecord.UserID = userID
-	if newRecord.Date == "" {
-		newRecord.Date = time.Now().Format("2006-01-02")
+	units := userUnits(userID)
+	if err := prepareHealthRecord(&newRecord, userLocation(userID), units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 	if err := db.Create(&newRecord).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -844,7 +1165,11 @@ func createHealthRecord(c *gin.Context) {
 	if newRecord.Type == "steps" {
 		updateStreak(userID, "steps")
 	}
+	if newRecord.Type == "weight" {
+		refreshCalorieGoal(userID, "weight")
+	}
 
+	displayHealthRecord(&newRecord, units)
 	c.JSON(http.StatusCreated, newRecord)
 }
 func updateHealthRecord(c *gin.Context) {
@@ -859,15 +1184,29 @@ func updateHealthRecord(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Health record not found"})
 		return
 	}
+	units := userUnits(userID)
+	displayHealthRecord(&healthRecord, units)
 	if err := c.ShouldBindJSON(&healthRecord); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	healthRecord.ID = id
 	healthRecord.UserID = userID
+	if err := prepareHealthRecord(&healthRecord, userLocation(userID), units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err := db.Save(&healthRecord).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if healthRecord.Type == "steps" {
+		updateStreak(userID, "steps")
+	}
+	if healthRecord.Type == "weight" {
+		refreshCalorieGoal(userID, "weight")
+	}
+	displayHealthRecord(&healthRecord, units)
 	c.JSON(http.StatusOK, healthRecord)
 }
 func deleteHealthRecord(c *gin.Context) {
@@ -877,10 +1216,17 @@ func deleteHealthRecord(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid health record ID"})
 		return
 	}
-	if err := db.Where("id = ? AND user_id = ?", id, userID).Delete(&HealthRecord{}).Error; err != nil {
+	var deleted []HealthRecord
+	if err := db.Clauses(clause.Returning{}).Where("id = ? AND user_id = ?", id, userID).Delete(&deleted).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if len(deleted) > 0 && deleted[0].Type == "steps" {
+		updateStreak(userID, "steps")
+	}
+	if len(deleted) > 0 && deleted[0].Type == "weight" {
+		refreshCalorieGoal(userID, "weight")
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "Health record deleted"})
 }
 
@@ -1151,46 +1497,55 @@ func register(c *gin.Context) {
 		Age: 18,
 		Sex: "man",
 		Height: 175,
+		TimeZone: defaultTimeZone,
 	}
 	if err := db.Create(&newUser).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully", "user_id": newUser.ID})
+	if err := sendVerificationEmail(newUser); err != nil {
+		log.Printf("failed to send verification email: %v", err)
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully, check your email to verify the address", "user_id": newUser.ID})
 }
 
 func login(c *gin.Context) {
 	var req struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		DeviceName string `json:"device_name"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	var user User
-	if err := db.Where("email = ?", req.Email).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+
+	ipKey := "login:ip:" + c.ClientIP()
+	accountKey := accountLimitKey(req.Email)
+	if state, err := loginIPLimiter.Check(ipKey); err == nil && rejectIfBlocked(c, state) {
 		return
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	if state, err := loginAccountLimiter.Check(accountKey); err == nil && rejectIfBlocked(c, state) {
 		return
 	}
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: user.ID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+
+	var user User
+	userErr := db.Where("email = ?", req.Email).First(&user).Error
+	if userErr != nil || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		loginIPLimiter.Fail(ipKey)
+		state, err := loginAccountLimiter.Fail(accountKey)
+		if err == nil && state.Locked && userErr == nil {
+			db.Create(&LoginLockout{UserID: user.ID, IP: c.ClientIP(), Failures: state.Failures, LockedUntil: state.BlockedUntil})
+		}
+		if err == nil && state.Locked {
+			rejectIfBlocked(c, state)
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"token": tokenString})
+	loginAccountLimiter.Reset(accountKey)
+	completeLogin(c, user, req.DeviceName)
 }
 
 func authMiddleware() gin.HandlerFunc {
@@ -1199,23 +1554,52 @@ func authMiddleware() gin.HandlerFunc {
 		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
 			tokenString = tokenString[7:]
 		}
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-		if err != nil || !token.Valid {
+		var userID int
+		if apiKey := c.GetHeader("X-API-Key"); apiKey != "" || strings.HasPrefix(tokenString, apiKeyPrefix) {
+			if apiKey == "" {
+				apiKey = tokenString
+			}
+			key, ok := authenticateAPIKey(c, apiKey)
+			if !ok {
+				return
+			}
+			userID = key.UserID
+			c.Set("api_key_id", key.ID)
+		} else {
+			claims := &Claims{}
+			token, err := keys.parse(tokenString, claims)
+			if err != nil || !token.Valid {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+				return
+			}
+			var session Session
+			if err := db.Select("id", "user_id", "expires_at", "revoked_at").First(&session, claims.SessionID).Error; err != nil ||
+				session.UserID != claims.UserID || !session.active(time.Now()) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session revoked"})
+				return
+			}
+			userID = claims.UserID
+			c.Set("session_id", session.ID)
+		}
+		var user User
+		if err := db.Select("id", "role", "email_verified").First(&user, userID).Error; err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			return
 		}
-		c.Set("user_id", claims.UserID)
+		if !user.EmailVerified && requiresVerifiedEmail(c.FullPath()) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Email address not verified", "code": "email_unverified"})
+			return
+		}
+		c.Set("user_id", userID)
+		c.Set("role", user.Role)
+		c.Set("email_verified", user.EmailVerified)
 		c.Next()
 	}
 }
 
-var jwtKey = []byte("qwertyuiop")
-
 type Claims struct {
-	UserID int `json:"user_id"`
+	UserID    int `json:"user_id"`
+	SessionID int `json:"sid"`
 	jwt.RegisteredClaims
 }
 
@@ -1226,6 +1610,7 @@ func getMe(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	displayUser(&user, userUnits(userID))
 	c.JSON(http.StatusOK, user)
 }
 
@@ -1238,20 +1623,41 @@ func updateMe(c *gin.Context) {
 		Age    int     `json:"age"`
 		Sex    string  `json:"sex"`
 		Height float64 `json:"height"`
+		TimeZone string `json:"time_zone"`
+		WeightUnit string  `json:"weight_unit"`
+		HeightUnit string  `json:"height_unit"`
+		HeightFt   float64 `json:"height_ft"`
+		HeightIn   float64 `json:"height_in"`
+		MaxHeartRate     *int `json:"max_heart_rate"`
+		RestingHeartRate *int `json:"resting_heart_rate"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.TimeZone != "" && !validTimeZone(req.TimeZone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time zone"})
+		return
+	}
 	var user User
 	if err := db.First(&user, userID).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	units := userUnits(userID)
+	stored := user
+	var err error
 	user.Name = req.Name
-	user.Email = req.Email
+	emailChanged := req.Email != "" && req.Email != user.Email
+	if emailChanged {
+		user.Email = req.Email
+		user.EmailVerified = false
+	}
 	if req.Weight != 0 {
-		user.Weight = req.Weight
+		if user.Weight, err = massUnits.fromInput(req.Weight, req.WeightUnit, units, &stored.Weight); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
 	if req.Age != 0 {
 		user.Age = req.Age
@@ -1259,13 +1665,46 @@ func updateMe(c *gin.Context) {
 	if req.Sex != "" {
 		user.Sex = req.Sex
 	}
-	if req.Height != 0 {
-		user.Height = req.Height
+	if req.HeightFt != 0 || req.HeightIn != 0 {
+		user.Height = (req.HeightFt*12 + req.HeightIn) * heightUnits.factors["in"]
+	} else if req.Height != 0 {
+		if user.Height, err = heightUnits.fromInput(req.Height, req.HeightUnit, units, &stored.Height); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.TimeZone != "" {
+		user.TimeZone = req.TimeZone
+	}
+	if req.MaxHeartRate != nil {
+		user.MaxHeartRate = req.MaxHeartRate
+	}
+	if req.RestingHeartRate != nil {
+		user.RestingHeartRate = req.RestingHeartRate
+	}
+	if err := normalizeHeartRates(&user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 	if err := db.Save(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if emailChanged {
+		if err := sendVerificationEmail(user); err != nil {
+			log.Printf("failed to send verification email: %v", err)
+		}
+	}
+	if user.Weight != stored.Weight {
+		recalculateEstimatedCalories(userID)
+	}
+	if profileChanged(stored, user) {
+		refreshCalorieGoal(userID, "profile")
+	}
+	if user.Sex != stored.Sex {
+		invalidateTrainingLoads(userID)
+	}
+	displayUser(&user, units)
 	c.JSON(http.StatusOK, user)
 }
 
@@ -1273,12 +1712,14 @@ func getSettings(c *gin.Context) {
 	userID := c.GetInt("user_id")
 	var settings Settings
 	if err := db.First(&settings, userID).Error; err != nil {
-		settings = Settings{UserID: userID, NotificationsEnabled: true, Theme: "light", WaterGoal: 2000, CaloriesGoal: 2000, StepsGoal: 10000}
+		settings = Settings{UserID: userID, NotificationsEnabled: true, Theme: "light", WaterGoal: 2000, CaloriesGoal: 2000, StepsGoal: 10000, Units: UnitsMetric, GoalMode: GoalMaintain, BMRFormula: FormulaMifflin}
 		if err := db.Create(&settings).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 	}
+	settings.TimeZone = userLocation(userID).String()
+	displaySettings(&settings)
 	c.JSON(http.StatusOK, settings)
 }
 
@@ -1288,16 +1729,28 @@ func updateSettings(c *gin.Context) {
 		NotificationsEnabled bool   `json:"notificationsEnabled"`
 		Theme               string `json:"theme"`
 		WaterGoal             int    `json:"water_goal"`
-		CaloriesGoal        int    `json:"calories_goal"`
+		CaloriesGoal        *int   `json:"calories_goal"`
 		StepsGoal             int    `json:"steps_goal"`
+		TimeZone            string `json:"time_zone"`
+		Units               string `json:"units"`
+		WaterGoalUnit       string `json:"water_goal_unit"`
+		RecalculateCalories *bool  `json:"recalculate_calories"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.TimeZone != "" && !validTimeZone(req.TimeZone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time zone"})
+		return
+	}
+	if req.Units != "" && !validUnits(req.Units) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Units must be metric or imperial"})
+		return
+	}
 	var settings Settings
 	if err := db.First(&settings, userID).Error; err != nil {
-		settings = Settings{UserID: userID, NotificationsEnabled: true, Theme: "light", WaterGoal: 2000, CaloriesGoal: 2000, StepsGoal: 10000}
+		settings = Settings{UserID: userID, NotificationsEnabled: true, Theme: "light", WaterGoal: 2000, CaloriesGoal: 2000, StepsGoal: 10000, Units: UnitsMetric, GoalMode: GoalMaintain, BMRFormula: FormulaMifflin}
 		if err := db.Create(&settings).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -1305,13 +1758,45 @@ func updateSettings(c *gin.Context) {
 	}
 	settings.NotificationsEnabled = req.NotificationsEnabled
 	settings.Theme = req.Theme
-	settings.WaterGoal = req.WaterGoal
-	settings.CaloriesGoal = req.CaloriesGoal
+	// The goal is read in the units the client was shown, i.e. before any
+	// change of unit system in this same request.
+	waterGoal, err := canonicalWaterGoal(req.WaterGoal, req.WaterGoalUnit, settings)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	settings.WaterGoal = waterGoal
+	if req.Units != "" {
+		settings.Units = req.Units
+	}
+	// Older clients do not send the opt-in; leave it as it is then.
+	if req.RecalculateCalories != nil {
+		settings.RecalculateCalories = *req.RecalculateCalories
+	}
+	// Typing in a goal by hand takes it out of automatic mode; a save that
+	// leaves it out or sends it back unchanged does not.
+	manualGoal := req.CaloriesGoal != nil && *req.CaloriesGoal != settings.CaloriesGoal
+	previousGoal := settings.CaloriesGoal
+	if manualGoal {
+		settings.AutoCaloriesGoal = false
+		settings.CaloriesGoal = *req.CaloriesGoal
+	}
 	settings.StepsGoal = req.StepsGoal
 	if err := db.Save(&settings).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if manualGoal {
+		recordCalorieTarget(userID, previousGoal, energyReport{Target: settings.CaloriesGoal, GoalMode: settings.GoalMode, WeeklyRate: settings.WeeklyRate}, "manual")
+	}
+	if req.TimeZone != "" {
+		if err := db.Model(&User{}).Where("id = ?", userID).Update("time_zone", req.TimeZone).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	settings.TimeZone = userLocation(userID).String()
+	displaySettings(&settings)
 	c.JSON(http.StatusOK, settings)
 }
 
@@ -1460,193 +1945,116 @@ func postChatMessage(c *gin.Context) {
 }
 
 func getWeeklySummary(c *gin.Context) {
-	userID := c.GetInt("user_id")
-	start := c.Query("start")
-	end := c.Query("end")
-	var startTime, endTime time.Time
-	var err error
-	if start != "" {
-		startTime, err = time.Parse("2006-01-02", start)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date"})
-			return
-		}
-	} else {
-		startTime = time.Now().AddDate(0, 0, -7)
-	}
-	if end != "" {
-		endTime, err = time.Parse("2006-01-02", end)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date"})
-			return
-		}
-	} else {
-		endTime = time.Now()
-	}
-
-	var workouts []Workout
-	db.Where("user_id = ? AND created_at >= ? AND created_at <= ?", userID, startTime, endTime).Find(&workouts)
-	totalWorkouts := len(workouts)
-	totalWorkoutMinutes := 0
-	totalWorkoutCalories := 0
-	workoutByDay := map[string]int{}
-	for _, w := range workouts {
-		totalWorkoutMinutes += w.Duration
-		totalWorkoutCalories += w.Calories
-		day := w.CreatedAt.Format("2006-01-02")
-		workoutByDay[day] += w.Calories
-	}
-
-	var diets []DietEntry
-	db.Where("user_id = ? AND created_at >= ? AND created_at <= ?", userID, startTime, endTime).Find(&diets)
-	totalDietCalories := 0
-	dietByDay := map[string]int{}
-	for _, d := range diets {
-		totalDietCalories += d.Calories
-		var day string
-		if t, ok := any(d).(interface{ GetCreatedAt() time.Time }); ok {
-			day = t.GetCreatedAt().Format("2006-01-02")
-		} else if createdAtField, ok := any(d).(map[string]interface{}); ok && createdAtField["created_at"] != nil {
-			if t, ok := createdAtField["created_at"].(time.Time); ok {
-				day = t.Format("2006-01-02")
-			}
-		}
-		if day == "" {
-			day = time.Now().Format("2006-01-02")
-		}
-		dietByDay[day] += d.Calories
-	}
-
-	var water []WaterIntake
-	db.Where("user_id = ?", userID).Find(&water)
-	totalWater := 0
-	for _, w := range water {
-		totalWater += w.Amount
-	}
-
-	var health []HealthRecord
-	db.Where("user_id = ? AND type = ?", userID, "steps").Find(&health)
-	totalSteps := 0
-	for _, h := range health {
-		if steps, err := strconv.Atoi(h.Value); err == nil {
-			totalSteps += steps
-		}
-	}
-
-	daily := []gin.H{}
-	for d := startTime; !d.After(endTime); d = d.AddDate(0, 0, 1) {
-		dateStr := d.Format("2006-01-02")
-		daily = append(daily, gin.H{
-			"date": dateStr,
-			"burned": workoutByDay[dateStr],
-			"consumed": dietByDay[dateStr],
-		})
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"workouts": totalWorkouts,
-		"workout_minutes": totalWorkoutMinutes,
-		"workout_calories": totalWorkoutCalories,
-		"diet_calories": totalDietCalories,
-		"water_ml": totalWater,
-		"steps": totalSteps,
-		"start": startTime.Format("2006-01-02"),
-		"end": endTime.Format("2006-01-02"),
-		"daily_calories": daily,
-	})
+	summaryForRange(c, 7)
 }
 
 func getMonthlySummary(c *gin.Context) {
+	summaryForRange(c, 30)
+}
+
+// summaryForRange totals activity between the start and end query dates
+// (inclusive), defaulting to the last defaultDays days. Days are the user's
+// local days.
+func summaryForRange(c *gin.Context, defaultDays int) {
 	userID := c.GetInt("user_id")
+	loc := userLocation(userID)
+	units := userUnits(userID)
 	start := c.Query("start")
 	end := c.Query("end")
 	var startTime, endTime time.Time
 	var err error
 	if start != "" {
-		startTime, err = time.Parse("2006-01-02", start)
+		startTime, err = time.ParseInLocation("2006-01-02", start, loc)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date"})
 			return
 		}
 	} else {
-		startTime = time.Now().AddDate(0, 0, -30)
+		startTime, _ = dayBounds(time.Now(), loc, -defaultDays)
 	}
 	if end != "" {
-		endTime, err = time.Parse("2006-01-02", end)
+		endTime, err = time.ParseInLocation("2006-01-02", end, loc)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date"})
 			return
 		}
 	} else {
-		endTime = time.Now()
+		endTime = startOfDay(time.Now(), loc)
 	}
+	_, rangeEnd := dayBounds(endTime, loc, 0)
 
 	var workouts []Workout
-	db.Where("user_id = ? AND created_at >= ? AND created_at <= ?", userID, startTime, endTime).Find(&workouts)
+	db.Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, startTime, rangeEnd).Find(&workouts)
 	totalWorkouts := len(workouts)
 	totalWorkoutMinutes := 0
 	totalWorkoutCalories := 0
+	totalDistance := 0.0
 	workoutByDay := map[string]int{}
 	for _, w := range workouts {
+		totalDistance += w.Distance
 		totalWorkoutMinutes += w.Duration
 		totalWorkoutCalories += w.Calories
-		day := w.CreatedAt.Format("2006-01-02")
-		workoutByDay[day] += w.Calories
+		workoutByDay[localDate(w.CreatedAt, loc)] += w.Calories
 	}
 
 	var diets []DietEntry
-	db.Where("user_id = ? AND created_at >= ? AND created_at <= ?", userID, startTime, endTime).Find(&diets)
+	db.Where("user_id = ? AND consumed_at >= ? AND consumed_at < ?", userID, startTime, rangeEnd).Find(&diets)
 	totalDietCalories := 0
 	dietByDay := map[string]int{}
+	var totalNutrition Nutrition
+	nutritionByDay := map[string]Nutrition{}
 	for _, d := range diets {
 		totalDietCalories += d.Calories
-		var day string
-		if t, ok := any(d).(interface{ GetCreatedAt() time.Time }); ok {
-			day = t.GetCreatedAt().Format("2006-01-02")
-		} else if createdAtField, ok := any(d).(map[string]interface{}); ok && createdAtField["created_at"] != nil {
-			if t, ok := createdAtField["created_at"].(time.Time); ok {
-				day = t.Format("2006-01-02")
-			}
-		}
-		if day == "" {
-			day = time.Now().Format("2006-01-02")
-		}
-		dietByDay[day] += d.Calories
+		dietByDay[localDate(d.ConsumedAt, loc)] += d.Calories
+		totalNutrition.addEntry(d)
+		day := nutritionByDay[localDate(d.ConsumedAt, loc)]
+		day.addEntry(d)
+		nutritionByDay[localDate(d.ConsumedAt, loc)] = day
 	}
 
 	var water []WaterIntake
-	db.Where("user_id = ?", userID).Find(&water)
-	totalWater := 0
+	db.Where("user_id = ? AND consumed_at >= ? AND consumed_at < ?", userID, startTime, rangeEnd).Find(&water)
+	totalWater := 0.0
+	waterByDay := map[string]float64{}
 	for _, w := range water {
 		totalWater += w.Amount
+		waterByDay[localDate(w.ConsumedAt, loc)] += w.Amount
 	}
 
-	var health []HealthRecord
-	db.Where("user_id = ? AND type = ?", userID, "steps").Find(&health)
-	totalSteps := 0
-	for _, h := range health {
-		if steps, err := strconv.Atoi(h.Value); err == nil {
-			totalSteps += steps
-		}
-	}
+	var totalSteps float64
+	db.Model(&HealthRecord{}).Select("COALESCE(SUM(numeric_value), 0)").
+		Where("user_id = ? AND type = ? AND date >= ? AND date <= ?", userID, "steps",
+			startTime.Format("2006-01-02"), endTime.Format("2006-01-02")).Scan(&totalSteps)
 
 	daily := []gin.H{}
-	for d := startTime; !d.After(endTime); d = d.AddDate(0, 0, 1) {
+	for d := startTime; d.Before(rangeEnd); d, _ = dayBounds(d, loc, 1) {
 		dateStr := d.Format("2006-01-02")
+		dayWater, _ := volumeUnits.display(waterByDay[dateStr], units)
 		daily = append(daily, gin.H{
 			"date": dateStr,
 			"burned": workoutByDay[dateStr],
 			"consumed": dietByDay[dateStr],
+			"nutrition": nutritionByDay[dateStr].rounded(),
+			"water_ml": waterByDay[dateStr],
+			"water": dayWater,
 		})
 	}
+	shownWater, waterUnit := volumeUnits.display(totalWater, units)
+	distance, distanceUnit := distanceUnits.display(totalDistance, units)
 
 	c.JSON(http.StatusOK, gin.H{
 		"workouts": totalWorkouts,
 		"workout_minutes": totalWorkoutMinutes,
 		"workout_calories": totalWorkoutCalories,
 		"diet_calories": totalDietCalories,
+		"diet_nutrition": totalNutrition.rounded(),
 		"water_ml": totalWater,
-		"steps": totalSteps,
+		"water": shownWater,
+		"water_unit": waterUnit,
+		"distance": distance,
+		"distance_unit": distanceUnit,
+		"units": units,
+		"steps": int(totalSteps),
 		"start": startTime.Format("2006-01-02"),
 		"end": endTime.Format("2006-01-02"),
 		"daily_calories": daily,
@@ -1664,15 +2072,9 @@ var badgeCriteria = []struct {
 		Title: "10,000 Steps in a Day",
 		Desc:  "Walk 10,000 steps in a single day.",
 		Check: func(userID int) bool {
-			var recs []HealthRecord
-			today := time.Now().Format("2006-01-02")
-			db.Where("user_id = ? AND type = ? AND date = ?", userID, "steps", today).Find(&recs)
-			for _, r := range recs {
-				if v, err := strconv.Atoi(r.Value); err == nil && v >= 10000 {
-					return true
-				}
-			}
-			return false
+			today := localDate(time.Now(), userLocation(userID))
+			steps, _ := dailyMetricValue(userID, "steps", today)
+			return steps >= 10000
 		},
 	},
 	{
@@ -1730,40 +2132,24 @@ func calculateStepsStreak(userID int) int {
 	}
 
 	streak := 0
+	loc := userLocation(userID)
 	today := time.Now()
 
-	todayStr := today.Format("2006-01-02")
-	var totalSteps int
-	var records []HealthRecord
-	db.Where("user_id = ? AND type = ? AND date = ?", userID, "steps", todayStr).Find(&records)
+	todayStr := localDate(today, loc)
+	totalSteps, _ := dailyMetricValue(userID, "steps", todayStr)
 
-	for _, record := range records {
-		if steps, err := strconv.Atoi(record.Value); err == nil {
-			totalSteps += steps
-		}
-	}
-
-	if totalSteps >= settings.StepsGoal {
+	if totalSteps >= float64(settings.StepsGoal) {
 		streak = 1
 	} else {
 		return 0
 	}
 
 	for i := 1; i < 365; i++ {
-		checkDate := today.AddDate(0, 0, -i)
+		checkDate, _ := dayBounds(today, loc, -i)
 		dateStr := checkDate.Format("2006-01-02")
+		totalSteps, _ := dailyMetricValue(userID, "steps", dateStr)
 
-		var totalSteps int
-		var records []HealthRecord
-		db.Where("user_id = ? AND type = ? AND date = ?", userID, "steps", dateStr).Find(&records)
-
-		for _, record := range records {
-			if steps, err := strconv.Atoi(record.Value); err == nil {
-				totalSteps += steps
-			}
-		}
-
-		if totalSteps >= settings.StepsGoal {
+		if totalSteps >= float64(settings.StepsGoal) {
 			streak++
 		} else {
 			break
@@ -1780,36 +2166,26 @@ func calculateDietStreak(userID int) int {
 	}
 
 	streak := 0
+	loc := userLocation(userID)
 	today := time.Now()
 
-	todayStr := today.Format("2006-01-02")
-	var totalCalories int
+	dayStart, dayEnd := dayBounds(today, loc, 0)
 	var entries []DietEntry
-	db.Where("user_id = ? AND DATE(created_at) = ?", userID, todayStr).Find(&entries)
+	db.Where("user_id = ? AND consumed_at >= ? AND consumed_at < ?", userID, dayStart, dayEnd).Find(&entries)
 
-	for _, entry := range entries {
-		totalCalories += entry.Calories
-	}
-
-	if totalCalories <= settings.CaloriesGoal {
+	if dietDayMet(settings, entries) {
 		streak = 1
 	} else {
 		return 0
 	}
 
 	for i := 1; i < 365; i++ {
-		checkDate := today.AddDate(0, 0, -i)
-		dateStr := checkDate.Format("2006-01-02")
+		dayStart, dayEnd := dayBounds(today, loc, -i)
 
-		var totalCalories int
 		var entries []DietEntry
-		db.Where("user_id = ? AND DATE(created_at) = ?", userID, dateStr).Find(&entries)
+		db.Where("user_id = ? AND consumed_at >= ? AND consumed_at < ?", userID, dayStart, dayEnd).Find(&entries)
 
-		for _, entry := range entries {
-			totalCalories += entry.Calories
-		}
-
-		if totalCalories <= settings.CaloriesGoal {
+		if dietDayMet(settings, entries) {
 			streak++
 		} else {
 			break
@@ -1826,36 +2202,36 @@ func calculateWaterStreak(userID int) int {
 	}
 
 	streak := 0
+	loc := userLocation(userID)
 	today := time.Now()
 
-	todayStr := today.Format("2006-01-02")
-	var totalWater int
+	dayStart, dayEnd := dayBounds(today, loc, 0)
+	var totalWater float64
 	var intakes []WaterIntake
-	db.Where("user_id = ? AND DATE(created_at) = ?", userID, todayStr).Find(&intakes)
+	db.Where("user_id = ? AND consumed_at >= ? AND consumed_at < ?", userID, dayStart, dayEnd).Find(&intakes)
 
 	for _, intake := range intakes {
 		totalWater += intake.Amount
 	}
 
-	if totalWater >= settings.WaterGoal {
+	if totalWater >= float64(settings.WaterGoal) {
 		streak = 1
 	} else {
 		return 0
 	}
 
 	for i := 1; i < 365; i++ {
-		checkDate := today.AddDate(0, 0, -i)
-		dateStr := checkDate.Format("2006-01-02")
+		dayStart, dayEnd := dayBounds(today, loc, -i)
 
-		var totalWater int
+		var totalWater float64
 		var intakes []WaterIntake
-		db.Where("user_id = ? AND DATE(created_at) = ?", userID, dateStr).Find(&intakes)
+		db.Where("user_id = ? AND consumed_at >= ? AND consumed_at < ?", userID, dayStart, dayEnd).Find(&intakes)
 
 		for _, intake := range intakes {
 			totalWater += intake.Amount
 		}
 
-		if totalWater >= settings.WaterGoal {
+		if totalWater >= float64(settings.WaterGoal) {
 			streak++
 		} else {
 			break
@@ -1866,7 +2242,7 @@ func calculateWaterStreak(userID int) int {
 }
 
 func updateStreak(userID int, streakType string) {
-	today := time.Now().Format("2006-01-02")
+	today := localDate(time.Now(), userLocation(userID))
 
 	var streak Streak
 	err := db.Where("user_id = ? AND type = ?", userID, streakType).First(&streak).Error
@@ -1933,32 +2309,108 @@ func main() {
 	if err != nil {
 		log.Println("No .env file found or error loading .env file")
 	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrateCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "foods" {
+		os.Exit(runFoodsCommand(os.Args[2:]))
+	}
+	keys, err = loadKeys()
+	if err != nil {
+		log.Fatalf("failed to load JWT keys: %v", err)
+	}
+	mailer, err = newMailer()
+	if err != nil {
+		log.Fatalf("failed to configure mailer: %v", err)
+	}
+	if err := loadOIDCProviders(); err != nil {
+		log.Fatalf("failed to load OIDC providers: %v", err)
+	}
 	r := gin.Default()
 
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
+	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-API-Key"}
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
 	config.AllowCredentials = true
 	r.Use(cors.New(config))
 
-	r.POST("/register", register)
+	r.POST("/register", throttleByIP("register"), register)
 	r.POST("/login", login)
+	r.POST("/login/2fa", loginSecondFactor)
+	r.POST("/token/refresh", refreshToken)
+	r.GET("/.well-known/jwks.json", getJWKS)
+	r.POST("/password/forgot", throttleByIP("forgot"), forgotPassword)
+	r.POST("/password/reset", resetPassword)
+	r.POST("/email/verify", verifyEmail)
+	r.GET("/auth/oidc/providers", getOIDCProviders)
+	r.GET("/auth/oidc/:provider/login", oidcStartLogin)
+	r.GET("/auth/oidc/:provider/callback", oidcCallback)
 
 	auth := r.Group("/")
 	auth.Use(authMiddleware())
 
-	auth.GET("/users", getUsers)
-	auth.GET("/users/:id", getUserByID)
-	auth.POST("/users", createUser)
-	auth.PUT("/users/:id", updateUser)
-	auth.DELETE("/users/:id", deleteUser)
+	admin := auth.Group("/admin")
+	admin.GET("/users", requirePermission(PermUsersRead), getUsers)
+	admin.GET("/users/:id", requirePermission(PermUsersRead), getUserByID)
+	admin.POST("/users", requirePermission(PermUsersWrite), createUser)
+	admin.PUT("/users/:id", requirePermission(PermUsersWrite), updateUser)
+	admin.DELETE("/users/:id", requirePermission(PermUsersWrite), deleteUser)
+	admin.GET("/users/:id/lockouts", requirePermission(PermUsersRead), getUserLockouts)
+	admin.GET("/audit", requirePermission(PermAuditRead), getAuditLogs)
 
 	auth.GET("/me", getMe)
 	auth.PUT("/me", updateMe)
 
+	auth.POST("/logout", logout)
+	auth.GET("/sessions", getSessions)
+	auth.DELETE("/sessions/:id", deleteSession)
+	auth.POST("/email/verify/resend", resendVerificationEmail)
+
+	auth.GET("/2fa", getTOTPStatus)
+	auth.POST("/2fa/enroll", enrollTOTP)
+	auth.POST("/2fa/confirm", confirmTOTP)
+	auth.POST("/2fa/disable", disableTOTP)
+	auth.POST("/2fa/recovery-codes", regenerateRecoveryCodes)
+
+	auth.GET("/apikeys", getAPIKeys)
+	auth.POST("/apikeys", createAPIKey)
+	auth.DELETE("/apikeys/:id", deleteAPIKey)
+
+	auth.POST("/auth/oidc/:provider/link", oidcStartLink)
+	auth.GET("/auth/identities", getExternalIdentities)
+	auth.DELETE("/auth/identities/:id", deleteExternalIdentity)
+
 	auth.GET("/workouts", getWorkouts)
+	auth.GET("/workouts/estimate", getCalorieEstimate)
 	auth.GET("/workouts/:id", getWorkoutByID)
+	auth.GET("/workouts/:id/route", getWorkoutRoute)
+	auth.POST("/workouts/import", importWorkout)
+	auth.GET("/workouts/:id/exercises", getWorkoutExercises)
+	auth.PUT("/workouts/:id/exercises", replaceWorkoutExercises)
+	auth.GET("/exercises", getExercises)
+	auth.GET("/records", getPersonalRecords)
+	auth.GET("/templates", getTemplates)
+	auth.GET("/templates/:id", getTemplate)
+	auth.POST("/templates", createTemplate)
+	auth.PUT("/templates/:id", updateTemplate)
+	auth.DELETE("/templates/:id", deleteTemplate)
+	auth.POST("/templates/:id/workout", logTemplateWorkout)
+	auth.GET("/plans", getPlans)
+	auth.GET("/plans/:id", getPlan)
+	auth.POST("/plans", createPlan)
+	auth.PUT("/plans/:id", updatePlan)
+	auth.DELETE("/plans/:id", deletePlan)
+	auth.POST("/plans/:id/enroll", enrollInPlan)
+	auth.GET("/plans/:id/adherence", getPlanAdherence)
+	auth.GET("/enrollments", getEnrollments)
+	auth.DELETE("/enrollments/:id", cancelEnrollment)
+	auth.GET("/schedule", getSchedule)
+	auth.POST("/schedule/:id/complete", completeSession)
+	auth.POST("/schedule/:id/skip", skipSession)
+	auth.POST("/exercises", createExercise)
+	auth.GET("/exercises/:id/history", getExerciseHistory)
+	auth.GET("/exercises/:id/progression", getExerciseProgression)
 	auth.POST("/workouts", createWorkout)
 	auth.PUT("/workouts/:id", updateWorkout)
 	auth.DELETE("/workouts/:id", deleteWorkout)
@@ -1974,6 +2426,26 @@ func main() {
 	auth.POST("/diet", createDietEntry)
 	auth.PUT("/diet/:id", updateDietEntry)
 	auth.DELETE("/diet/:id", deleteDietEntry)
+	auth.GET("/foods", getFoods)
+	auth.GET("/foods/:id", getFood)
+	auth.GET("/foods/barcode/:ean", getFoodByBarcode)
+	auth.POST("/foods", createFood)
+	auth.PUT("/foods/:id", updateFood)
+	auth.DELETE("/foods/:id", deleteFood)
+	auth.GET("/recipes", getRecipes)
+	auth.GET("/recipes/:id", getRecipe)
+	auth.POST("/recipes", createRecipe)
+	auth.PUT("/recipes/:id", updateRecipe)
+	auth.DELETE("/recipes/:id", deleteRecipe)
+	auth.GET("/nutrition/goals", getNutritionGoals)
+	auth.PUT("/nutrition/goals", updateNutritionGoals)
+	auth.GET("/nutrition/daily", getDailyNutrition)
+	auth.GET("/meal-plan", getMealPlan)
+	auth.POST("/meal-plan", createPlannedMeal)
+	auth.PUT("/meal-plan/:id", updatePlannedMeal)
+	auth.DELETE("/meal-plan/:id", deletePlannedMeal)
+	auth.POST("/meal-plan/log", logPlannedMeal)
+	auth.GET("/meal-plan/shopping-list", getShoppingList)
 
 	auth.GET("/periods", getPeriods)
 	auth.GET("/periods/:id", getPeriodByID)
@@ -1998,6 +2470,8 @@ func main() {
 	auth.POST("/healthrecords", createHealthRecord)
 	auth.PUT("/healthrecords/:id", updateHealthRecord)
 	auth.DELETE("/healthrecords/:id", deleteHealthRecord)
+	auth.GET("/metrics", getMetrics)
+	auth.GET("/metrics/:type/daily", getMetricDaily)
 
 	auth.GET("/reminders", getReminders)
 	auth.POST("/reminders", createReminder)
@@ -2019,11 +2493,19 @@ func main() {
 	r.GET("/chat/:friend_id", authMiddleware(), getChatHistory)
 	r.POST("/chat/:friend_id", authMiddleware(), postChatMessage)
 	auth.GET("/summary/weekly", getWeeklySummary)
+	auth.GET("/summary/training-load", getTrainingLoad)
 	auth.GET("/summary/monthly", getMonthlySummary)
+	auth.GET("/energy", getEnergy)
+	auth.PUT("/energy/goal", updateEnergyGoal)
+	auth.GET("/energy/targets", getCalorieTargets)
 	auth.GET("/badges", authMiddleware(), getBadges)
 	auth.GET("/streaks", authMiddleware(), getStreaks)
 
 	initDB()
+	if err := initLimiters(); err != nil {
+		log.Fatalf("failed to configure login limiter: %v", err)
+	}
+	bootstrapAdmins()
 	startReminderChecker()
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
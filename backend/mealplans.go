@@ -0,0 +1,539 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxMealPlanDays = 62
+
+// mealHours is the local hour a planned meal is logged at when it is
+// logged on its day after the fact.
+var mealHours = map[string]int{"breakfast": 8, "lunch": 13, "snack": 16, "dinner": 19}
+
+// errMealAlreadyLogged means another request logged a planned meal first.
+var errMealAlreadyLogged = errors.New("meal was already logged")
+
+// PlannedMeal is a food or recipe the user means to eat at Meal on Date,
+// sized like a diet entry: Amount grams of a food or Servings of a recipe.
+// DietEntryID links the entry it was logged as.
+type PlannedMeal struct {
+	ID          int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID      int       `json:"user_id" gorm:"index:idx_planned_meals_user_date;not null"`
+	Date        string    `json:"date" gorm:"type:varchar(10);index:idx_planned_meals_user_date;not null"`
+	Meal        string    `json:"meal" gorm:"type:varchar(32);not null"`
+	FoodID      *int      `json:"food_id" gorm:"index"`
+	Amount      float64   `json:"amount" gorm:"not null;default:0"`
+	AmountUnit  string    `json:"amount_unit,omitempty" gorm:"-"`
+	RecipeID    *int      `json:"recipe_id" gorm:"index"`
+	Servings    float64   `json:"servings,omitempty" gorm:"not null;default:0"`
+	Note        string    `json:"note"`
+	DietEntryID *int      `json:"diet_entry_id" gorm:"index"`
+	Name        string    `json:"name" gorm:"-"`
+	Nutrition   Nutrition `json:"nutrition" gorm:"-"`
+	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// dietEntry is the diet entry the planned meal describes, with its portion
+// in canonical units.
+func (p PlannedMeal) dietEntry() DietEntry {
+	return DietEntry{
+		UserID:     p.UserID,
+		Meal:       p.Meal,
+		FoodID:     p.FoodID,
+		Amount:     p.Amount,
+		AmountUnit: portionUnits.canonical,
+		RecipeID:   p.RecipeID,
+		Servings:   p.Servings,
+	}
+}
+
+// preparePlannedMeal validates a planned meal from a request. The portion
+// is resolved the way a diet entry's is, so the same foods, recipes, amounts
+// and servings are accepted.
+func preparePlannedMeal(p *PlannedMeal, units string) error {
+	if _, err := time.Parse(dateLayout, p.Date); err != nil {
+		return errors.New("date must be YYYY-MM-DD")
+	}
+	if p.Meal = normalizeKey(p.Meal); p.Meal == "" || len(p.Meal) > 32 {
+		return errors.New("meal is required and must be at most 32 characters")
+	}
+	if (p.FoodID == nil) == (p.RecipeID == nil) {
+		return errors.New("give either food_id or recipe_id")
+	}
+	entry := p.dietEntry()
+	entry.AmountUnit = p.AmountUnit
+	if err := resolveDietFood(&entry, nil, units); err != nil {
+		return err
+	}
+	p.Amount, p.AmountUnit, p.Servings = entry.Amount, "", entry.Servings
+	p.Name, p.Nutrition = entry.Food, entry.nutrition()
+	return nil
+}
+
+// mealPlanContents loads the recipes of planned meals and every food in
+// them, recipe ingredients included.
+func mealPlanContents(meals []PlannedMeal) (map[int]Food, map[int]Recipe, error) {
+	recipeIDs, foodIDs := []int{}, []int{}
+	for _, p := range meals {
+		if p.RecipeID != nil {
+			recipeIDs = append(recipeIDs, *p.RecipeID)
+		}
+		if p.FoodID != nil {
+			foodIDs = append(foodIDs, *p.FoodID)
+		}
+	}
+	recipes := map[int]Recipe{}
+	if len(recipeIDs) > 0 {
+		var rows []Recipe
+		if err := db.Preload("Ingredients", preloadIngredients).Where("id IN ?", uniqueInts(recipeIDs)).Find(&rows).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, r := range rows {
+			recipes[r.ID] = r
+			for _, in := range r.Ingredients {
+				foodIDs = append(foodIDs, in.FoodID)
+			}
+		}
+	}
+	foods := map[int]Food{}
+	if len(foodIDs) > 0 {
+		var rows []Food
+		if err := db.Where("id IN ?", uniqueInts(foodIDs)).Find(&rows).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, f := range rows {
+			foods[f.ID] = f
+		}
+	}
+	return foods, recipes, nil
+}
+
+// plannedNutrition fills in the names and nutrients of planned meals from
+// the current foods and recipes; unlike diet entries, plans follow edits.
+func plannedNutrition(meals []PlannedMeal) error {
+	foods, recipes, err := mealPlanContents(meals)
+	if err != nil {
+		return err
+	}
+	for i := range meals {
+		p := &meals[i]
+		var n Nutrition
+		if p.FoodID != nil {
+			food := foods[*p.FoodID]
+			p.Name = food.Name
+			n.addFood(food, p.Amount)
+		} else if r, ok := recipes[*p.RecipeID]; ok {
+			p.Name = r.Name
+			n = recipeTotal(r, foods).scaled(p.Servings / float64(r.Servings))
+		}
+		p.Nutrition = n.rounded()
+	}
+	return nil
+}
+
+func displayPlannedMeal(p *PlannedMeal, units string) {
+	if p.FoodID != nil {
+		p.Amount, p.AmountUnit = portionUnits.display(p.Amount, units)
+	}
+}
+
+// mealPlanRange reads start and end (inclusive, default today and the six
+// days after).
+func mealPlanRange(c *gin.Context, loc *time.Location) (string, string, bool) {
+	start := c.DefaultQuery("start", localDate(time.Now(), loc))
+	startDay, err := time.Parse(dateLayout, start)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date"})
+		return "", "", false
+	}
+	end := c.DefaultQuery("end", startDay.AddDate(0, 0, 6).Format(dateLayout))
+	endDay, err := time.Parse(dateLayout, end)
+	if err != nil || endDay.Before(startDay) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date"})
+		return "", "", false
+	}
+	if endDay.Sub(startDay) >= maxMealPlanDays*24*time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Date range is too long"})
+		return "", "", false
+	}
+	return start, end, true
+}
+
+func findPlannedMeal(c *gin.Context, userID int) (PlannedMeal, bool) {
+	var p PlannedMeal
+	id, ok := paramID(c, "planned meal")
+	if !ok {
+		return p, false
+	}
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&p).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Planned meal not found"})
+		return p, false
+	}
+	return p, true
+}
+
+type mealPlanDay struct {
+	meals   map[string][]PlannedMeal
+	planned map[string]Nutrition
+	actual  map[string]Nutrition
+}
+
+// getMealPlan lists the planned meals between start and end day by day and
+// meal by meal, next to what was actually logged: planned and actual
+// totals per meal and per day.
+func getMealPlan(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	loc := userLocation(userID)
+	start, end, ok := mealPlanRange(c, loc)
+	if !ok {
+		return
+	}
+	var meals []PlannedMeal
+	if err := db.Where("user_id = ? AND date >= ? AND date <= ?", userID, start, end).
+		Order("date, id").Find(&meals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := plannedNutrition(meals); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	startDay, _ := time.ParseInLocation(dateLayout, start, loc)
+	endDay, _ := time.ParseInLocation(dateLayout, end, loc)
+	from, _ := dayBounds(startDay, loc, 0)
+	_, to := dayBounds(endDay, loc, 0)
+	var entries []DietEntry
+	if err := db.Where("user_id = ? AND consumed_at >= ? AND consumed_at < ?", userID, from, to).
+		Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	days := map[string]*mealPlanDay{}
+	day := func(date string) *mealPlanDay {
+		if days[date] == nil {
+			days[date] = &mealPlanDay{meals: map[string][]PlannedMeal{}, planned: map[string]Nutrition{}, actual: map[string]Nutrition{}}
+		}
+		return days[date]
+	}
+	units := userUnits(userID)
+	for _, p := range meals {
+		d := day(p.Date)
+		n := d.planned[p.Meal]
+		n.addNutrition(p.Nutrition)
+		d.planned[p.Meal] = n
+		displayPlannedMeal(&p, units)
+		d.meals[p.Meal] = append(d.meals[p.Meal], p)
+	}
+	for _, e := range entries {
+		d := day(localDate(e.ConsumedAt, loc))
+		meal := normalizeKey(e.Meal)
+		if meal == "" {
+			meal = "other"
+		}
+		n := d.actual[meal]
+		n.addEntry(e)
+		d.actual[meal] = n
+	}
+
+	views := []gin.H{}
+	for date := startDay; !date.After(endDay); date = date.AddDate(0, 0, 1) {
+		d := day(date.Format(dateLayout))
+		names := []string{}
+		for meal := range d.planned {
+			names = append(names, meal)
+		}
+		for meal := range d.actual {
+			if _, ok := d.planned[meal]; !ok {
+				names = append(names, meal)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if a, b := mealIndex(names[i]), mealIndex(names[j]); a != b {
+				return a < b
+			}
+			return names[i] < names[j]
+		})
+		var planned, actual Nutrition
+		mealViews := []gin.H{}
+		for _, meal := range names {
+			items := d.meals[meal]
+			if items == nil {
+				items = []PlannedMeal{}
+			}
+			planned.addNutrition(d.planned[meal])
+			actual.addNutrition(d.actual[meal])
+			mealViews = append(mealViews, gin.H{
+				"meal":    meal,
+				"items":   items,
+				"planned": d.planned[meal].rounded(),
+				"actual":  d.actual[meal].rounded(),
+			})
+		}
+		views = append(views, gin.H{
+			"date":    date.Format(dateLayout),
+			"meals":   mealViews,
+			"planned": planned.rounded(),
+			"actual":  actual.rounded(),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"start": start, "end": end, "days": views})
+}
+
+// mealIndex orders meals through the day, other names after the usual ones.
+func mealIndex(meal string) int {
+	for i, m := range mealOrder {
+		if m == meal {
+			return i
+		}
+	}
+	return len(mealOrder)
+}
+
+func createPlannedMeal(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var p PlannedMeal
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.ID, p.UserID, p.DietEntryID = 0, userID, nil
+	units := userUnits(userID)
+	if err := preparePlannedMeal(&p, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Create(&p).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	displayPlannedMeal(&p, units)
+	c.JSON(http.StatusCreated, p)
+}
+
+// updatePlannedMeal replaces a planned meal that has not been logged yet.
+func updatePlannedMeal(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	stored, ok := findPlannedMeal(c, userID)
+	if !ok {
+		return
+	}
+	if stored.DietEntryID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Planned meal has already been logged"})
+		return
+	}
+	var p PlannedMeal
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.ID, p.UserID, p.DietEntryID, p.CreatedAt = stored.ID, userID, nil, stored.CreatedAt
+	units := userUnits(userID)
+	if err := preparePlannedMeal(&p, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Save(&p).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	displayPlannedMeal(&p, units)
+	c.JSON(http.StatusOK, p)
+}
+
+// deletePlannedMeal takes a meal off the plan. A diet entry it was logged
+// as stays.
+func deletePlannedMeal(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	p, ok := findPlannedMeal(c, userID)
+	if !ok {
+		return
+	}
+	if err := db.Delete(&p).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Planned meal deleted"})
+}
+
+// logPlannedMeal logs every item planned for meal on date (default today)
+// that is not logged yet as diet entries, computed from the current foods
+// and recipes. Entries for today are timed now; for earlier days at the
+// meal's usual hour.
+func logPlannedMeal(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var req struct {
+		Date string `json:"date"`
+		Meal string `json:"meal" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	loc := userLocation(userID)
+	today := localDate(time.Now(), loc)
+	if req.Date == "" {
+		req.Date = today
+	}
+	day, err := time.ParseInLocation(dateLayout, req.Date, loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date"})
+		return
+	}
+	if req.Date > today {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Meals cannot be logged ahead of time"})
+		return
+	}
+	meal := normalizeKey(req.Meal)
+	consumedAt := time.Now()
+	if req.Date < today {
+		hour, ok := mealHours[meal]
+		if !ok {
+			hour = 12
+		}
+		consumedAt = time.Date(day.Year(), day.Month(), day.Day(), hour, 0, 0, 0, loc)
+	}
+
+	var meals []PlannedMeal
+	if err := db.Where("user_id = ? AND date = ? AND meal = ? AND diet_entry_id IS NULL", userID, req.Date, meal).
+		Order("id").Find(&meals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(meals) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Nothing left to log for this meal"})
+		return
+	}
+	units := userUnits(userID)
+	entries := make([]DietEntry, len(meals))
+	for i, p := range meals {
+		entries[i] = p.dietEntry()
+		entries[i].ConsumedAt = consumedAt
+		if err := resolveDietFood(&entries[i], nil, units); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&entries).Error; err != nil {
+			return err
+		}
+		// Only claim meals nobody has logged since they were read, so two
+		// requests racing for the same meal cannot both create entries.
+		for i, p := range meals {
+			res := tx.Model(&PlannedMeal{}).Where("id = ? AND diet_entry_id IS NULL", p.ID).
+				Update("diet_entry_id", entries[i].ID)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected != 1 {
+				return errMealAlreadyLogged
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errMealAlreadyLogged) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This meal was already logged"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	updateStreak(userID, "diet")
+
+	for i := range entries {
+		displayDietEntry(&entries[i], units)
+	}
+	c.JSON(http.StatusCreated, entries)
+}
+
+// unlinkPlannedMeals reopens planned meals logged as a deleted diet entry.
+func unlinkPlannedMeals(entryID int) {
+	db.Model(&PlannedMeal{}).Where("diet_entry_id = ?", entryID).Update("diet_entry_id", nil)
+}
+
+// getShoppingList adds up what the meals planned between start and end and
+// not yet logged need, recipes broken down into their ingredients, and
+// groups the foods by category.
+func getShoppingList(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	loc := userLocation(userID)
+	start, end, ok := mealPlanRange(c, loc)
+	if !ok {
+		return
+	}
+	var meals []PlannedMeal
+	if err := db.Where("user_id = ? AND date >= ? AND date <= ? AND diet_entry_id IS NULL", userID, start, end).
+		Find(&meals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	foods, recipes, err := mealPlanContents(meals)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	grams := map[int]float64{}
+	for _, p := range meals {
+		if p.FoodID != nil {
+			grams[*p.FoodID] += p.Amount
+			continue
+		}
+		r, ok := recipes[*p.RecipeID]
+		if !ok {
+			continue
+		}
+		for _, in := range r.Ingredients {
+			grams[in.FoodID] += in.Amount * p.Servings / float64(r.Servings)
+		}
+	}
+
+	units := userUnits(userID)
+	byCategory := map[string][]gin.H{}
+	for id, g := range grams {
+		food, ok := foods[id]
+		if !ok {
+			continue
+		}
+		category := strings.TrimSpace(food.Category)
+		if category == "" {
+			category = "Other"
+		}
+		amount, unit := portionUnits.display(g, units)
+		item := gin.H{
+			"food_id":     food.ID,
+			"name":        food.Name,
+			"brand":       food.Brand,
+			"amount":      amount,
+			"amount_unit": unit,
+			"servings":    nil,
+		}
+		if food.ServingSize > 0 {
+			item["servings"] = roundTo(g/food.ServingSize, 1)
+		}
+		byCategory[category] = append(byCategory[category], item)
+	}
+	categories := make([]string, 0, len(byCategory))
+	for category := range byCategory {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	views := make([]gin.H, 0, len(categories))
+	for _, category := range categories {
+		items := byCategory[category]
+		sort.Slice(items, func(i, j int) bool {
+			return strings.ToLower(items[i]["name"].(string)) < strings.ToLower(items[j]["name"].(string))
+		})
+		views = append(views, gin.H{"category": category, "items": items})
+	}
+	c.JSON(http.StatusOK, gin.H{"start": start, "end": end, "categories": views})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Value shapes a health metric can take.
+const (
+	ShapeInteger = "integer"
+	ShapeDecimal = "decimal"
+	ShapePair    = "pair" // e.g. systolic/diastolic, written "120/80"
+)
+
+// How several readings on the same day combine into one value.
+const (
+	AggregateSum     = "sum"
+	AggregateLast    = "last"
+	AggregateAverage = "average"
+)
+
+// MetricDef describes one HealthRecord type. For pairs, Min/Max bound the
+// first value and Min2/Max2 the second.
+type MetricDef struct {
+	Type      string  `json:"type"`
+	Label     string  `json:"label"`
+	Unit      string  `json:"unit"`
+	Shape     string  `json:"shape"`
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+	Min2      float64 `json:"min2,omitempty"`
+	Max2      float64 `json:"max2,omitempty"`
+	Aggregate string  `json:"aggregate"`
+
+	convert *quantity // set when the value can be entered in other units
+}
+
+var metricRegistry = map[string]MetricDef{
+	"steps":              {Label: "Steps", Unit: "steps", Shape: ShapeInteger, Min: 0, Max: 200000, Aggregate: AggregateSum},
+	"weight":             {Label: "Weight", Unit: "kg", Shape: ShapeDecimal, Min: 20, Max: 400, Aggregate: AggregateLast, convert: &massUnits},
+	"body_fat":           {Label: "Body fat", Unit: "%", Shape: ShapeDecimal, Min: 2, Max: 75, Aggregate: AggregateLast},
+	"heart_rate":         {Label: "Heart rate", Unit: "bpm", Shape: ShapeInteger, Min: 20, Max: 250, Aggregate: AggregateAverage},
+	"resting_heart_rate": {Label: "Resting heart rate", Unit: "bpm", Shape: ShapeInteger, Min: 20, Max: 200, Aggregate: AggregateAverage},
+	"blood_pressure":     {Label: "Blood pressure", Unit: "mmHg", Shape: ShapePair, Min: 50, Max: 260, Min2: 30, Max2: 180, Aggregate: AggregateAverage},
+	"blood_glucose":      {Label: "Blood glucose", Unit: "mmol/L", Shape: ShapeDecimal, Min: 1, Max: 40, Aggregate: AggregateAverage},
+	"oxygen_saturation":  {Label: "Oxygen saturation", Unit: "%", Shape: ShapeInteger, Min: 50, Max: 100, Aggregate: AggregateAverage},
+	"sleep":              {Label: "Sleep", Unit: "h", Shape: ShapeDecimal, Min: 0, Max: 24, Aggregate: AggregateSum},
+}
+
+func init() {
+	for name, def := range metricRegistry {
+		def.Type = name
+		metricRegistry[name] = def
+	}
+}
+
+func lookupMetric(name string) (MetricDef, bool) {
+	def, ok := metricRegistry[normalizeKey(name)]
+	return def, ok
+}
+
+func checkMetricRange(def MetricDef, v, min, max float64) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) || v < min || v > max {
+		return fmt.Errorf("%s must be between %g and %g %s", def.Label, min, max, def.Unit)
+	}
+	if def.Shape != ShapeDecimal && v != math.Trunc(v) {
+		return fmt.Errorf("%s must be a whole number", def.Label)
+	}
+	return nil
+}
+
+// parseMetricValue validates raw against the metric and returns the numeric
+// value(s) along with the canonical string form.
+func parseMetricValue(def MetricDef, raw string) (float64, *float64, string, error) {
+	raw = strings.TrimSpace(raw)
+	if def.Shape == ShapePair {
+		a, b, ok := strings.Cut(raw, "/")
+		if !ok {
+			return 0, nil, "", fmt.Errorf("%s must be written as two numbers, e.g. 120/80", def.Label)
+		}
+		first, err1 := strconv.ParseFloat(strings.TrimSpace(a), 64)
+		second, err2 := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err1 != nil || err2 != nil {
+			return 0, nil, "", fmt.Errorf("%s must be written as two numbers, e.g. 120/80", def.Label)
+		}
+		if err := checkMetricRange(def, first, def.Min, def.Max); err != nil {
+			return 0, nil, "", err
+		}
+		if err := checkMetricRange(def, second, def.Min2, def.Max2); err != nil {
+			return 0, nil, "", err
+		}
+		return first, &second, formatMetricNumber(first) + "/" + formatMetricNumber(second), nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, nil, "", fmt.Errorf("%s must be a number", def.Label)
+	}
+	if err := checkMetricRange(def, v, def.Min, def.Max); err != nil {
+		return 0, nil, "", err
+	}
+	return v, nil, formatMetricNumber(v), nil
+}
+
+func formatMetricNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// prepareHealthRecord checks a record against the registry and fills in its
+// typed columns. Values in another unit (Unit, or the user's preferred units
+// when empty) are converted first. Dates default to today in loc.
+func prepareHealthRecord(rec *HealthRecord, loc *time.Location, units string) error {
+	def, ok := lookupMetric(rec.Type)
+	if !ok {
+		return fmt.Errorf("unknown health metric %q", rec.Type)
+	}
+	if def.convert != nil {
+		v, err := strconv.ParseFloat(strings.TrimSpace(rec.Value), 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number", def.Label)
+		}
+		if v, err = def.convert.toCanonical(v, rec.Unit, units); err != nil {
+			return err
+		}
+		rec.Value = formatMetricNumber(v)
+	} else if rec.Unit != "" && rec.Unit != def.Unit {
+		return fmt.Errorf("%s is recorded in %s", def.Label, def.Unit)
+	}
+	value, second, canonical, err := parseMetricValue(def, rec.Value)
+	if err != nil {
+		return err
+	}
+	if rec.Date == "" {
+		rec.Date = localDate(time.Now(), loc)
+	} else if _, err := time.Parse(dateLayout, rec.Date); err != nil {
+		return fmt.Errorf("date must be YYYY-MM-DD")
+	}
+	rec.Type = def.Type
+	rec.Value = canonical
+	rec.NumericValue = &value
+	rec.SecondaryValue = second
+	rec.Unit = def.Unit
+	return nil
+}
+
+// aggregateMetric combines one day's readings (ordered oldest first) by the
+// metric's rule. The second value is only set for pairs.
+func aggregateMetric(def MetricDef, recs []HealthRecord) (float64, *float64, bool) {
+	var sum, sum2 float64
+	n, n2 := 0, 0
+	var last *HealthRecord
+	for i := range recs {
+		r := &recs[i]
+		if r.NumericValue == nil {
+			continue
+		}
+		last = r
+		sum += *r.NumericValue
+		n++
+		if r.SecondaryValue != nil {
+			sum2 += *r.SecondaryValue
+			n2++
+		}
+	}
+	if n == 0 {
+		return 0, nil, false
+	}
+	switch def.Aggregate {
+	case AggregateLast:
+		return *last.NumericValue, last.SecondaryValue, true
+	case AggregateAverage:
+		var second *float64
+		if n2 > 0 {
+			avg2 := sum2 / float64(n2)
+			second = &avg2
+		}
+		return sum / float64(n), second, true
+	default:
+		var second *float64
+		if n2 > 0 {
+			second = &sum2
+		}
+		return sum, second, true
+	}
+}
+
+// dailyMetricValue is the aggregated value of one metric for one local date.
+func dailyMetricValue(userID int, metric, date string) (float64, bool) {
+	def, ok := lookupMetric(metric)
+	if !ok {
+		return 0, false
+	}
+	var recs []HealthRecord
+	db.Where("user_id = ? AND type = ? AND date = ?", userID, def.Type, date).Order("id").Find(&recs)
+	v, _, ok := aggregateMetric(def, recs)
+	return v, ok
+}
+
+func getMetrics(c *gin.Context) {
+	defs := make([]MetricDef, 0, len(metricRegistry))
+	for _, def := range metricRegistry {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Type < defs[j].Type })
+	c.JSON(http.StatusOK, defs)
+}
+
+// getMetricDaily returns one aggregated value per day for a metric between
+// the start and end dates (inclusive, default last 30 days).
+func getMetricDaily(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	def, ok := lookupMetric(c.Param("type"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown metric"})
+		return
+	}
+	loc := userLocation(userID)
+	end := c.DefaultQuery("end", localDate(time.Now(), loc))
+	start := c.DefaultQuery("start", localDate(time.Now().AddDate(0, 0, -29), loc))
+	if _, err := time.Parse(dateLayout, start); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date"})
+		return
+	}
+	if _, err := time.Parse(dateLayout, end); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date"})
+		return
+	}
+	var recs []HealthRecord
+	if err := db.Where("user_id = ? AND type = ? AND date >= ? AND date <= ?", userID, def.Type, start, end).
+		Order("date, id").Find(&recs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	byDate := map[string][]HealthRecord{}
+	dates := []string{}
+	for _, r := range recs {
+		if _, seen := byDate[r.Date]; !seen {
+			dates = append(dates, r.Date)
+		}
+		byDate[r.Date] = append(byDate[r.Date], r)
+	}
+	units := userUnits(userID)
+	unit := def.Unit
+	days := []gin.H{}
+	for _, d := range dates {
+		value, second, ok := aggregateMetric(def, byDate[d])
+		if !ok {
+			continue
+		}
+		if def.convert != nil {
+			value, unit = def.convert.display(value, units)
+		}
+		day := gin.H{"date": d, "value": value, "count": len(byDate[d])}
+		if second != nil {
+			day["value2"] = *second
+		}
+		days = append(days, day)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"type":      def.Type,
+		"unit":      unit,
+		"aggregate": def.Aggregate,
+		"start":     start,
+		"end":       end,
+		"days":      days,
+	})
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Key for pg_advisory_lock; every instance uses the same one so only one of
+// them migrates at a time.
+const migrationLockKey = 48151623
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// goMigrations holds steps written in Go, for data changes that are awkward
+// to express in SQL. They share version numbers with the SQL files.
+var goMigrations = []migration{
+	{Version: 11, Name: "backfill_personal_records", Up: backfillPersonalRecords, Down: sqlStep("DELETE FROM personal_records")},
+}
+
+// SchemaMigration records one applied migration.
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func sqlStep(body string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		return tx.Exec(body).Error
+	}
+}
+
+// loadMigrations merges the embedded SQL files with goMigrations, ordered by
+// version.
+func loadMigrations() ([]migration, error) {
+	byVersion := map[int]*migration{}
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		m := migrationFileName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := migrationFiles.ReadFile("migrations/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = sqlStep(string(body))
+		} else {
+			mig.Down = sqlStep(string(body))
+		}
+	}
+	for i := range goMigrations {
+		g := goMigrations[i]
+		if _, ok := byVersion[g.Version]; ok {
+			return nil, fmt.Errorf("migration %d defined twice", g.Version)
+		}
+		byVersion[g.Version] = &g
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == nil {
+			return nil, fmt.Errorf("migration %d_%s has no up step", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func ensureMigrationTable(conn *gorm.DB) error {
+	return conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL
+	)`).Error
+}
+
+func appliedMigrations(conn *gorm.DB) (map[int]SchemaMigration, error) {
+	var rows []SchemaMigration
+	if err := conn.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := map[int]SchemaMigration{}
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// withMigrationLock runs fn on a single connection holding the advisory
+// lock, so concurrent starts or deploys wait for each other.
+func withMigrationLock(fn func(conn *gorm.DB) error) error {
+	return db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", migrationLockKey).Error; err != nil {
+			return err
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?)", migrationLockKey)
+		if err := ensureMigrationTable(conn); err != nil {
+			return err
+		}
+		return fn(conn)
+	})
+}
+
+// migrateUp applies pending migrations in order, at most limit of them when
+// limit > 0. Each one runs in its own transaction with its bookkeeping row.
+func migrateUp(limit int) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []migration
+	err = withMigrationLock(func(conn *gorm.DB) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if limit > 0 && len(done) >= limit {
+				break
+			}
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if err := m.Up(tx); err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// migrateDown reverts the last steps applied migrations, newest first.
+func migrateDown(steps int) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []migration
+	err = withMigrationLock(func(conn *gorm.DB) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == nil {
+				return fmt.Errorf("migration %04d_%s cannot be reverted", m.Version, m.Name)
+			}
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if err := m.Down(tx); err != nil {
+					return err
+				}
+				return tx.Where("version = ?", m.Version).Delete(&SchemaMigration{}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// requireCurrentSchema is checked at server start: the binary refuses to
+// run against a database that is missing any of its migrations.
+func requireCurrentSchema() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationTable(db); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	known := map[int]bool{}
+	for _, m := range migrations {
+		known[m.Version] = true
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+		}
+	}
+	for v, r := range applied {
+		if !known[v] {
+			log.Printf("database has migration %04d_%s that this build does not know about", v, r.Name)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is out of date, pending migrations: %s (run `%s migrate up`)",
+			strings.Join(pending, ", "), filepath.Base(os.Args[0]))
+	}
+	return nil
+}
+
+func migrationStatus() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	var applied map[int]SchemaMigration
+	if err := withMigrationLock(func(conn *gorm.DB) error {
+		applied, err = appliedMigrations(conn)
+		return err
+	}); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		status := "pending"
+		if r, ok := applied[m.Version]; ok {
+			status = r.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", m.Version, m.Name, status)
+	}
+	return w.Flush()
+}
+
+// createMigration writes an empty up/down pair into MIGRATIONS_DIR (default
+// ./migrations) with the next free version number.
+func createMigration(name string) error {
+	name = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), " ", "_"))
+	if !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(name) {
+		return errors.New("migration name may only contain letters, digits and underscores")
+	}
+	dir := os.Getenv("MIGRATIONS_DIR")
+	if dir == "" {
+		dir = "migrations"
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	next := 1
+	for _, e := range entries {
+		if m := migrationFileName.FindStringSubmatch(e.Name()); m != nil {
+			if v, _ := strconv.Atoi(m[1]); v >= next {
+				next = v + 1
+			}
+		}
+	}
+	for _, g := range goMigrations {
+		if g.Version >= next {
+			next = g.Version + 1
+		}
+	}
+	for _, direction := range []string{"up", "down"} {
+		path := filepath.Join(dir, fmt.Sprintf("%04d_%s.%s.sql", next, name, direction))
+		if err := os.WriteFile(path, []byte(""), 0o644); err != nil {
+			return err
+		}
+		fmt.Println("created", path)
+	}
+	return nil
+}
+
+const migrateUsage = `usage: migrate <command>
+  up [n]         apply pending migrations (all, or the next n)
+  down [n]       revert the last n applied migrations (default 1)
+  status         list migrations and when they were applied
+  create <name>  add an empty migration to MIGRATIONS_DIR`
+
+// runMigrateCommand handles "migrate ..." on the command line and returns the
+// process exit code.
+func runMigrateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	count := func(def int) (int, error) {
+		if len(args) < 2 {
+			return def, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid count %q", args[1])
+		}
+		return n, nil
+	}
+	var err error
+	switch args[0] {
+	case "up":
+		var n int
+		if n, err = count(0); err == nil {
+			connectDB()
+			var done []migration
+			done, err = migrateUp(n)
+			for _, m := range done {
+				fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+			}
+			if err == nil && len(done) == 0 {
+				fmt.Println("schema is up to date")
+			}
+		}
+	case "down":
+		var n int
+		if n, err = count(1); err == nil {
+			connectDB()
+			var done []migration
+			done, err = migrateDown(n)
+			for _, m := range done {
+				fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+			}
+		}
+	case "status":
+		connectDB()
+		err = migrationStatus()
+	case "create":
+		if len(args) < 2 {
+			err = errors.New("create needs a name")
+		} else {
+			err = createMigration(strings.Join(args[1:], "_"))
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS streaks;
+DROP TABLE IF EXISTS badges;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS activities;
+DROP TABLE IF EXISTS friendships;
+DROP TABLE IF EXISTS friend_requests;
+DROP TABLE IF EXISTS reminders;
+DROP TABLE IF EXISTS settings;
+DROP TABLE IF EXISTS health_records;
+DROP TABLE IF EXISTS journeys;
+DROP TABLE IF EXISTS awards;
+DROP TABLE IF EXISTS periods;
+DROP TABLE IF EXISTS diet_entries;
+DROP TABLE IF EXISTS water_intakes;
+DROP TABLE IF EXISTS workouts;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,156 @@
+-- Schema as created by AutoMigrate before versioned migrations. Every
+-- statement is IF NOT EXISTS so databases set up by AutoMigrate adopt it
+-- as a no-op.
+
+CREATE TABLE IF NOT EXISTS users (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL,
+    email text NOT NULL,
+    password text NOT NULL,
+    weight decimal DEFAULT 70,
+    age bigint DEFAULT 18,
+    sex text DEFAULT 'other',
+    height decimal DEFAULT 170,
+    CONSTRAINT uni_users_email UNIQUE (email)
+);
+
+CREATE TABLE IF NOT EXISTS workouts (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    type text NOT NULL,
+    duration bigint,
+    intensity text,
+    calories bigint,
+    location text,
+    created_at timestamptz,
+    category text
+);
+CREATE INDEX IF NOT EXISTS idx_workouts_user_id ON workouts (user_id);
+
+CREATE TABLE IF NOT EXISTS water_intakes (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    amount bigint
+);
+CREATE INDEX IF NOT EXISTS idx_water_intakes_user_id ON water_intakes (user_id);
+
+CREATE TABLE IF NOT EXISTS diet_entries (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    meal text,
+    food text,
+    calories bigint
+);
+CREATE INDEX IF NOT EXISTS idx_diet_entries_user_id ON diet_entries (user_id);
+
+CREATE TABLE IF NOT EXISTS periods (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    start text,
+    "end" text
+);
+CREATE INDEX IF NOT EXISTS idx_periods_user_id ON periods (user_id);
+
+CREATE TABLE IF NOT EXISTS awards (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    title text,
+    "desc" text
+);
+CREATE INDEX IF NOT EXISTS idx_awards_user_id ON awards (user_id);
+
+CREATE TABLE IF NOT EXISTS journeys (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    content text,
+    date text
+);
+CREATE INDEX IF NOT EXISTS idx_journeys_user_id ON journeys (user_id);
+
+CREATE TABLE IF NOT EXISTS health_records (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    type text,
+    value text,
+    date text
+);
+CREATE INDEX IF NOT EXISTS idx_health_records_user_id ON health_records (user_id);
+
+CREATE TABLE IF NOT EXISTS settings (
+    user_id bigserial PRIMARY KEY,
+    notifications_enabled boolean,
+    theme text,
+    water_goal bigint DEFAULT 2000,
+    calories_goal bigint DEFAULT 2000,
+    steps_goal bigint DEFAULT 10000
+);
+
+CREATE TABLE IF NOT EXISTS reminders (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    time text,
+    message text,
+    type text
+);
+CREATE INDEX IF NOT EXISTS idx_reminders_user_id ON reminders (user_id);
+
+CREATE TABLE IF NOT EXISTS friend_requests (
+    id bigserial PRIMARY KEY,
+    from_user_id bigint NOT NULL,
+    to_user_id bigint NOT NULL,
+    status varchar(16) NOT NULL,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_friend_requests_from_user_id ON friend_requests (from_user_id);
+CREATE INDEX IF NOT EXISTS idx_friend_requests_to_user_id ON friend_requests (to_user_id);
+
+CREATE TABLE IF NOT EXISTS friendships (
+    id bigserial PRIMARY KEY,
+    user_id1 bigint NOT NULL,
+    user_id2 bigint NOT NULL,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_friendships_user_id1 ON friendships (user_id1);
+CREATE INDEX IF NOT EXISTS idx_friendships_user_id2 ON friendships (user_id2);
+
+CREATE TABLE IF NOT EXISTS activities (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    type text NOT NULL,
+    data jsonb,
+    created_at timestamptz,
+    is_public boolean DEFAULT true
+);
+CREATE INDEX IF NOT EXISTS idx_activities_user_id ON activities (user_id);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id bigserial PRIMARY KEY,
+    from_user_id bigint NOT NULL,
+    to_user_id bigint NOT NULL,
+    content text NOT NULL,
+    created_at timestamptz,
+    read boolean DEFAULT false
+);
+CREATE INDEX IF NOT EXISTS idx_messages_from_user_id ON messages (from_user_id);
+CREATE INDEX IF NOT EXISTS idx_messages_to_user_id ON messages (to_user_id);
+
+CREATE TABLE IF NOT EXISTS badges (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    code text NOT NULL,
+    title text,
+    "desc" text,
+    earned_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_badges_user_id ON badges (user_id);
+
+CREATE TABLE IF NOT EXISTS streaks (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    type text NOT NULL,
+    current bigint DEFAULT 0,
+    longest bigint DEFAULT 0,
+    last_date text NOT NULL,
+    updated_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_streaks_user_id ON streaks (user_id);
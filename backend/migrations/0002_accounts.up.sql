@@ -0,0 +1,119 @@
+-- Roles, sessions, email verification, login throttling, two-factor
+-- authentication, API keys and external identities.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role varchar(16) NOT NULL DEFAULT 'user';
+-- Accounts that exist before verification was introduced are trusted as
+-- verified so the verified-only routes keep working for them; new accounts
+-- start unverified.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified boolean NOT NULL DEFAULT true;
+ALTER TABLE users ALTER COLUMN email_verified SET DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_pending_secret text;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS time_zone varchar(64) NOT NULL DEFAULT 'UTC';
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    refresh_token_hash text NOT NULL,
+    previous_token_hash text,
+    device_name text,
+    user_agent text,
+    ip text,
+    created_at timestamptz,
+    last_used_at timestamptz,
+    expires_at timestamptz NOT NULL,
+    revoked_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_refresh_token_hash ON sessions (refresh_token_hash);
+CREATE INDEX IF NOT EXISTS idx_sessions_previous_token_hash ON sessions (previous_token_hash);
+
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id bigserial PRIMARY KEY,
+    actor_id bigint NOT NULL,
+    action text NOT NULL,
+    target_type text,
+    target_id bigint,
+    details jsonb,
+    ip text,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_actor_id ON audit_logs (actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_created_at ON audit_logs (created_at);
+
+CREATE TABLE IF NOT EXISTS account_tokens (
+    id varchar(32) PRIMARY KEY,
+    user_id bigint NOT NULL,
+    purpose varchar(32) NOT NULL,
+    expires_at timestamptz NOT NULL,
+    used_at timestamptz,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_account_tokens_user_id ON account_tokens (user_id);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key varchar(255) PRIMARY KEY,
+    failures bigint NOT NULL DEFAULT 0,
+    last_failure_at timestamptz NOT NULL,
+    blocked_until timestamptz NOT NULL,
+    locked boolean NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS login_lockouts (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    ip text,
+    failures bigint,
+    locked_until timestamptz,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_login_lockouts_user_id ON login_lockouts (user_id);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    code_hash text NOT NULL,
+    used_at timestamptz,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    name text NOT NULL,
+    prefix varchar(16) NOT NULL,
+    key_hash text NOT NULL,
+    scopes text NOT NULL,
+    created_at timestamptz,
+    expires_at timestamptz,
+    last_used_at timestamptz,
+    last_used_ip text,
+    revoked_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_prefix ON api_keys (prefix);
+
+CREATE TABLE IF NOT EXISTS external_identities (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    provider varchar(64) NOT NULL,
+    subject text NOT NULL,
+    email text,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_external_identities_user_id ON external_identities (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_identity_provider_subject ON external_identities (provider, subject);
+
+CREATE TABLE IF NOT EXISTS oidc_states (
+    state varchar(64) PRIMARY KEY,
+    provider varchar(64) NOT NULL,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    link_user_id bigint,
+    device_name text,
+    expires_at timestamptz NOT NULL,
+    created_at timestamptz
+);
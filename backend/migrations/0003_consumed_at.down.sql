@@ -0,0 +1,4 @@
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS created_at;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS consumed_at;
+ALTER TABLE water_intakes DROP COLUMN IF EXISTS created_at;
+ALTER TABLE water_intakes DROP COLUMN IF EXISTS consumed_at;
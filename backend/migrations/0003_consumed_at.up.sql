@@ -0,0 +1,12 @@
+-- Water and diet entries get the time they were consumed. Rows logged
+-- before this existed only know "now", so created_at follows consumed_at.
+
+ALTER TABLE water_intakes ADD COLUMN IF NOT EXISTS consumed_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE water_intakes ADD COLUMN IF NOT EXISTS created_at timestamptz;
+UPDATE water_intakes SET created_at = consumed_at WHERE created_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_water_intakes_consumed_at ON water_intakes (consumed_at);
+
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS consumed_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS created_at timestamptz;
+UPDATE diet_entries SET created_at = consumed_at WHERE created_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_diet_entries_consumed_at ON diet_entries (consumed_at);
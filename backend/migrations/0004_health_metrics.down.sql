@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_health_records_user_type_date;
+ALTER TABLE health_records DROP COLUMN IF EXISTS unit;
+ALTER TABLE health_records DROP COLUMN IF EXISTS secondary_value;
+ALTER TABLE health_records DROP COLUMN IF EXISTS numeric_value;
@@ -0,0 +1,38 @@
+-- Typed values for health records. Known metric names are normalised
+-- ("Heart Rate" -> heart_rate) and values that parse are copied into the
+-- numeric columns; anything else keeps only its original text.
+
+ALTER TABLE health_records ADD COLUMN IF NOT EXISTS numeric_value double precision;
+ALTER TABLE health_records ADD COLUMN IF NOT EXISTS secondary_value double precision;
+ALTER TABLE health_records ADD COLUMN IF NOT EXISTS unit text;
+
+UPDATE health_records
+SET type = lower(replace(trim(type), ' ', '_'))
+WHERE lower(replace(trim(type), ' ', '_')) IN (
+    'steps', 'weight', 'body_fat', 'heart_rate', 'resting_heart_rate',
+    'blood_pressure', 'blood_glucose', 'oxygen_saturation', 'sleep'
+);
+
+UPDATE health_records
+SET numeric_value = trim(value)::double precision
+WHERE type <> 'blood_pressure' AND trim(value) ~ '^-?[0-9]+(\.[0-9]+)?$';
+
+UPDATE health_records
+SET numeric_value = trim(split_part(value, '/', 1))::double precision,
+    secondary_value = trim(split_part(value, '/', 2))::double precision
+WHERE type = 'blood_pressure' AND value ~ '^\s*[0-9]+(\.[0-9]+)?\s*/\s*[0-9]+(\.[0-9]+)?\s*$';
+
+UPDATE health_records SET unit = CASE type
+    WHEN 'steps' THEN 'steps'
+    WHEN 'weight' THEN 'kg'
+    WHEN 'body_fat' THEN '%'
+    WHEN 'heart_rate' THEN 'bpm'
+    WHEN 'resting_heart_rate' THEN 'bpm'
+    WHEN 'blood_pressure' THEN 'mmHg'
+    WHEN 'blood_glucose' THEN 'mmol/L'
+    WHEN 'oxygen_saturation' THEN '%'
+    WHEN 'sleep' THEN 'h'
+END
+WHERE unit IS NULL AND numeric_value IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_health_records_user_type_date ON health_records (user_id, type, date);
@@ -0,0 +1,3 @@
+ALTER TABLE workouts DROP COLUMN IF EXISTS distance;
+ALTER TABLE water_intakes ALTER COLUMN amount TYPE bigint USING round(amount);
+ALTER TABLE settings DROP COLUMN IF EXISTS units;
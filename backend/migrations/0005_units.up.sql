@@ -0,0 +1,7 @@
+-- Unit preference per user; water amounts (ml) become fractional so values
+-- entered in fluid ounces survive conversion, and workouts gain a distance
+-- stored in metres.
+
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS units varchar(16) NOT NULL DEFAULT 'metric';
+ALTER TABLE water_intakes ALTER COLUMN amount TYPE double precision;
+ALTER TABLE workouts ADD COLUMN IF NOT EXISTS distance double precision NOT NULL DEFAULT 0;
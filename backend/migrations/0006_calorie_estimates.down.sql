@@ -0,0 +1,2 @@
+ALTER TABLE settings DROP COLUMN IF EXISTS recalculate_calories;
+ALTER TABLE workouts DROP COLUMN IF EXISTS calories_estimated;
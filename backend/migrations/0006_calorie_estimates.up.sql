@@ -0,0 +1,2 @@
+ALTER TABLE workouts ADD COLUMN IF NOT EXISTS calories_estimated boolean NOT NULL DEFAULT false;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS recalculate_calories boolean NOT NULL DEFAULT false;
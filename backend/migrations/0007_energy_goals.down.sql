@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS calorie_targets;
+ALTER TABLE settings DROP COLUMN IF EXISTS auto_calories_goal;
+ALTER TABLE settings DROP COLUMN IF EXISTS bmr_formula;
+ALTER TABLE settings DROP COLUMN IF EXISTS weekly_rate;
+ALTER TABLE settings DROP COLUMN IF EXISTS goal_mode;
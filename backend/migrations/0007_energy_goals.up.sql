@@ -0,0 +1,18 @@
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS goal_mode varchar(16) NOT NULL DEFAULT 'maintain';
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS weekly_rate double precision NOT NULL DEFAULT 0;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS bmr_formula varchar(32) NOT NULL DEFAULT 'mifflin';
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS auto_calories_goal boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS calorie_targets (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    calories bigint NOT NULL,
+    bmr double precision,
+    tdee double precision,
+    goal_mode varchar(16),
+    weekly_rate double precision,
+    reason varchar(32),
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_calorie_targets_user_id ON calorie_targets (user_id);
+CREATE INDEX IF NOT EXISTS idx_calorie_targets_created_at ON calorie_targets (created_at);
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS track_points;
+ALTER TABLE workouts DROP COLUMN IF EXISTS started_at;
+ALTER TABLE workouts DROP COLUMN IF EXISTS source;
+ALTER TABLE workouts DROP COLUMN IF EXISTS max_heart_rate;
+ALTER TABLE workouts DROP COLUMN IF EXISTS avg_heart_rate;
+ALTER TABLE workouts DROP COLUMN IF EXISTS elapsed_time;
+ALTER TABLE workouts DROP COLUMN IF EXISTS elevation_gain;
@@ -0,0 +1,23 @@
+-- Workouts imported from GPX, TCX and FIT recordings, with their track
+-- points kept in a table of their own.
+
+ALTER TABLE workouts ADD COLUMN IF NOT EXISTS elevation_gain double precision NOT NULL DEFAULT 0;
+ALTER TABLE workouts ADD COLUMN IF NOT EXISTS elapsed_time bigint NOT NULL DEFAULT 0;
+ALTER TABLE workouts ADD COLUMN IF NOT EXISTS avg_heart_rate bigint NOT NULL DEFAULT 0;
+ALTER TABLE workouts ADD COLUMN IF NOT EXISTS max_heart_rate bigint NOT NULL DEFAULT 0;
+ALTER TABLE workouts ADD COLUMN IF NOT EXISTS source varchar(16) NOT NULL DEFAULT 'manual';
+ALTER TABLE workouts ADD COLUMN IF NOT EXISTS started_at timestamptz;
+
+CREATE TABLE IF NOT EXISTS track_points (
+    id bigserial PRIMARY KEY,
+    workout_id bigint NOT NULL,
+    seq bigint NOT NULL,
+    time timestamptz,
+    lat double precision,
+    lon double precision,
+    elevation double precision,
+    heart_rate bigint,
+    cadence bigint,
+    distance double precision
+);
+CREATE INDEX IF NOT EXISTS idx_track_points_workout_id ON track_points (workout_id);
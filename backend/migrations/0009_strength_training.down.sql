@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS exercise_sets;
+DROP TABLE IF EXISTS workout_exercises;
+DROP TABLE IF EXISTS exercises;
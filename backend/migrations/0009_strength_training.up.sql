@@ -0,0 +1,66 @@
+-- Exercise catalog and per-workout sets for strength training. Catalog rows
+-- have no user_id; slugs are unique within the catalog and within each
+-- user's own exercises.
+
+CREATE TABLE IF NOT EXISTS exercises (
+    id bigserial PRIMARY KEY,
+    user_id bigint,
+    name text NOT NULL,
+    slug varchar(64) NOT NULL,
+    muscle_group varchar(32),
+    equipment varchar(32),
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_exercises_user_id ON exercises (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_exercises_user_slug ON exercises (COALESCE(user_id, 0), slug);
+
+CREATE TABLE IF NOT EXISTS workout_exercises (
+    id bigserial PRIMARY KEY,
+    workout_id bigint NOT NULL,
+    exercise_id bigint NOT NULL,
+    position bigint NOT NULL,
+    notes text
+);
+CREATE INDEX IF NOT EXISTS idx_workout_exercises_workout_id ON workout_exercises (workout_id);
+CREATE INDEX IF NOT EXISTS idx_workout_exercises_exercise_id ON workout_exercises (exercise_id);
+
+CREATE TABLE IF NOT EXISTS exercise_sets (
+    id bigserial PRIMARY KEY,
+    workout_exercise_id bigint NOT NULL,
+    position bigint NOT NULL,
+    reps bigint NOT NULL,
+    weight double precision NOT NULL DEFAULT 0,
+    rpe double precision,
+    rest_seconds bigint,
+    warmup boolean NOT NULL DEFAULT false
+);
+CREATE INDEX IF NOT EXISTS idx_exercise_sets_workout_exercise_id ON exercise_sets (workout_exercise_id);
+
+INSERT INTO exercises (name, slug, muscle_group, equipment, created_at) VALUES
+    ('Bench Press', 'bench_press', 'chest', 'barbell', now()),
+    ('Incline Bench Press', 'incline_bench_press', 'chest', 'barbell', now()),
+    ('Dumbbell Bench Press', 'dumbbell_bench_press', 'chest', 'dumbbell', now()),
+    ('Push-Up', 'push_up', 'chest', 'bodyweight', now()),
+    ('Dip', 'dip', 'chest', 'bodyweight', now()),
+    ('Back Squat', 'back_squat', 'legs', 'barbell', now()),
+    ('Front Squat', 'front_squat', 'legs', 'barbell', now()),
+    ('Leg Press', 'leg_press', 'legs', 'machine', now()),
+    ('Lunge', 'lunge', 'legs', 'dumbbell', now()),
+    ('Leg Curl', 'leg_curl', 'legs', 'machine', now()),
+    ('Leg Extension', 'leg_extension', 'legs', 'machine', now()),
+    ('Calf Raise', 'calf_raise', 'legs', 'machine', now()),
+    ('Hip Thrust', 'hip_thrust', 'legs', 'barbell', now()),
+    ('Deadlift', 'deadlift', 'back', 'barbell', now()),
+    ('Romanian Deadlift', 'romanian_deadlift', 'legs', 'barbell', now()),
+    ('Barbell Row', 'barbell_row', 'back', 'barbell', now()),
+    ('Pull-Up', 'pull_up', 'back', 'bodyweight', now()),
+    ('Chin-Up', 'chin_up', 'back', 'bodyweight', now()),
+    ('Lat Pulldown', 'lat_pulldown', 'back', 'cable', now()),
+    ('Seated Cable Row', 'seated_cable_row', 'back', 'cable', now()),
+    ('Overhead Press', 'overhead_press', 'shoulders', 'barbell', now()),
+    ('Lateral Raise', 'lateral_raise', 'shoulders', 'dumbbell', now()),
+    ('Face Pull', 'face_pull', 'shoulders', 'cable', now()),
+    ('Dumbbell Curl', 'dumbbell_curl', 'arms', 'dumbbell', now()),
+    ('Triceps Pushdown', 'triceps_pushdown', 'arms', 'cable', now()),
+    ('Kettlebell Swing', 'kettlebell_swing', 'full_body', 'kettlebell', now())
+ON CONFLICT DO NOTHING;
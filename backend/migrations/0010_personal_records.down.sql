@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS workout_efforts;
+DROP TABLE IF EXISTS personal_records;
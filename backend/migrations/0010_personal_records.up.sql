@@ -0,0 +1,23 @@
+-- Personal records per user, kind and scope (workout type or exercise ID),
+-- and the fastest splits found in imported recordings.
+
+CREATE TABLE IF NOT EXISTS personal_records (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    kind varchar(32) NOT NULL,
+    scope varchar(64) NOT NULL,
+    value double precision NOT NULL,
+    workout_id bigint NOT NULL,
+    achieved_at timestamptz NOT NULL,
+    updated_at timestamptz
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_personal_records_key ON personal_records (user_id, kind, scope);
+CREATE INDEX IF NOT EXISTS idx_personal_records_workout_id ON personal_records (workout_id);
+
+CREATE TABLE IF NOT EXISTS workout_efforts (
+    id bigserial PRIMARY KEY,
+    workout_id bigint NOT NULL,
+    distance bigint NOT NULL,
+    seconds bigint NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_workout_efforts_workout_id ON workout_efforts (workout_id);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS scheduled_sessions;
+DROP TABLE IF EXISTS plan_enrollments;
+DROP TABLE IF EXISTS plan_sessions;
+DROP TABLE IF EXISTS training_plans;
+DROP TABLE IF EXISTS template_exercises;
+DROP TABLE IF EXISTS workout_templates;
@@ -0,0 +1,74 @@
+-- Workout templates, multi-week plans built from them, enrollments and the
+-- sessions an enrollment puts on the user's calendar.
+
+CREATE TABLE IF NOT EXISTS workout_templates (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    name text NOT NULL,
+    type text NOT NULL,
+    category text,
+    intensity text,
+    duration bigint,
+    distance double precision,
+    notes text,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_workout_templates_user_id ON workout_templates (user_id);
+
+CREATE TABLE IF NOT EXISTS template_exercises (
+    id bigserial PRIMARY KEY,
+    template_id bigint NOT NULL,
+    exercise_id bigint NOT NULL,
+    position bigint NOT NULL,
+    sets bigint NOT NULL,
+    reps bigint NOT NULL,
+    weight double precision NOT NULL DEFAULT 0,
+    rest_seconds bigint
+);
+CREATE INDEX IF NOT EXISTS idx_template_exercises_template_id ON template_exercises (template_id);
+
+CREATE TABLE IF NOT EXISTS training_plans (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    name text NOT NULL,
+    description text,
+    weeks bigint NOT NULL,
+    is_public boolean NOT NULL DEFAULT false,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_training_plans_user_id ON training_plans (user_id);
+
+CREATE TABLE IF NOT EXISTS plan_sessions (
+    id bigserial PRIMARY KEY,
+    plan_id bigint NOT NULL,
+    template_id bigint NOT NULL,
+    week bigint NOT NULL,
+    weekday bigint NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_plan_sessions_plan_id ON plan_sessions (plan_id);
+
+CREATE TABLE IF NOT EXISTS plan_enrollments (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    plan_id bigint NOT NULL,
+    start_date varchar(10) NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'active',
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_plan_enrollments_user_id ON plan_enrollments (user_id);
+CREATE INDEX IF NOT EXISTS idx_plan_enrollments_plan_id ON plan_enrollments (plan_id);
+
+CREATE TABLE IF NOT EXISTS scheduled_sessions (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    enrollment_id bigint NOT NULL,
+    template_id bigint NOT NULL,
+    week bigint NOT NULL,
+    date varchar(10) NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'planned',
+    workout_id bigint,
+    completed_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_scheduled_sessions_user_date ON scheduled_sessions (user_id, date);
+CREATE INDEX IF NOT EXISTS idx_scheduled_sessions_enrollment_id ON scheduled_sessions (enrollment_id);
+CREATE INDEX IF NOT EXISTS idx_scheduled_sessions_workout_id ON scheduled_sessions (workout_id);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS workout_loads;
+ALTER TABLE users DROP COLUMN IF EXISTS resting_heart_rate;
+ALTER TABLE users DROP COLUMN IF EXISTS max_heart_rate;
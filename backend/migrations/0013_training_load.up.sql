@@ -0,0 +1,22 @@
+-- Optional heart rates on the profile, and the cached zone times and TRIMP
+-- of each workout together with the heart rates they were computed from.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS max_heart_rate bigint;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS resting_heart_rate bigint;
+
+CREATE TABLE IF NOT EXISTS workout_loads (
+    workout_id bigint PRIMARY KEY,
+    user_id bigint NOT NULL,
+    trimp double precision NOT NULL,
+    hr_based boolean NOT NULL,
+    zone0 bigint NOT NULL DEFAULT 0,
+    zone1 bigint NOT NULL DEFAULT 0,
+    zone2 bigint NOT NULL DEFAULT 0,
+    zone3 bigint NOT NULL DEFAULT 0,
+    zone4 bigint NOT NULL DEFAULT 0,
+    zone5 bigint NOT NULL DEFAULT 0,
+    max_hr bigint NOT NULL,
+    resting_hr bigint NOT NULL,
+    computed_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_workout_loads_user_id ON workout_loads (user_id);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_diet_entries_food_id;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS fiber;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS fat;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS carbs;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS protein;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS amount;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS food_id;
+DROP TABLE IF EXISTS foods;
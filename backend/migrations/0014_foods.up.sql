@@ -0,0 +1,35 @@
+-- Food catalog with nutrients per 100 g, plus users' own foods, and diet
+-- entries that reference a food and portion. Search uses trigram word
+-- similarity on the lower-cased name and brand.
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE TABLE IF NOT EXISTS foods (
+    id bigserial PRIMARY KEY,
+    user_id bigint,
+    name text NOT NULL,
+    brand text,
+    category text,
+    source varchar(32) NOT NULL,
+    source_id varchar(64),
+    search_name text NOT NULL,
+    calories double precision NOT NULL DEFAULT 0,
+    protein double precision NOT NULL DEFAULT 0,
+    carbs double precision NOT NULL DEFAULT 0,
+    fat double precision NOT NULL DEFAULT 0,
+    fiber double precision NOT NULL DEFAULT 0,
+    serving_size double precision,
+    serving_name text,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_foods_user_id ON foods (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_foods_source_id ON foods (source, source_id) WHERE user_id IS NULL;
+CREATE INDEX IF NOT EXISTS idx_foods_search_name ON foods USING gin (search_name gin_trgm_ops);
+
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS food_id bigint;
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS amount double precision NOT NULL DEFAULT 0;
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS protein double precision NOT NULL DEFAULT 0;
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS carbs double precision NOT NULL DEFAULT 0;
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS fat double precision NOT NULL DEFAULT 0;
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS fiber double precision NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_diet_entries_food_id ON diet_entries (food_id);
@@ -0,0 +1,5 @@
+-- Barcodes of packaged foods, stored as EAN-8 or EAN-13 (UPC-A with a
+-- leading zero).
+
+ALTER TABLE foods ADD COLUMN IF NOT EXISTS barcode varchar(13);
+CREATE INDEX IF NOT EXISTS idx_foods_barcode ON foods (barcode);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_diet_entries_recipe_id;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS servings;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS recipe_id;
+DROP TABLE IF EXISTS recipe_ingredients;
+DROP TABLE IF EXISTS recipes;
@@ -0,0 +1,29 @@
+-- Recipes made of foods, and diet entries that log servings of a recipe.
+
+CREATE TABLE IF NOT EXISTS recipes (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    name text NOT NULL,
+    description text,
+    instructions text,
+    servings bigint NOT NULL DEFAULT 1,
+    shared boolean NOT NULL DEFAULT false,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_recipes_user_id ON recipes (user_id);
+
+CREATE TABLE IF NOT EXISTS recipe_ingredients (
+    id bigserial PRIMARY KEY,
+    recipe_id bigint NOT NULL,
+    food_id bigint NOT NULL,
+    position bigint NOT NULL,
+    amount double precision NOT NULL,
+    note text
+);
+CREATE INDEX IF NOT EXISTS idx_recipe_ingredients_recipe_id ON recipe_ingredients (recipe_id);
+CREATE INDEX IF NOT EXISTS idx_recipe_ingredients_food_id ON recipe_ingredients (food_id);
+
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS recipe_id bigint;
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS servings double precision NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_diet_entries_recipe_id ON diet_entries (recipe_id);
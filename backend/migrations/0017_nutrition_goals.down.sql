@@ -0,0 +1,12 @@
+ALTER TABLE settings DROP COLUMN IF EXISTS diet_streak_mode;
+ALTER TABLE settings DROP COLUMN IF EXISTS sodium_goal;
+ALTER TABLE settings DROP COLUMN IF EXISTS sugar_goal;
+ALTER TABLE settings DROP COLUMN IF EXISTS fiber_goal;
+ALTER TABLE settings DROP COLUMN IF EXISTS fat_goal;
+ALTER TABLE settings DROP COLUMN IF EXISTS carbs_goal;
+ALTER TABLE settings DROP COLUMN IF EXISTS protein_goal;
+ALTER TABLE settings DROP COLUMN IF EXISTS macro_mode;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS sodium;
+ALTER TABLE diet_entries DROP COLUMN IF EXISTS sugar;
+ALTER TABLE foods DROP COLUMN IF EXISTS sodium;
+ALTER TABLE foods DROP COLUMN IF EXISTS sugar;
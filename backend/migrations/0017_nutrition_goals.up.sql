@@ -0,0 +1,15 @@
+-- Sugar and sodium on foods and diet entries, and per-user nutrition goals.
+
+ALTER TABLE foods ADD COLUMN IF NOT EXISTS sugar double precision NOT NULL DEFAULT 0;
+ALTER TABLE foods ADD COLUMN IF NOT EXISTS sodium double precision NOT NULL DEFAULT 0;
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS sugar double precision NOT NULL DEFAULT 0;
+ALTER TABLE diet_entries ADD COLUMN IF NOT EXISTS sodium double precision NOT NULL DEFAULT 0;
+
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS macro_mode varchar(16) NOT NULL DEFAULT 'percent';
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS protein_goal double precision NOT NULL DEFAULT 20;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS carbs_goal double precision NOT NULL DEFAULT 50;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS fat_goal double precision NOT NULL DEFAULT 30;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS fiber_goal double precision NOT NULL DEFAULT 30;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS sugar_goal double precision NOT NULL DEFAULT 50;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS sodium_goal double precision NOT NULL DEFAULT 2300;
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS diet_streak_mode varchar(16) NOT NULL DEFAULT 'calories';
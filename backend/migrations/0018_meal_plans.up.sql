@@ -0,0 +1,20 @@
+-- Meals planned ahead from foods and recipes, and the diet entries they
+-- were logged as.
+
+CREATE TABLE IF NOT EXISTS planned_meals (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    date varchar(10) NOT NULL,
+    meal varchar(32) NOT NULL,
+    food_id bigint,
+    amount double precision NOT NULL DEFAULT 0,
+    recipe_id bigint,
+    servings double precision NOT NULL DEFAULT 0,
+    note text,
+    diet_entry_id bigint,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_planned_meals_user_date ON planned_meals (user_id, date);
+CREATE INDEX IF NOT EXISTS idx_planned_meals_food_id ON planned_meals (food_id);
+CREATE INDEX IF NOT EXISTS idx_planned_meals_recipe_id ON planned_meals (recipe_id);
+CREATE INDEX IF NOT EXISTS idx_planned_meals_diet_entry_id ON planned_meals (diet_entry_id);
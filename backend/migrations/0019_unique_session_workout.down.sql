@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_scheduled_sessions_workout_id;
+CREATE INDEX IF NOT EXISTS idx_scheduled_sessions_workout_id ON scheduled_sessions (workout_id);
@@ -0,0 +1,10 @@
+-- A workout completes at most one scheduled session. Sessions that share a
+-- workout keep it on the earliest one; the others stay completed unlinked.
+
+UPDATE scheduled_sessions s SET workout_id = NULL
+WHERE workout_id IS NOT NULL AND EXISTS (
+    SELECT 1 FROM scheduled_sessions o
+    WHERE o.workout_id = s.workout_id AND o.id < s.id
+);
+DROP INDEX IF EXISTS idx_scheduled_sessions_workout_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_scheduled_sessions_workout_id ON scheduled_sessions (workout_id) WHERE workout_id IS NOT NULL;
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MacroModePercent = "percent"
+	MacroModeGrams   = "grams"
+
+	DietStreakCalories = "calories"
+	DietStreakMacros   = "macros"
+
+	// How far from a range target a day may land and still count as on track.
+	macroTolerance = 0.1
+)
+
+// kcal per gram of each energy macro.
+const (
+	kcalPerProtein = 4
+	kcalPerCarb    = 4
+	kcalPerFat     = 9
+)
+
+// How a nutrient's target is read: a range to land in, a minimum to reach
+// or a limit to stay under.
+const (
+	goalRange   = "range"
+	goalMinimum = "minimum"
+	goalLimit   = "limit"
+)
+
+var nutrientGoals = []struct {
+	Name string
+	Kind string
+	Get  func(Nutrition) float64
+}{
+	{"calories", goalRange, func(n Nutrition) float64 { return n.Calories }},
+	{"protein", goalMinimum, func(n Nutrition) float64 { return n.Protein }},
+	{"carbs", goalRange, func(n Nutrition) float64 { return n.Carbs }},
+	{"fat", goalRange, func(n Nutrition) float64 { return n.Fat }},
+	{"fiber", goalMinimum, func(n Nutrition) float64 { return n.Fiber }},
+	{"sugar", goalLimit, func(n Nutrition) float64 { return n.Sugar }},
+	{"sodium", goalLimit, func(n Nutrition) float64 { return n.Sodium }},
+}
+
+// mealShares splits the day's targets across meals; entries under other
+// meal names are counted in the day but have no target of their own.
+var mealShares = map[string]float64{"breakfast": 0.25, "lunch": 0.35, "dinner": 0.3, "snack": 0.1}
+
+var mealOrder = []string{"breakfast", "lunch", "dinner", "snack"}
+
+// macroTargets turns the goals in settings into amounts per day. In percent
+// mode protein, carbs and fat are shares of CaloriesGoal.
+func macroTargets(s Settings) Nutrition {
+	t := Nutrition{
+		Calories: float64(s.CaloriesGoal),
+		Protein:  s.ProteinGoal,
+		Carbs:    s.CarbsGoal,
+		Fat:      s.FatGoal,
+		Fiber:    s.FiberGoal,
+		Sugar:    s.SugarGoal,
+		Sodium:   s.SodiumGoal,
+	}
+	if s.MacroMode != MacroModeGrams {
+		t.Protein = t.Calories * s.ProteinGoal / 100 / kcalPerProtein
+		t.Carbs = t.Calories * s.CarbsGoal / 100 / kcalPerCarb
+		t.Fat = t.Calories * s.FatGoal / 100 / kcalPerFat
+	}
+	return t.rounded()
+}
+
+func nutrientStatus(kind string, consumed, target float64) string {
+	if target <= 0 {
+		return "no_target"
+	}
+	switch kind {
+	case goalMinimum:
+		if consumed < target {
+			return "under"
+		}
+	case goalLimit:
+		if consumed > target {
+			return "over"
+		}
+	default:
+		if consumed < target*(1-macroTolerance) {
+			return "under"
+		}
+		if consumed > target*(1+macroTolerance) {
+			return "over"
+		}
+	}
+	return "on_track"
+}
+
+// macroAdherent reports whether every nutrient with a target is on track.
+func macroAdherent(total, target Nutrition) bool {
+	for _, g := range nutrientGoals {
+		if s := nutrientStatus(g.Kind, g.Get(total), g.Get(target)); s == "under" || s == "over" {
+			return false
+		}
+	}
+	return true
+}
+
+// dietDayMet decides whether a day's entries keep the diet streak going:
+// staying under the calorie goal, or in macros mode landing on every
+// nutrient target.
+func dietDayMet(s Settings, entries []DietEntry) bool {
+	var total Nutrition
+	for _, e := range entries {
+		total.addEntry(e)
+	}
+	if s.DietStreakMode == DietStreakMacros {
+		return len(entries) > 0 && macroAdherent(total, macroTargets(s))
+	}
+	return total.Calories <= float64(s.CaloriesGoal)
+}
+
+// compareNutrition reports each nutrient against its target.
+func compareNutrition(total, target Nutrition) gin.H {
+	report := gin.H{}
+	for _, g := range nutrientGoals {
+		consumed, goal := g.Get(total), g.Get(target)
+		item := gin.H{
+			"consumed":  consumed,
+			"target":    goal,
+			"kind":      g.Kind,
+			"remaining": math.Round((goal-consumed)*10) / 10,
+			"percent":   nil,
+			"status":    nutrientStatus(g.Kind, consumed, goal),
+		}
+		if goal > 0 {
+			item["percent"] = math.Round(consumed / goal * 100)
+		}
+		report[g.Name] = item
+	}
+	return report
+}
+
+// energySplit is the share of calories that came from each energy macro.
+func energySplit(n Nutrition) gin.H {
+	kcal := n.Protein*kcalPerProtein + n.Carbs*kcalPerCarb + n.Fat*kcalPerFat
+	if kcal == 0 {
+		return gin.H{"protein": 0, "carbs": 0, "fat": 0}
+	}
+	return gin.H{
+		"protein": math.Round(n.Protein * kcalPerProtein / kcal * 100),
+		"carbs":   math.Round(n.Carbs * kcalPerCarb / kcal * 100),
+		"fat":     math.Round(n.Fat * kcalPerFat / kcal * 100),
+	}
+}
+
+func nutritionGoalsView(s Settings) gin.H {
+	return gin.H{
+		"macro_mode":       s.MacroMode,
+		"protein_goal":     s.ProteinGoal,
+		"carbs_goal":       s.CarbsGoal,
+		"fat_goal":         s.FatGoal,
+		"fiber_goal":       s.FiberGoal,
+		"sugar_goal":       s.SugarGoal,
+		"sodium_goal":      s.SodiumGoal,
+		"diet_streak_mode": s.DietStreakMode,
+		"calories_goal":    s.CaloriesGoal,
+		"targets":          macroTargets(s),
+	}
+}
+
+func getNutritionGoals(c *gin.Context) {
+	c.JSON(http.StatusOK, nutritionGoalsView(loadSettings(c.GetInt("user_id"))))
+}
+
+// updateNutritionGoals sets the macro goals. Protein, carbs and fat are
+// percentages of the calorie goal that add up to 100 in percent mode and
+// grams in grams mode; fiber and sugar are grams and sodium milligrams.
+func updateNutritionGoals(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var req struct {
+		MacroMode      string   `json:"macro_mode"`
+		ProteinGoal    *float64 `json:"protein_goal"`
+		CarbsGoal      *float64 `json:"carbs_goal"`
+		FatGoal        *float64 `json:"fat_goal"`
+		FiberGoal      *float64 `json:"fiber_goal"`
+		SugarGoal      *float64 `json:"sugar_goal"`
+		SodiumGoal     *float64 `json:"sodium_goal"`
+		DietStreakMode string   `json:"diet_streak_mode"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	settings := loadSettings(userID)
+	if req.MacroMode != "" {
+		if req.MacroMode != MacroModePercent && req.MacroMode != MacroModeGrams {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "macro_mode must be percent or grams"})
+			return
+		}
+		settings.MacroMode = req.MacroMode
+	}
+	if req.DietStreakMode != "" {
+		if req.DietStreakMode != DietStreakCalories && req.DietStreakMode != DietStreakMacros {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "diet_streak_mode must be calories or macros"})
+			return
+		}
+		settings.DietStreakMode = req.DietStreakMode
+	}
+	for _, g := range []struct {
+		value  *float64
+		target *float64
+		max    float64
+	}{
+		{req.ProteinGoal, &settings.ProteinGoal, 1000},
+		{req.CarbsGoal, &settings.CarbsGoal, 1000},
+		{req.FatGoal, &settings.FatGoal, 1000},
+		{req.FiberGoal, &settings.FiberGoal, 200},
+		{req.SugarGoal, &settings.SugarGoal, 500},
+		{req.SodiumGoal, &settings.SodiumGoal, 10000},
+	} {
+		if g.value == nil {
+			continue
+		}
+		if *g.value < 0 || *g.value > g.max {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Nutrition goals must be positive and realistic"})
+			return
+		}
+		*g.target = *g.value
+	}
+	if settings.MacroMode == MacroModePercent {
+		if sum := settings.ProteinGoal + settings.CarbsGoal + settings.FatGoal; math.Abs(sum-100) > 0.5 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "protein_goal, carbs_goal and fat_goal must add up to 100 percent"})
+			return
+		}
+	}
+	if err := db.Model(&Settings{}).Where("user_id = ?", userID).Updates(map[string]interface{}{
+		"macro_mode":       settings.MacroMode,
+		"protein_goal":     settings.ProteinGoal,
+		"carbs_goal":       settings.CarbsGoal,
+		"fat_goal":         settings.FatGoal,
+		"fiber_goal":       settings.FiberGoal,
+		"sugar_goal":       settings.SugarGoal,
+		"sodium_goal":      settings.SodiumGoal,
+		"diet_streak_mode": settings.DietStreakMode,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, nutritionGoalsView(settings))
+}
+
+// getDailyNutrition compares what was logged on date (default today) with
+// the day's targets, in total and per meal. Each meal's target is its share
+// of the day's.
+func getDailyNutrition(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	loc := userLocation(userID)
+	day := time.Now()
+	if date := c.Query("date"); date != "" {
+		var err error
+		if day, err = time.ParseInLocation(dateLayout, date, loc); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date"})
+			return
+		}
+	}
+	dayStart, dayEnd := dayBounds(day, loc, 0)
+	var entries []DietEntry
+	if err := db.Where("user_id = ? AND consumed_at >= ? AND consumed_at < ?", userID, dayStart, dayEnd).
+		Order("consumed_at").Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	settings := loadSettings(userID)
+	targets := macroTargets(settings)
+
+	var total Nutrition
+	byMeal := map[string]Nutrition{}
+	counts := map[string]int{}
+	for _, e := range entries {
+		total.addEntry(e)
+		meal := normalizeKey(e.Meal)
+		if meal == "" {
+			meal = "other"
+		}
+		n := byMeal[meal]
+		n.addEntry(e)
+		byMeal[meal] = n
+		counts[meal]++
+	}
+
+	var others []string
+	for meal := range byMeal {
+		if _, ok := mealShares[meal]; !ok {
+			others = append(others, meal)
+		}
+	}
+	sort.Strings(others)
+	meals := []gin.H{}
+	for _, meal := range append(append([]string{}, mealOrder...), others...) {
+		n := byMeal[meal].rounded()
+		view := gin.H{"meal": meal, "entries": counts[meal], "total": n, "nutrients": nil}
+		if share, ok := mealShares[meal]; ok {
+			view["nutrients"] = compareNutrition(n, targets.scaled(share).rounded())
+		}
+		meals = append(meals, view)
+	}
+
+	total = total.rounded()
+	c.JSON(http.StatusOK, gin.H{
+		"date":         dayStart.Format(dateLayout),
+		"macro_mode":   settings.MacroMode,
+		"targets":      targets,
+		"total":        total,
+		"nutrients":    compareNutrition(total, targets),
+		"energy_split": energySplit(total),
+		"on_track":     len(entries) > 0 && macroAdherent(total, targets),
+		"meals":        meals,
+	})
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+// oidcHTTPClient is used for discovery, JWKS and token requests. The tests
+// in oidc_test.go point a provider at a local stand-in issuer.
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var oidcProviders = map[string]*oidcProvider{}
+
+// OIDCProviderConfig is one entry of OIDC_PROVIDERS_FILE:
+//
+//	{
+//	  "providers": [
+//	    {
+//	      "name": "google",
+//	      "display_name": "Google",
+//	      "issuer": "https://accounts.google.com",
+//	      "client_id": "...",
+//	      "client_secret_env": "GOOGLE_CLIENT_SECRET",
+//	      "redirect_url": "https://api.example.com/auth/oidc/google/callback",
+//	      "scopes": ["openid", "email", "profile"],
+//	      "app_redirect_url": "healthysummer://auth/callback"
+//	    }
+//	  ]
+//	}
+//
+// app_redirect_url is optional; when set the callback redirects there with
+// the login result in the URL fragment instead of answering with JSON.
+type OIDCProviderConfig struct {
+	Name                    string   `json:"name"`
+	DisplayName             string   `json:"display_name"`
+	Issuer                  string   `json:"issuer"`
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret"`
+	ClientSecretEnv         string   `json:"client_secret_env"`
+	RedirectURL             string   `json:"redirect_url"`
+	Scopes                  []string `json:"scopes"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"` // client_secret_basic (default), client_secret_post, none
+	AppRedirectURL          string   `json:"app_redirect_url"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcProvider struct {
+	cfg OIDCProviderConfig
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	jwks        map[string]interface{}
+	jwksFetched time.Time
+}
+
+// ExternalIdentity links an account at an identity provider to a local user.
+type ExternalIdentity struct {
+	ID        int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID    int       `json:"user_id" gorm:"index;not null"`
+	Provider  string    `json:"provider" gorm:"uniqueIndex:idx_identity_provider_subject;type:varchar(64);not null"`
+	Subject   string    `json:"subject" gorm:"uniqueIndex:idx_identity_provider_subject;not null"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// OIDCState holds the per-attempt secrets between the redirect to the
+// provider and the callback, so any backend instance can finish the flow.
+type OIDCState struct {
+	State        string `gorm:"primaryKey;type:varchar(64)"`
+	Provider     string `gorm:"type:varchar(64);not null"`
+	Nonce        string `gorm:"not null"`
+	CodeVerifier string `gorm:"not null"`
+	LinkUserID   *int   // set when a signed-in user is linking an identity
+	DeviceName   string
+	ExpiresAt    time.Time `gorm:"not null"`
+	CreatedAt    time.Time `gorm:"autoCreateTime"`
+}
+
+type oidcIDClaims struct {
+	Email             string       `json:"email"`
+	EmailVerified     flexibleBool `json:"email_verified"`
+	Name              string       `json:"name"`
+	PreferredUsername string       `json:"preferred_username"`
+	Nonce             string       `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// flexibleBool accepts true and "true"; some providers send the string.
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	*b = flexibleBool(s == "true")
+	return nil
+}
+
+func loadOIDCProviders() error {
+	path := os.Getenv("OIDC_PROVIDERS_FILE")
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Providers []OIDCProviderConfig `json:"providers"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return fmt.Errorf("parse OIDC_PROVIDERS_FILE: %w", err)
+	}
+	for _, cfg := range file.Providers {
+		if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return fmt.Errorf("provider %q: name, issuer, client_id and redirect_url are required", cfg.Name)
+		}
+		if _, dup := oidcProviders[cfg.Name]; dup {
+			return fmt.Errorf("duplicate provider %q", cfg.Name)
+		}
+		if cfg.ClientSecretEnv != "" {
+			cfg.ClientSecret = os.Getenv(cfg.ClientSecretEnv)
+		}
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"openid", "email", "profile"}
+		}
+		if cfg.DisplayName == "" {
+			cfg.DisplayName = cfg.Name
+		}
+		cfg.Issuer = strings.TrimRight(cfg.Issuer, "/")
+		oidcProviders[cfg.Name] = &oidcProvider{cfg: cfg}
+	}
+	if len(oidcProviders) > 0 {
+		log.Printf("Loaded %d OIDC provider(s)", len(oidcProviders))
+	}
+	return nil
+}
+
+func oidcGetJSON(rawURL string, out interface{}) error {
+	resp, err := oidcHTTPClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := oidcGetJSON(p.cfg.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// verificationKey returns the provider key for kid, refetching the JWKS at
+// most once a minute when an unknown kid shows up (provider key rotation).
+func (p *oidcProvider) verificationKey(kid string) (interface{}, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.jwks[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.jwksFetched) < time.Minute && p.jwks != nil {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	var set struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := oidcGetJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.jwks = map[string]interface{}{}
+	p.jwksFetched = time.Now()
+	for _, raw := range set.Keys {
+		// Only the string members matter here; x5c and key_ops are ignored.
+		jwk := map[string]string{}
+		for k, v := range raw {
+			if str, ok := v.(string); ok {
+				jwk[k] = str
+			}
+		}
+		if use := jwk["use"]; use != "" && use != "sig" {
+			continue
+		}
+		if key, err := parseJWK(jwk); err == nil {
+			p.jwks[jwk["kid"]] = key
+		}
+	}
+	if k, ok := p.jwks[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func parseJWK(jwk map[string]string) (interface{}, error) {
+	b64 := func(field string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk[field], "="))
+	}
+	switch jwk["kty"] {
+	case "RSA":
+		n, err := b64("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64("e")
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk["crv"] {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk["crv"])
+		}
+		x, err := b64("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64("y")
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if jwk["crv"] != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk["crv"])
+		}
+		x, err := b64("x")
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk["kty"])
+}
+
+func (p *oidcProvider) verifyIDToken(raw, nonce string) (*oidcIDClaims, error) {
+	claims := &oidcIDClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.verificationKey(kid)
+	},
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "ES512", "EdDSA"}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	return claims, nil
+}
+
+func (p *oidcProvider) exchangeCode(code, verifier string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.cfg.ClientID)
+	method := p.cfg.TokenEndpointAuthMethod
+	if method == "client_secret_post" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if (method == "" || method == "client_secret_basic") && p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+func randomURLString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// authorizationURL starts a flow: it stores state, nonce and the PKCE
+// verifier and returns where to send the browser.
+func (p *oidcProvider) authorizationURL(linkUserID *int, deviceName string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+	state, err := randomURLString(24)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomURLString(24)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", err
+	}
+	record := OIDCState{
+		State:        state,
+		Provider:     p.cfg.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		LinkUserID:   linkUserID,
+		DeviceName:   deviceName,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.ClientID)
+	v.Set("redirect_uri", p.cfg.RedirectURL)
+	v.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// resolveOIDCUser finds or creates the local user for a verified ID token.
+// Existing accounts are only matched by email when both sides have verified
+// the address, otherwise someone could pre-register a victim's email.
+func resolveOIDCUser(provider string, claims *oidcIDClaims, linkUserID *int) (User, int, error) {
+	var user User
+	var identity ExternalIdentity
+	err := db.Where("provider = ? AND subject = ?", provider, claims.Subject).First(&identity).Error
+	if err == nil {
+		if linkUserID != nil && *linkUserID != identity.UserID {
+			return user, http.StatusConflict, errors.New("this identity is already linked to another account")
+		}
+		if err := db.First(&user, identity.UserID).Error; err != nil {
+			return user, http.StatusUnauthorized, errors.New("linked account no longer exists")
+		}
+		return user, 0, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return user, http.StatusInternalServerError, err
+	}
+
+	switch {
+	case linkUserID != nil:
+		if err := db.First(&user, *linkUserID).Error; err != nil {
+			return user, http.StatusUnauthorized, errors.New("user not found")
+		}
+	case claims.Email == "" || !bool(claims.EmailVerified):
+		return user, http.StatusBadRequest, errors.New("the provider did not return a verified email address")
+	default:
+		err := db.Where("LOWER(email) = LOWER(?)", claims.Email).First(&user).Error
+		if err == nil && !user.EmailVerified {
+			return user, http.StatusConflict, errors.New("an unverified account uses this email; verify it or reset its password first")
+		}
+		if err == gorm.ErrRecordNotFound {
+			user, err = createOIDCUser(claims)
+		}
+		if err != nil {
+			return user, http.StatusInternalServerError, err
+		}
+	}
+
+	identity = ExternalIdentity{UserID: user.ID, Provider: provider, Subject: claims.Subject, Email: claims.Email}
+	if err := db.Create(&identity).Error; err != nil {
+		return user, http.StatusInternalServerError, err
+	}
+	return user, 0, nil
+}
+
+func createOIDCUser(claims *oidcIDClaims) (User, error) {
+	name := claims.Name
+	if name == "" {
+		name = claims.PreferredUsername
+	}
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	// No usable password; the account can set one through /password/forgot.
+	secret, err := randomURLString(32)
+	if err != nil {
+		return User{}, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{
+		Name:          name,
+		Email:         claims.Email,
+		Password:      string(hash),
+		Weight:        70,
+		Age:           18,
+		Sex:           "man",
+		Height:        175,
+		Role:          RoleUser,
+		EmailVerified: true,
+	}
+	return user, db.Create(&user).Error
+}
+
+func getOIDCProviders(c *gin.Context) {
+	names := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []gin.H{}
+	for _, name := range names {
+		result = append(result, gin.H{"name": name, "display_name": oidcProviders[name].cfg.DisplayName})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func oidcStartLogin(c *gin.Context) {
+	p, ok := oidcProviders[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown provider"})
+		return
+	}
+	authURL, err := p.authorizationURL(nil, c.Query("device_name"))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Provider unavailable: " + err.Error()})
+		return
+	}
+	if c.Query("mode") == "json" {
+		c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+		return
+	}
+	c.Redirect(http.StatusFound, authURL)
+}
+
+func oidcStartLink(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	p, ok := oidcProviders[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown provider"})
+		return
+	}
+	authURL, err := p.authorizationURL(&userID, "")
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Provider unavailable: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+func oidcCallback(c *gin.Context) {
+	p, ok := oidcProviders[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown provider"})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		oidcRespond(c, p, http.StatusUnauthorized, gin.H{"error": "Provider returned " + e + ": " + c.Query("error_description")})
+		return
+	}
+	// Deleting with RETURNING makes each state usable exactly once.
+	var state OIDCState
+	res := db.Clauses(clause.Returning{}).
+		Where("state = ? AND provider = ? AND expires_at > ?", c.Query("state"), p.cfg.Name, time.Now()).
+		Delete(&state)
+	if res.Error != nil || res.RowsAffected != 1 {
+		oidcRespond(c, p, http.StatusBadRequest, gin.H{"error": "Invalid or expired state"})
+		return
+	}
+	idToken, err := p.exchangeCode(c.Query("code"), state.CodeVerifier)
+	if err != nil {
+		oidcRespond(c, p, http.StatusBadGateway, gin.H{"error": "Code exchange failed: " + err.Error()})
+		return
+	}
+	claims, err := p.verifyIDToken(idToken, state.Nonce)
+	if err != nil {
+		oidcRespond(c, p, http.StatusUnauthorized, gin.H{"error": "Invalid ID token: " + err.Error()})
+		return
+	}
+	user, status, err := resolveOIDCUser(p.cfg.Name, claims, state.LinkUserID)
+	if err != nil {
+		oidcRespond(c, p, status, gin.H{"error": err.Error()})
+		return
+	}
+	if state.LinkUserID != nil {
+		oidcRespond(c, p, http.StatusOK, gin.H{"message": "Identity linked", "provider": p.cfg.Name})
+		return
+	}
+	result, err := loginResult(c, user, state.DeviceName)
+	if err != nil {
+		oidcRespond(c, p, http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	oidcRespond(c, p, http.StatusOK, result)
+}
+
+// oidcRespond answers with JSON, or hands the result to the app through the
+// fragment of its redirect URL when one is configured.
+func oidcRespond(c *gin.Context, p *oidcProvider, status int, body gin.H) {
+	if p.cfg.AppRedirectURL == "" {
+		c.JSON(status, body)
+		return
+	}
+	v := url.Values{}
+	for k, val := range body {
+		v.Set(k, fmt.Sprint(val))
+	}
+	v.Set("status", strconv.Itoa(status))
+	c.Redirect(http.StatusFound, p.cfg.AppRedirectURL+"#"+v.Encode())
+}
+
+func getExternalIdentities(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var identities []ExternalIdentity
+	if err := db.Where("user_id = ?", userID).Find(&identities).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, identities)
+}
+
+func deleteExternalIdentity(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identity ID"})
+		return
+	}
+	result := db.Where("id = ? AND user_id = ?", id, userID).Delete(&ExternalIdentity{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Identity unlinked"})
+}
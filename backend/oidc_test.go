@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testOIDCProvider = "stand-in"
+	testOIDCClientID = "healthy-summer"
+	testOIDCSecret   = "stand-in-secret"
+)
+
+// testIssuer is a local stand-in OIDC provider: discovery, JWKS and a token
+// endpoint that enforces PKCE. Codes are handed out by authorize instead of
+// a login page.
+type testIssuer struct {
+	t   *testing.T
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]issuedCode
+}
+
+type issuedCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{t: t, key: key, codes: map[string]issuedCode{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 iss.srv.URL,
+			"authorization_endpoint": iss.srv.URL + "/authorize",
+			"token_endpoint":         iss.srv.URL + "/token",
+			"jwks_uri":               iss.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stand-in-1",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", iss.token)
+	iss.srv = httptest.NewServer(mux)
+	t.Cleanup(iss.srv.Close)
+
+	oidcProviders[testOIDCProvider] = &oidcProvider{cfg: OIDCProviderConfig{
+		Name:         testOIDCProvider,
+		DisplayName:  "Stand-in",
+		Issuer:       iss.srv.URL,
+		ClientID:     testOIDCClientID,
+		ClientSecret: testOIDCSecret,
+		RedirectURL:  "http://localhost/auth/oidc/" + testOIDCProvider + "/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+	}}
+	t.Cleanup(func() { delete(oidcProviders, testOIDCProvider) })
+	return iss
+}
+
+func oidcError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func (iss *testIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if id, secret, ok := r.BasicAuth(); !ok || id != testOIDCClientID || secret != testOIDCSecret {
+		oidcError(w, "invalid_client", "bad client credentials")
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		oidcError(w, "invalid_request", "authorization_code grant expected")
+		return
+	}
+	iss.mu.Lock()
+	issued, ok := iss.codes[r.PostForm.Get("code")]
+	delete(iss.codes, r.PostForm.Get("code"))
+	iss.mu.Unlock()
+	if !ok {
+		oidcError(w, "invalid_grant", "unknown or used code")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != issued.challenge {
+		oidcError(w, "invalid_grant", "PKCE verification failed")
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, issued.claims)
+	token.Header["kid"] = "stand-in-1"
+	signed, err := token.SignedString(iss.key)
+	if err != nil {
+		iss.t.Errorf("sign id token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+// issue hands out a code for an authorization request with the given PKCE
+// challenge. The ID token carries nonce unless claims override it.
+func (iss *testIssuer) issue(challenge, nonce string, claims jwt.MapClaims) string {
+	code, err := randomURLString(16)
+	if err != nil {
+		iss.t.Fatal(err)
+	}
+	all := jwt.MapClaims{
+		"iss":   iss.srv.URL,
+		"aud":   testOIDCClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	iss.mu.Lock()
+	iss.codes[code] = issuedCode{challenge: challenge, claims: all}
+	iss.mu.Unlock()
+	return code
+}
+
+// authorize plays the provider's login page for an authorization URL from
+// the backend and returns the state to call back with and the code.
+func (iss *testIssuer) authorize(authURL string, claims jwt.MapClaims) (string, string) {
+	iss.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		iss.t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("client_id") != testOIDCClientID || q.Get("code_challenge_method") != "S256" {
+		iss.t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+	if q.Get("state") == "" || q.Get("nonce") == "" || q.Get("code_challenge") == "" {
+		iss.t.Fatalf("authorization URL lacks state, nonce or PKCE challenge: %s", authURL)
+	}
+	return q.Get("state"), iss.issue(q.Get("code_challenge"), q.Get("nonce"), claims)
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestOIDCCodeExchangeChecksPKCEVerifier(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := oidcProviders[testOIDCProvider]
+
+	code := iss.issue(pkceChallenge("the-real-verifier"), "n-1", jwt.MapClaims{"sub": "alice"})
+	if _, err := p.exchangeCode(code, "a-guessed-verifier"); err == nil {
+		t.Fatal("code exchange succeeded with the wrong PKCE verifier")
+	}
+
+	code = iss.issue(pkceChallenge("the-real-verifier"), "n-1", jwt.MapClaims{"sub": "alice"})
+	idToken, err := p.exchangeCode(code, "the-real-verifier")
+	if err != nil {
+		t.Fatalf("code exchange with the right verifier: %v", err)
+	}
+	if _, err := p.exchangeCode(code, "the-real-verifier"); err == nil {
+		t.Error("a code could be exchanged twice")
+	}
+	if _, err := p.verifyIDToken(idToken, "n-1"); err != nil {
+		t.Errorf("valid ID token rejected: %v", err)
+	}
+}
+
+func TestOIDCIDTokenChecksNonce(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := oidcProviders[testOIDCProvider]
+
+	code := iss.issue(pkceChallenge("v"), "nonce-of-another-attempt", jwt.MapClaims{"sub": "alice"})
+	idToken, err := p.exchangeCode(code, "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.verifyIDToken(idToken, "nonce-of-this-attempt"); err == nil {
+		t.Error("ID token with another attempt's nonce was accepted")
+	}
+}
+
+// integrationDB connects to the Postgres database in TEST_DATABASE_URL and
+// brings its schema up to date. Tests that need it are skipped without one.
+func integrationDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("connect to test database: %v", err)
+	}
+	previous := db
+	db = conn
+	t.Cleanup(func() { db = previous })
+	if _, err := migrateUp(0); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+	if keys == nil {
+		if keys, err = loadKeys(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func oidcTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/auth/oidc/:provider/login", oidcStartLogin)
+	r.GET("/auth/oidc/:provider/callback", oidcCallback)
+	return r
+}
+
+func serve(r *gin.Engine, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func startOIDCLogin(t *testing.T, r *gin.Engine) string {
+	t.Helper()
+	w := serve(r, "/auth/oidc/"+testOIDCProvider+"/login?mode=json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("start: %d %s", w.Code, w.Body)
+	}
+	var body struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return body.AuthorizationURL
+}
+
+func oidcCallbackURL(state, code string) string {
+	return "/auth/oidc/" + testOIDCProvider + "/callback?" + url.Values{"state": {state}, "code": {code}}.Encode()
+}
+
+// testEmail is unique per run so tests can share a database.
+func testEmail(t *testing.T, name string) string {
+	email := fmt.Sprintf("%s-%d@oidc.test", name, time.Now().UnixNano())
+	t.Cleanup(func() {
+		var users []User
+		db.Where("email = ?", email).Find(&users)
+		for _, u := range users {
+			db.Where("user_id = ?", u.ID).Delete(&ExternalIdentity{})
+			db.Where("user_id = ?", u.ID).Delete(&Session{})
+			db.Delete(&u)
+		}
+	})
+	return email
+}
+
+func createTestUser(t *testing.T, email string, verified bool) User {
+	t.Helper()
+	user := User{Name: "Existing", Email: email, Password: "not-a-hash", Weight: 70, Age: 30, Sex: "other", Height: 170, Role: RoleUser}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Set separately: a false EmailVerified would be left to the column default.
+	if err := db.Model(&user).Update("email_verified", verified).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func identityOwner(t *testing.T, subject string) (int, bool) {
+	t.Helper()
+	var identity ExternalIdentity
+	err := db.Where("provider = ? AND subject = ?", testOIDCProvider, subject).First(&identity).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity.UserID, true
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	integrationDB(t)
+	iss := newTestIssuer(t)
+	r := oidcTestRouter()
+
+	t.Run("new account, state used once", func(t *testing.T) {
+		email := testEmail(t, "new")
+		state, code := iss.authorize(startOIDCLogin(t, r), jwt.MapClaims{"sub": email, "email": email, "email_verified": true})
+		w := serve(r, oidcCallbackURL(state, code))
+		if w.Code != http.StatusOK {
+			t.Fatalf("callback: %d %s", w.Code, w.Body)
+		}
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if body["token"] == nil || body["refresh_token"] == nil {
+			t.Errorf("callback gave no tokens: %s", w.Body)
+		}
+		if _, ok := identityOwner(t, email); !ok {
+			t.Error("identity was not stored")
+		}
+
+		replay := serve(r, oidcCallbackURL(state, iss.issue("", "", nil)))
+		if replay.Code != http.StatusBadRequest {
+			t.Errorf("replayed state: %d %s, want 400", replay.Code, replay.Body)
+		}
+	})
+
+	t.Run("unknown state", func(t *testing.T) {
+		w := serve(r, oidcCallbackURL("never-issued", "code"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unknown state: %d, want 400", w.Code)
+		}
+	})
+
+	t.Run("PKCE verifier is sent and checked", func(t *testing.T) {
+		email := testEmail(t, "pkce")
+		state, code := iss.authorize(startOIDCLogin(t, r), jwt.MapClaims{"sub": email, "email": email, "email_verified": true})
+		if err := db.Model(&OIDCState{}).Where("state = ?", state).Update("code_verifier", "tampered").Error; err != nil {
+			t.Fatal(err)
+		}
+		w := serve(r, oidcCallbackURL(state, code))
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("wrong verifier: %d %s, want 502", w.Code, w.Body)
+		}
+		if _, ok := identityOwner(t, email); ok {
+			t.Error("identity stored although PKCE failed")
+		}
+	})
+
+	t.Run("nonce is checked", func(t *testing.T) {
+		email := testEmail(t, "nonce")
+		state, code := iss.authorize(startOIDCLogin(t, r), jwt.MapClaims{"sub": email, "email": email, "email_verified": true, "nonce": "replayed-token"})
+		w := serve(r, oidcCallbackURL(state, code))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("wrong nonce: %d %s, want 401", w.Code, w.Body)
+		}
+		if _, ok := identityOwner(t, email); ok {
+			t.Error("identity stored although the nonce did not match")
+		}
+	})
+
+	t.Run("links when both emails are verified", func(t *testing.T) {
+		email := testEmail(t, "both")
+		user := createTestUser(t, email, true)
+		state, code := iss.authorize(startOIDCLogin(t, r), jwt.MapClaims{"sub": email, "email": email, "email_verified": "true"})
+		if w := serve(r, oidcCallbackURL(state, code)); w.Code != http.StatusOK {
+			t.Fatalf("callback: %d %s", w.Code, w.Body)
+		}
+		if owner, ok := identityOwner(t, email); !ok || owner != user.ID {
+			t.Errorf("identity linked to %d (%v), want %d", owner, ok, user.ID)
+		}
+	})
+
+	t.Run("unverified provider email does not take over an account", func(t *testing.T) {
+		email := testEmail(t, "provider-unverified")
+		createTestUser(t, email, true)
+		state, code := iss.authorize(startOIDCLogin(t, r), jwt.MapClaims{"sub": email, "email": email, "email_verified": false})
+		if w := serve(r, oidcCallbackURL(state, code)); w.Code == http.StatusOK {
+			t.Fatalf("callback succeeded: %s", w.Body)
+		}
+		if _, ok := identityOwner(t, email); ok {
+			t.Error("unverified provider email was linked to the existing account")
+		}
+	})
+
+	t.Run("unverified local account is not linked", func(t *testing.T) {
+		email := testEmail(t, "local-unverified")
+		createTestUser(t, email, false)
+		state, code := iss.authorize(startOIDCLogin(t, r), jwt.MapClaims{"sub": email, "email": email, "email_verified": true})
+		if w := serve(r, oidcCallbackURL(state, code)); w.Code != http.StatusConflict {
+			t.Fatalf("callback: %d %s, want 409", w.Code, w.Body)
+		}
+		if _, ok := identityOwner(t, email); ok {
+			t.Error("identity linked to an account whose email is not verified")
+		}
+	})
+
+	t.Run("signed-in user links explicitly", func(t *testing.T) {
+		email := testEmail(t, "explicit")
+		user := createTestUser(t, email, false)
+		authURL, err := oidcProviders[testOIDCProvider].authorizationURL(&user.ID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject := "explicit-" + email
+		state, code := iss.authorize(authURL, jwt.MapClaims{"sub": subject, "email": "someone-else@oidc.test", "email_verified": false})
+		if w := serve(r, oidcCallbackURL(state, code)); w.Code != http.StatusOK {
+			t.Fatalf("callback: %d %s", w.Code, w.Body)
+		}
+		if owner, ok := identityOwner(t, subject); !ok || owner != user.ID {
+			t.Errorf("identity linked to %d (%v), want %d", owner, ok, user.ID)
+		}
+	})
+}
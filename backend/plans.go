@@ -0,0 +1,935 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// errSessionNotPlanned means the session left the planned state while it
+// was being completed.
+var errSessionNotPlanned = errors.New("session is no longer planned")
+
+// pgUniqueViolation is the Postgres error code for a unique index conflict.
+const pgUniqueViolation = "23505"
+
+// Scheduled session states. A planned session whose date has passed counts
+// as missed.
+const (
+	SessionPlanned   = "planned"
+	SessionCompleted = "completed"
+	SessionSkipped   = "skipped"
+)
+
+const (
+	EnrollmentActive    = "active"
+	EnrollmentCancelled = "cancelled"
+
+	maxPlanWeeks = 52
+)
+
+// WorkoutTemplate is a routine that can be logged again and again.
+type WorkoutTemplate struct {
+	ID           int                `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID       int                `json:"user_id" gorm:"index;not null"`
+	Name         string             `json:"name" gorm:"not null"`
+	Type         string             `json:"type" gorm:"not null"`
+	Category     string             `json:"category"`
+	Intensity    string             `json:"intensity"`
+	Duration     int                `json:"duration"` // minutes
+	Distance     float64            `json:"distance"` // stored in metres
+	DistanceUnit string             `json:"distance_unit,omitempty" gorm:"-"`
+	Notes        string             `json:"notes"`
+	Exercises    []TemplateExercise `json:"exercises" gorm:"foreignKey:TemplateID"`
+	CreatedAt    time.Time          `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// TemplateExercise prescribes Sets × Reps at Weight (kg) for one exercise.
+type TemplateExercise struct {
+	ID          int     `json:"id" gorm:"primaryKey;autoIncrement"`
+	TemplateID  int     `json:"template_id" gorm:"index;not null"`
+	ExerciseID  int     `json:"exercise_id" gorm:"not null"`
+	Position    int     `json:"position" gorm:"not null"`
+	Sets        int     `json:"sets" gorm:"not null"`
+	Reps        int     `json:"reps" gorm:"not null"`
+	Weight      float64 `json:"weight" gorm:"not null;default:0"`
+	WeightUnit  string  `json:"weight_unit,omitempty" gorm:"-"`
+	RestSeconds int     `json:"rest_seconds"`
+}
+
+// TrainingPlan arranges templates over a number of weeks. Public plans can
+// be joined by anyone.
+type TrainingPlan struct {
+	ID          int           `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID      int           `json:"user_id" gorm:"index;not null"`
+	Name        string        `json:"name" gorm:"not null"`
+	Description string        `json:"description"`
+	Weeks       int           `json:"weeks" gorm:"not null"`
+	IsPublic    bool          `json:"is_public" gorm:"not null;default:false"`
+	Sessions    []PlanSession `json:"sessions" gorm:"foreignKey:PlanID"`
+	CreatedAt   time.Time     `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// PlanSession puts a template on a weekday (1 = Monday … 7 = Sunday) of a
+// plan week (from 1).
+type PlanSession struct {
+	ID         int `json:"id" gorm:"primaryKey;autoIncrement"`
+	PlanID     int `json:"plan_id" gorm:"index;not null"`
+	TemplateID int `json:"template_id" gorm:"not null"`
+	Week       int `json:"week" gorm:"not null"`
+	Weekday    int `json:"weekday" gorm:"not null"`
+}
+
+// PlanEnrollment is a user following a plan from StartDate, the Monday of
+// week 1 or a later day of it.
+type PlanEnrollment struct {
+	ID        int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID    int       `json:"user_id" gorm:"index;not null"`
+	PlanID    int       `json:"plan_id" gorm:"index;not null"`
+	StartDate string    `json:"start_date" gorm:"type:varchar(10);not null"`
+	Status    string    `json:"status" gorm:"type:varchar(16);not null;default:'active'"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// ScheduledSession is one plan session placed on the user's calendar.
+// WorkoutID links the workout that completed it.
+type ScheduledSession struct {
+	ID           int        `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID       int        `json:"user_id" gorm:"index:idx_scheduled_sessions_user_date;not null"`
+	EnrollmentID int        `json:"enrollment_id" gorm:"index;not null"`
+	TemplateID   int        `json:"template_id" gorm:"not null"`
+	Week         int        `json:"week" gorm:"not null"`
+	Date         string     `json:"date" gorm:"type:varchar(10);index:idx_scheduled_sessions_user_date;not null"`
+	Status       string     `json:"status" gorm:"type:varchar(16);not null;default:'planned'"`
+	WorkoutID    *int       `json:"workout_id" gorm:"uniqueIndex:idx_scheduled_sessions_workout_id,where:workout_id IS NOT NULL"`
+	CompletedAt  *time.Time `json:"completed_at"`
+}
+
+func paramID(c *gin.Context, what string) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + what + " ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+func displayTemplate(t *WorkoutTemplate, units string) {
+	t.Distance, t.DistanceUnit = distanceUnits.display(t.Distance, units)
+	for i := range t.Exercises {
+		e := &t.Exercises[i]
+		e.Weight, e.WeightUnit = massUnits.display(e.Weight, units)
+	}
+}
+
+// prepareTemplate validates a template from a request and converts its
+// values to canonical units.
+func prepareTemplate(t *WorkoutTemplate, userID int, units string) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" || t.Type == "" {
+		return errors.New("name and type are required")
+	}
+	if t.Duration < 0 || t.Duration > 24*60 {
+		return errors.New("duration must be between 0 and 1440 minutes")
+	}
+	if t.Intensity == "" {
+		t.Intensity = "medium"
+	}
+	var err error
+	if t.Distance, err = distanceUnits.toCanonical(t.Distance, t.DistanceUnit, units); err != nil {
+		return err
+	}
+	t.DistanceUnit = ""
+	ids := []int{}
+	for i := range t.Exercises {
+		e := &t.Exercises[i]
+		e.ID, e.TemplateID, e.Position = 0, t.ID, i+1
+		if e.Sets < 1 || e.Sets > 20 || e.Reps < 0 || e.Reps > 1000 {
+			return fmt.Errorf("exercise %d: sets must be 1-20 and reps 0-1000", i+1)
+		}
+		if e.Weight, err = massUnits.toCanonical(e.Weight, e.WeightUnit, units); err != nil {
+			return err
+		}
+		e.WeightUnit = ""
+		ids = append(ids, e.ExerciseID)
+	}
+	if len(ids) > 0 {
+		var known int64
+		visibleExercises(db.Model(&Exercise{}), userID).Where("id IN ?", ids).Distinct("id").Count(&known)
+		if int(known) != len(uniqueInts(ids)) {
+			return errors.New("unknown exercise")
+		}
+	}
+	return nil
+}
+
+func uniqueInts(values []int) []int {
+	seen := map[int]bool{}
+	out := []int{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// templateVisible reports whether the user may use a template: their own,
+// or one that is part of a public plan.
+func templateVisible(userID int, t WorkoutTemplate) bool {
+	if t.UserID == userID {
+		return true
+	}
+	var count int64
+	db.Model(&PlanSession{}).
+		Joins("JOIN training_plans ON training_plans.id = plan_sessions.plan_id").
+		Where("plan_sessions.template_id = ? AND training_plans.is_public = ?", t.ID, true).
+		Count(&count)
+	return count > 0
+}
+
+func loadTemplate(id int) (WorkoutTemplate, error) {
+	var t WorkoutTemplate
+	err := db.Preload("Exercises", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).First(&t, id).Error
+	return t, err
+}
+
+func getTemplates(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var templates []WorkoutTemplate
+	if err := db.Where("user_id = ?", userID).
+		Preload("Exercises", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).
+		Order("name").Find(&templates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	units := userUnits(userID)
+	for i := range templates {
+		displayTemplate(&templates[i], units)
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+func getTemplate(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "template")
+	if !ok {
+		return
+	}
+	t, err := loadTemplate(id)
+	if err != nil || !templateVisible(userID, t) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+	displayTemplate(&t, userUnits(userID))
+	c.JSON(http.StatusOK, t)
+}
+
+func createTemplate(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var t WorkoutTemplate
+	if err := c.ShouldBindJSON(&t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t.ID, t.UserID = 0, userID
+	units := userUnits(userID)
+	if err := prepareTemplate(&t, userID, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Create(&t).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	displayTemplate(&t, units)
+	c.JSON(http.StatusCreated, t)
+}
+
+// updateTemplate replaces a template, exercises included. Sessions already
+// on calendars pick up the change.
+func updateTemplate(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "template")
+	if !ok {
+		return
+	}
+	stored, err := loadTemplate(id)
+	if err != nil || stored.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+	var t WorkoutTemplate
+	if err := c.ShouldBindJSON(&t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t.ID, t.UserID, t.CreatedAt = stored.ID, userID, stored.CreatedAt
+	units := userUnits(userID)
+	if err := prepareTemplate(&t, userID, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Exercises").Save(&t).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("template_id = ?", t.ID).Delete(&TemplateExercise{}).Error; err != nil {
+			return err
+		}
+		if len(t.Exercises) == 0 {
+			return nil
+		}
+		return tx.Create(&t.Exercises).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	displayTemplate(&t, units)
+	c.JSON(http.StatusOK, t)
+}
+
+func deleteTemplate(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "template")
+	if !ok {
+		return
+	}
+	var t WorkoutTemplate
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&t).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+	var inPlans, scheduled int64
+	db.Model(&PlanSession{}).Where("template_id = ?", id).Count(&inPlans)
+	db.Model(&ScheduledSession{}).Where("template_id = ? AND status = ?", id, SessionPlanned).Count(&scheduled)
+	if inPlans > 0 || scheduled > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Template is used by a plan"})
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&t).Error; err != nil {
+			return err
+		}
+		return tx.Where("template_id = ?", id).Delete(&TemplateExercise{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Template deleted"})
+}
+
+// workoutFromTemplate logs a workout as the template describes it, with its
+// exercises as sets, and runs the usual post-save work.
+func workoutFromTemplate(userID int, t WorkoutTemplate) (Workout, error) {
+	var w Workout
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		w, err = createTemplateWorkout(tx, userID, t)
+		return err
+	})
+	if err != nil {
+		return w, err
+	}
+	templateWorkoutLogged(userID, w)
+	return w, nil
+}
+
+// createTemplateWorkout saves a workout and its exercises from the template
+// in tx. The caller runs templateWorkoutLogged once tx has committed.
+func createTemplateWorkout(tx *gorm.DB, userID int, t WorkoutTemplate) (Workout, error) {
+	w := Workout{
+		UserID:    userID,
+		Type:      t.Type,
+		Category:  t.Category,
+		Intensity: t.Intensity,
+		Duration:  t.Duration,
+		Distance:  t.Distance,
+		Location:  "unspecified",
+		Source:    "manual",
+	}
+	var user User
+	if err := tx.First(&user, userID).Error; err == nil {
+		applyCalorieEstimate(&w, nil, user)
+	}
+	if err := tx.Create(&w).Error; err != nil {
+		return w, err
+	}
+	entries := make([]WorkoutExercise, 0, len(t.Exercises))
+	for _, e := range t.Exercises {
+		entry := WorkoutExercise{WorkoutID: w.ID, ExerciseID: e.ExerciseID, Position: e.Position}
+		for i := 0; i < e.Sets; i++ {
+			entry.Sets = append(entry.Sets, ExerciseSet{Position: i + 1, Reps: e.Reps, Weight: e.Weight, RestSeconds: e.RestSeconds})
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return w, nil
+	}
+	return w, tx.Create(&entries).Error
+}
+
+// templateWorkoutLogged awards badges, records and the calorie goal update
+// for a committed template workout.
+func templateWorkoutLogged(userID int, w Workout) {
+	checkAndAwardBadges(userID)
+	updatePersonalRecords(userID, w.ID)
+	refreshCalorieGoal(userID, "workout")
+}
+
+func logTemplateWorkout(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "template")
+	if !ok {
+		return
+	}
+	t, err := loadTemplate(id)
+	if err != nil || !templateVisible(userID, t) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return
+	}
+	w, err := workoutFromTemplate(userID, t)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	linkScheduledSession(w)
+	displayWorkout(&w, userUnits(userID))
+	c.JSON(http.StatusCreated, w)
+}
+
+func loadPlan(id int) (TrainingPlan, error) {
+	var p TrainingPlan
+	err := db.Preload("Sessions", func(tx *gorm.DB) *gorm.DB { return tx.Order("week, weekday") }).First(&p, id).Error
+	return p, err
+}
+
+// preparePlan checks a plan from a request; its templates must belong to
+// the author.
+func preparePlan(p *TrainingPlan, userID int) error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	if p.Weeks < 1 || p.Weeks > maxPlanWeeks {
+		return fmt.Errorf("weeks must be between 1 and %d", maxPlanWeeks)
+	}
+	ids := []int{}
+	for i := range p.Sessions {
+		s := &p.Sessions[i]
+		s.ID, s.PlanID = 0, p.ID
+		if s.Week < 1 || s.Week > p.Weeks {
+			return fmt.Errorf("session %d: week must be between 1 and %d", i+1, p.Weeks)
+		}
+		if s.Weekday < 1 || s.Weekday > 7 {
+			return fmt.Errorf("session %d: weekday must be 1 (Monday) to 7 (Sunday)", i+1)
+		}
+		ids = append(ids, s.TemplateID)
+	}
+	if len(ids) > 0 {
+		ids = uniqueInts(ids)
+		var owned int64
+		db.Model(&WorkoutTemplate{}).Where("id IN ? AND user_id = ?", ids, userID).Count(&owned)
+		if int(owned) != len(ids) {
+			return errors.New("plans can only use your own templates")
+		}
+	}
+	return nil
+}
+
+func getPlans(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	query := db.Where("user_id = ?", userID)
+	if c.Query("public") == "true" {
+		query = db.Where("is_public = ?", true)
+	}
+	var plans []TrainingPlan
+	if err := query.Preload("Sessions", func(tx *gorm.DB) *gorm.DB { return tx.Order("week, weekday") }).
+		Order("created_at desc").Find(&plans).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, plans)
+}
+
+func getPlan(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "plan")
+	if !ok {
+		return
+	}
+	p, err := loadPlan(id)
+	if err != nil || (p.UserID != userID && !p.IsPublic) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func createPlan(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var p TrainingPlan
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.ID, p.UserID = 0, userID
+	if err := preparePlan(&p, userID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Create(&p).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, p)
+}
+
+// updatePlan replaces a plan and its sessions. Calendars of people already
+// enrolled keep the sessions they were given.
+func updatePlan(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "plan")
+	if !ok {
+		return
+	}
+	stored, err := loadPlan(id)
+	if err != nil || stored.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	var p TrainingPlan
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.ID, p.UserID, p.CreatedAt = stored.ID, userID, stored.CreatedAt
+	if err := preparePlan(&p, userID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Sessions").Save(&p).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("plan_id = ?", p.ID).Delete(&PlanSession{}).Error; err != nil {
+			return err
+		}
+		if len(p.Sessions) == 0 {
+			return nil
+		}
+		return tx.Create(&p.Sessions).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func deletePlan(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "plan")
+	if !ok {
+		return
+	}
+	var p TrainingPlan
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&p).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	var enrolled int64
+	db.Model(&PlanEnrollment{}).Where("plan_id = ? AND status = ? AND user_id <> ?", id, EnrollmentActive, userID).Count(&enrolled)
+	if enrolled > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Other users are following this plan"})
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&p).Error; err != nil {
+			return err
+		}
+		return tx.Where("plan_id = ?", id).Delete(&PlanSession{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Plan deleted"})
+}
+
+// enrollInPlan puts every session of the plan on the user's calendar.
+// Week 1 is the Monday-to-Sunday week holding start_date (default today);
+// sessions before start_date are left out.
+func enrollInPlan(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "plan")
+	if !ok {
+		return
+	}
+	p, err := loadPlan(id)
+	if err != nil || (p.UserID != userID && !p.IsPublic) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	var req struct {
+		StartDate string `json:"start_date"`
+	}
+	c.ShouldBindJSON(&req)
+	loc := userLocation(userID)
+	if req.StartDate == "" {
+		req.StartDate = localDate(time.Now(), loc)
+	}
+	start, err := time.Parse(dateLayout, req.StartDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start_date must be YYYY-MM-DD"})
+		return
+	}
+	var active int64
+	db.Model(&PlanEnrollment{}).Where("user_id = ? AND plan_id = ? AND status = ?", userID, p.ID, EnrollmentActive).Count(&active)
+	if active > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Already enrolled in this plan"})
+		return
+	}
+
+	// Days since Monday, with Sunday as the 7th day.
+	offset := (int(start.Weekday()) + 6) % 7
+	monday := start.AddDate(0, 0, -offset)
+	enrollment := PlanEnrollment{UserID: userID, PlanID: p.ID, StartDate: req.StartDate, Status: EnrollmentActive}
+	var sessions []ScheduledSession
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&enrollment).Error; err != nil {
+			return err
+		}
+		for _, s := range p.Sessions {
+			day := monday.AddDate(0, 0, (s.Week-1)*7+s.Weekday-1)
+			if day.Before(start) {
+				continue
+			}
+			sessions = append(sessions, ScheduledSession{
+				UserID: userID, EnrollmentID: enrollment.ID, TemplateID: s.TemplateID,
+				Week: s.Week, Date: day.Format(dateLayout), Status: SessionPlanned,
+			})
+		}
+		if len(sessions) == 0 {
+			return nil
+		}
+		return tx.Create(&sessions).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"enrollment": enrollment, "sessions": sessions})
+}
+
+func getEnrollments(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var enrollments []PlanEnrollment
+	if err := db.Where("user_id = ?", userID).Order("created_at desc").Find(&enrollments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, enrollments)
+}
+
+// cancelEnrollment stops following a plan. Sessions still ahead are taken
+// off the calendar; past ones stay for the statistics.
+func cancelEnrollment(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "enrollment")
+	if !ok {
+		return
+	}
+	var enrollment PlanEnrollment
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&enrollment).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Enrollment not found"})
+		return
+	}
+	today := localDate(time.Now(), userLocation(userID))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&enrollment).Update("status", EnrollmentCancelled).Error; err != nil {
+			return err
+		}
+		return tx.Where("enrollment_id = ? AND status = ? AND date >= ?", enrollment.ID, SessionPlanned, today).
+			Delete(&ScheduledSession{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Enrollment cancelled"})
+}
+
+// getSchedule lists scheduled sessions between start and end (inclusive,
+// default this week and the next three), with template names.
+func getSchedule(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	loc := userLocation(userID)
+	start := c.DefaultQuery("start", localDate(time.Now(), loc))
+	end := c.DefaultQuery("end", localDate(time.Now().AddDate(0, 0, 27), loc))
+	if _, err := time.Parse(dateLayout, start); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date"})
+		return
+	}
+	if _, err := time.Parse(dateLayout, end); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date"})
+		return
+	}
+	var sessions []ScheduledSession
+	if err := db.Where("user_id = ? AND date >= ? AND date <= ?", userID, start, end).
+		Order("date, id").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ids := []int{}
+	for _, s := range sessions {
+		ids = append(ids, s.TemplateID)
+	}
+	var templates []WorkoutTemplate
+	db.Where("id IN ?", uniqueInts(ids)).Find(&templates)
+	byID := map[int]WorkoutTemplate{}
+	for _, t := range templates {
+		byID[t.ID] = t
+	}
+	today := localDate(time.Now(), loc)
+	views := make([]gin.H, 0, len(sessions))
+	for _, s := range sessions {
+		t := byID[s.TemplateID]
+		views = append(views, gin.H{
+			"id":            s.ID,
+			"enrollment_id": s.EnrollmentID,
+			"date":          s.Date,
+			"week":          s.Week,
+			"status":        sessionStatus(s, today),
+			"template_id":   s.TemplateID,
+			"name":          t.Name,
+			"type":          t.Type,
+			"duration":      t.Duration,
+			"workout_id":    s.WorkoutID,
+			"completed_at":  s.CompletedAt,
+		})
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+func sessionStatus(s ScheduledSession, today string) string {
+	if s.Status == SessionPlanned && s.Date < today {
+		return "missed"
+	}
+	return s.Status
+}
+
+// completeSession marks a scheduled session done. With workout_id the given
+// workout is linked; without it a workout is logged from the template.
+func completeSession(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "session")
+	if !ok {
+		return
+	}
+	var session ScheduledSession
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if session.Status != SessionPlanned {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is already " + session.Status})
+		return
+	}
+	var req struct {
+		WorkoutID *int `json:"workout_id"`
+	}
+	c.ShouldBindJSON(&req)
+	var workout Workout
+	var template WorkoutTemplate
+	if req.WorkoutID != nil {
+		if err := db.Where("id = ? AND user_id = ?", *req.WorkoutID, userID).First(&workout).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Workout not found"})
+			return
+		}
+		var linked int64
+		db.Model(&ScheduledSession{}).Where("workout_id = ?", workout.ID).Count(&linked)
+		if linked > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Workout already completes another session"})
+			return
+		}
+	} else {
+		var err error
+		if template, err = loadTemplate(session.TemplateID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return
+		}
+	}
+	// The template workout is saved with the session update so a session
+	// completed concurrently leaves no stray workout behind.
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if req.WorkoutID == nil {
+			var err error
+			if workout, err = createTemplateWorkout(tx, userID, template); err != nil {
+				return err
+			}
+		}
+		result := tx.Model(&ScheduledSession{}).Where("id = ? AND status = ?", session.ID, SessionPlanned).Updates(map[string]interface{}{
+			"status":       SessionCompleted,
+			"workout_id":   workout.ID,
+			"completed_at": now,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errSessionNotPlanned
+		}
+		return nil
+	})
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, errSessionNotPlanned):
+		c.JSON(http.StatusConflict, gin.H{"error": "No planned session with this ID"})
+		return
+	case errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation:
+		c.JSON(http.StatusConflict, gin.H{"error": "Workout already completes another session"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if req.WorkoutID == nil {
+		templateWorkoutLogged(userID, workout)
+	}
+	session.Status, session.WorkoutID, session.CompletedAt = SessionCompleted, &workout.ID, &now
+	c.JSON(http.StatusOK, session)
+}
+
+func skipSession(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "session")
+	if !ok {
+		return
+	}
+	result := db.Model(&ScheduledSession{}).Where("id = ? AND user_id = ? AND status = ?", id, userID, SessionPlanned).
+		Update("status", SessionSkipped)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No planned session with this ID"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session skipped"})
+}
+
+// linkScheduledSession completes the open session of the workout's day
+// whose template has the same type, so logging a planned workout the usual
+// way still counts.
+func linkScheduledSession(w Workout) {
+	date := localDate(w.CreatedAt, userLocation(w.UserID))
+	var session ScheduledSession
+	err := db.Joins("JOIN workout_templates ON workout_templates.id = scheduled_sessions.template_id").
+		Where("scheduled_sessions.user_id = ? AND scheduled_sessions.date = ? AND scheduled_sessions.status = ? AND LOWER(workout_templates.type) = LOWER(?)",
+			w.UserID, date, SessionPlanned, w.Type).
+		Order("scheduled_sessions.id").Limit(1).Find(&session).Error
+	if err != nil || session.ID == 0 {
+		return
+	}
+	db.Model(&session).Updates(map[string]interface{}{
+		"status":       SessionCompleted,
+		"workout_id":   w.ID,
+		"completed_at": time.Now(),
+	})
+}
+
+// unlinkScheduledSessions reopens sessions completed by a deleted workout.
+func unlinkScheduledSessions(tx *gorm.DB, workoutID int) error {
+	return tx.Model(&ScheduledSession{}).Where("workout_id = ?", workoutID).Updates(map[string]interface{}{
+		"status":       SessionPlanned,
+		"workout_id":   nil,
+		"completed_at": nil,
+	}).Error
+}
+
+// getPlanAdherence reports how well the caller is following a plan, for
+// their latest enrollment in it: completed sessions over those already due,
+// overall and per week.
+func getPlanAdherence(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "plan")
+	if !ok {
+		return
+	}
+	var enrollment PlanEnrollment
+	if err := db.Where("user_id = ? AND plan_id = ?", userID, id).Order("created_at desc").First(&enrollment).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not enrolled in this plan"})
+		return
+	}
+	var sessions []ScheduledSession
+	if err := db.Where("enrollment_id = ?", enrollment.ID).Order("date").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	type tally struct {
+		Week      int     `json:"week"`
+		Scheduled int     `json:"scheduled"`
+		Due       int     `json:"due"`
+		Completed int     `json:"completed"`
+		Skipped   int     `json:"skipped"`
+		Missed    int     `json:"missed"`
+		Adherence float64 `json:"adherence"` // percent of due sessions completed
+	}
+	today := localDate(time.Now(), userLocation(userID))
+	total := tally{}
+	var weeks []*tally
+	byWeek := map[int]*tally{}
+	for _, s := range sessions {
+		w := byWeek[s.Week]
+		if w == nil {
+			w = &tally{Week: s.Week}
+			byWeek[s.Week] = w
+			weeks = append(weeks, w)
+		}
+		for _, t := range []*tally{w, &total} {
+			t.Scheduled++
+			// Today's sessions only count once they are done.
+			status := sessionStatus(s, today)
+			if s.Date < today || status != SessionPlanned {
+				t.Due++
+			}
+			switch status {
+			case SessionCompleted:
+				t.Completed++
+			case SessionSkipped:
+				t.Skipped++
+			case "missed":
+				t.Missed++
+			}
+		}
+	}
+	for _, t := range append(weeks, &total) {
+		if t.Due > 0 {
+			t.Adherence = math.Round(float64(t.Completed)/float64(t.Due)*1000) / 10
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enrollment": enrollment,
+		"scheduled":  total.Scheduled,
+		"due":        total.Due,
+		"completed":  total.Completed,
+		"skipped":    total.Skipped,
+		"missed":     total.Missed,
+		"adherence":  total.Adherence,
+		"weeks":      weeks,
+	})
+}
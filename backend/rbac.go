@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RoleUser  = "user"
+	RoleCoach = "coach"
+	RoleAdmin = "admin"
+)
+
+const (
+	PermUsersRead  = "users:read"
+	PermUsersWrite = "users:write"
+	PermRolesWrite = "roles:write"
+	PermAuditRead  = "audit:read"
+)
+
+var rolePermissions = map[string]map[string]bool{
+	RoleUser:  {},
+	RoleCoach: {},
+	RoleAdmin: {
+		PermUsersRead:  true,
+		PermUsersWrite: true,
+		PermRolesWrite: true,
+		PermAuditRead:  true,
+	},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func hasPermission(role, perm string) bool {
+	return rolePermissions[role][perm]
+}
+
+// requirePermission must run after authMiddleware, which puts the caller's
+// role on the context.
+func requirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPermission(c.GetString("role"), perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+type AuditLog struct {
+	ID         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	ActorID    int       `json:"actor_id" gorm:"index;not null"`
+	Action     string    `json:"action" gorm:"not null"` // e.g., "user.update", "user.delete"
+	TargetType string    `json:"target_type"`
+	TargetID   int       `json:"target_id"`
+	Details    string    `json:"details" gorm:"type:jsonb"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at" gorm:"autoCreateTime;index"`
+}
+
+func recordAudit(c *gin.Context, action, targetType string, targetID int, details interface{}) {
+	data := "{}"
+	if details != nil {
+		if raw, err := json.Marshal(details); err == nil {
+			data = string(raw)
+		}
+	}
+	entry := AuditLog{
+		ActorID:    c.GetInt("user_id"),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    data,
+		IP:         c.ClientIP(),
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("failed to write audit log: %v", err)
+	}
+}
+
+func getAuditLogs(c *gin.Context) {
+	query := db.Order("created_at desc")
+	if actor := c.Query("actor_id"); actor != "" {
+		query = query.Where("actor_id = ?", actor)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if target := c.Query("target_id"); target != "" {
+		query = query.Where("target_id = ?", target)
+	}
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	var logs []AuditLog
+	if err := query.Limit(limit).Find(&logs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, logs)
+}
+
+// bootstrapAdmins promotes the accounts listed in ADMIN_EMAILS so a fresh
+// deployment has someone who can reach the admin API.
+func bootstrapAdmins() {
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		res := db.Model(&User{}).Where("email = ? AND role <> ?", email, RoleAdmin).Update("role", RoleAdmin)
+		if res.Error != nil {
+			log.Printf("failed to promote %s to admin: %v", email, res.Error)
+		} else if res.RowsAffected > 0 {
+			log.Printf("Promoted %s to admin", email)
+		}
+	}
+}
+
+func isLastAdmin(userID int) bool {
+	var count int64
+	db.Model(&User{}).Where("role = ? AND id <> ?", RoleAdmin, userID).Count(&count)
+	var user User
+	if err := db.Select("id", "role").First(&user, userID).Error; err != nil {
+		return false
+	}
+	return user.Role == RoleAdmin && count == 0
+}
+
+// userChanges lists the fields an admin edit actually touched, for the audit log.
+func userChanges(before, after User) gin.H {
+	changes := gin.H{}
+	if before.Name != after.Name {
+		changes["name"] = []string{before.Name, after.Name}
+	}
+	if before.Email != after.Email {
+		changes["email"] = []string{before.Email, after.Email}
+	}
+	if before.Role != after.Role {
+		changes["role"] = []string{before.Role, after.Role}
+	}
+	if before.Weight != after.Weight {
+		changes["weight"] = []float64{before.Weight, after.Weight}
+	}
+	if before.Height != after.Height {
+		changes["height"] = []float64{before.Height, after.Height}
+	}
+	if before.Age != after.Age {
+		changes["age"] = []int{before.Age, after.Age}
+	}
+	if before.Sex != after.Sex {
+		changes["sex"] = []string{before.Sex, after.Sex}
+	}
+	return changes
+}
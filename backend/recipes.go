@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxRecipeServings    = 100
+	maxRecipeIngredients = 100
+)
+
+// Nutrition is a sum of food nutrients: energy in kcal, sodium in mg, the
+// rest in grams.
+type Nutrition struct {
+	Calories float64 `json:"calories"`
+	Protein  float64 `json:"protein"`
+	Carbs    float64 `json:"carbs"`
+	Fat      float64 `json:"fat"`
+	Fiber    float64 `json:"fiber"`
+	Sugar    float64 `json:"sugar"`
+	Sodium   float64 `json:"sodium"`
+}
+
+func (n *Nutrition) addFood(food Food, grams float64) {
+	f := grams / 100
+	n.Calories += food.Calories * f
+	n.Protein += food.Protein * f
+	n.Carbs += food.Carbs * f
+	n.Fat += food.Fat * f
+	n.Fiber += food.Fiber * f
+	n.Sugar += food.Sugar * f
+	n.Sodium += food.Sodium * f
+}
+
+// addEntry adds what a diet entry logged.
+func (n *Nutrition) addEntry(d DietEntry) {
+	n.Calories += float64(d.Calories)
+	n.Protein += d.Protein
+	n.Carbs += d.Carbs
+	n.Fat += d.Fat
+	n.Fiber += d.Fiber
+	n.Sugar += d.Sugar
+	n.Sodium += d.Sodium
+}
+
+func (n *Nutrition) addNutrition(o Nutrition) {
+	n.Calories += o.Calories
+	n.Protein += o.Protein
+	n.Carbs += o.Carbs
+	n.Fat += o.Fat
+	n.Fiber += o.Fiber
+	n.Sugar += o.Sugar
+	n.Sodium += o.Sodium
+}
+
+func (d DietEntry) nutrition() Nutrition {
+	var n Nutrition
+	n.addEntry(d)
+	return n
+}
+
+// setNutrition stores n, which should be rounded, on the entry.
+func (d *DietEntry) setNutrition(n Nutrition) {
+	d.Calories = int(n.Calories)
+	d.Protein, d.Carbs, d.Fat, d.Fiber = n.Protein, n.Carbs, n.Fat, n.Fiber
+	d.Sugar, d.Sodium = n.Sugar, n.Sodium
+}
+
+func (n Nutrition) scaled(f float64) Nutrition {
+	return Nutrition{
+		Calories: n.Calories * f,
+		Protein:  n.Protein * f,
+		Carbs:    n.Carbs * f,
+		Fat:      n.Fat * f,
+		Fiber:    n.Fiber * f,
+		Sugar:    n.Sugar * f,
+		Sodium:   n.Sodium * f,
+	}
+}
+
+func (n Nutrition) rounded() Nutrition {
+	return Nutrition{
+		Calories: math.Round(n.Calories),
+		Protein:  roundTo(n.Protein, 1),
+		Carbs:    roundTo(n.Carbs, 1),
+		Fat:      roundTo(n.Fat, 1),
+		Fiber:    roundTo(n.Fiber, 1),
+		Sugar:    roundTo(n.Sugar, 1),
+		Sodium:   math.Round(n.Sodium),
+	}
+}
+
+// Recipe is a dish made of foods, split into Servings portions. Shared
+// recipes can be viewed and logged by the author's friends.
+type Recipe struct {
+	ID           int                `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID       int                `json:"user_id" gorm:"index;not null"`
+	Name         string             `json:"name" gorm:"not null"`
+	Description  string             `json:"description"`
+	Instructions string             `json:"instructions"`
+	Servings     int                `json:"servings" gorm:"not null;default:1"`
+	Shared       bool               `json:"shared" gorm:"not null;default:false"`
+	Ingredients  []RecipeIngredient `json:"ingredients" gorm:"foreignKey:RecipeID"`
+	Total        Nutrition          `json:"total" gorm:"-"`
+	PerServing   Nutrition          `json:"per_serving" gorm:"-"`
+	Weight       float64            `json:"weight" gorm:"-"` // of the whole recipe, in WeightUnit
+	WeightUnit   string             `json:"weight_unit,omitempty" gorm:"-"`
+	CreatedAt    time.Time          `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt    time.Time          `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// RecipeIngredient is Amount grams of a food.
+type RecipeIngredient struct {
+	ID         int     `json:"id" gorm:"primaryKey;autoIncrement"`
+	RecipeID   int     `json:"recipe_id" gorm:"index;not null"`
+	FoodID     int     `json:"food_id" gorm:"index;not null"`
+	Position   int     `json:"position" gorm:"not null"`
+	Amount     float64 `json:"amount" gorm:"not null"`
+	AmountUnit string  `json:"amount_unit,omitempty" gorm:"-"`
+	Note       string  `json:"note"`
+	FoodName   string  `json:"food_name,omitempty" gorm:"-"`
+}
+
+func friendIDs(userID int) ([]int, error) {
+	var friends []Friendship
+	if err := db.Where("user_id1 = ? OR user_id2 = ?", userID, userID).Find(&friends).Error; err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for _, f := range friends {
+		if f.UserID1 == userID {
+			ids = append(ids, f.UserID2)
+		} else {
+			ids = append(ids, f.UserID1)
+		}
+	}
+	return ids, nil
+}
+
+func recipeVisible(userID int, r Recipe) bool {
+	return r.UserID == userID || (r.Shared && isFriend(userID, r.UserID))
+}
+
+func preloadIngredients(tx *gorm.DB) *gorm.DB {
+	return tx.Order("position")
+}
+
+func loadRecipe(id int) (Recipe, error) {
+	var r Recipe
+	err := db.Preload("Ingredients", preloadIngredients).First(&r, id).Error
+	return r, err
+}
+
+// recipeFoods loads the ingredient foods of recipes. Foods are read without
+// a visibility check: whoever may see a recipe may see what is in it.
+func recipeFoods(recipes []Recipe) (map[int]Food, error) {
+	ids := []int{}
+	for _, r := range recipes {
+		for _, in := range r.Ingredients {
+			ids = append(ids, in.FoodID)
+		}
+	}
+	foods := map[int]Food{}
+	if len(ids) == 0 {
+		return foods, nil
+	}
+	var rows []Food
+	if err := db.Where("id IN ?", uniqueInts(ids)).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, f := range rows {
+		foods[f.ID] = f
+	}
+	return foods, nil
+}
+
+func recipeTotal(r Recipe, foods map[int]Food) Nutrition {
+	var total Nutrition
+	for _, in := range r.Ingredients {
+		total.addFood(foods[in.FoodID], in.Amount)
+	}
+	return total
+}
+
+// recipeNutrition fills in the totals and weight of recipes and the names
+// of their ingredients.
+func recipeNutrition(recipes []Recipe) error {
+	foods, err := recipeFoods(recipes)
+	if err != nil {
+		return err
+	}
+	for i := range recipes {
+		r := &recipes[i]
+		r.Weight = 0
+		for j := range r.Ingredients {
+			in := &r.Ingredients[j]
+			in.FoodName = foods[in.FoodID].Name
+			r.Weight += in.Amount
+		}
+		total := recipeTotal(*r, foods)
+		r.Total = total.rounded()
+		r.PerServing = total.scaled(1 / float64(r.Servings)).rounded()
+	}
+	return nil
+}
+
+func displayRecipe(r *Recipe, units string) {
+	r.Weight, r.WeightUnit = portionUnits.display(r.Weight, units)
+	for i := range r.Ingredients {
+		in := &r.Ingredients[i]
+		in.Amount, in.AmountUnit = portionUnits.display(in.Amount, units)
+	}
+}
+
+// prepareRecipe validates a recipe from a request and converts ingredient
+// amounts to grams. Ingredients must be foods the author can see.
+func prepareRecipe(r *Recipe, userID int, units string) error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if r.Servings == 0 {
+		r.Servings = 1
+	}
+	if r.Servings < 1 || r.Servings > maxRecipeServings {
+		return fmt.Errorf("servings must be between 1 and %d", maxRecipeServings)
+	}
+	if len(r.Ingredients) == 0 || len(r.Ingredients) > maxRecipeIngredients {
+		return fmt.Errorf("a recipe needs 1 to %d ingredients", maxRecipeIngredients)
+	}
+	ids := []int{}
+	for i := range r.Ingredients {
+		in := &r.Ingredients[i]
+		in.ID, in.RecipeID, in.Position = 0, r.ID, i+1
+		amount, err := portionUnits.toCanonical(in.Amount, in.AmountUnit, units)
+		if err != nil {
+			return err
+		}
+		if amount <= 0 || amount > 10000 {
+			return fmt.Errorf("ingredient %d: amount must be more than 0 and at most 10 kg", i+1)
+		}
+		in.Amount, in.AmountUnit = amount, ""
+		ids = append(ids, in.FoodID)
+	}
+	ids = uniqueInts(ids)
+	var known int64
+	visibleFoods(db.Model(&Food{}), userID).Where("id IN ?", ids).Count(&known)
+	if int(known) != len(ids) {
+		return errors.New("unknown food")
+	}
+	return nil
+}
+
+func saveRecipeIngredients(tx *gorm.DB, r *Recipe) error {
+	if err := tx.Where("recipe_id = ?", r.ID).Delete(&RecipeIngredient{}).Error; err != nil {
+		return err
+	}
+	for i := range r.Ingredients {
+		r.Ingredients[i].RecipeID = r.ID
+	}
+	return tx.Create(&r.Ingredients).Error
+}
+
+// getRecipes lists the user's recipes, or with shared=true the recipes
+// their friends share.
+func getRecipes(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	query := db.Where("user_id = ?", userID)
+	if c.Query("shared") == "true" {
+		ids, err := friendIDs(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		query = db.Where("user_id IN ? AND shared = ?", ids, true)
+	}
+	var recipes []Recipe
+	if err := query.Preload("Ingredients", preloadIngredients).Order("name").Find(&recipes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := recipeNutrition(recipes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	units := userUnits(userID)
+	for i := range recipes {
+		displayRecipe(&recipes[i], units)
+	}
+	c.JSON(http.StatusOK, recipes)
+}
+
+func getRecipe(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "recipe")
+	if !ok {
+		return
+	}
+	r, err := loadRecipe(id)
+	if err != nil || !recipeVisible(userID, r) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	recipes := []Recipe{r}
+	if err := recipeNutrition(recipes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	displayRecipe(&recipes[0], userUnits(userID))
+	c.JSON(http.StatusOK, recipes[0])
+}
+
+func createRecipe(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var r Recipe
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r.ID, r.UserID = 0, userID
+	units := userUnits(userID)
+	if err := prepareRecipe(&r, userID, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Create(&r).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recipes := []Recipe{r}
+	if err := recipeNutrition(recipes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	displayRecipe(&recipes[0], units)
+	c.JSON(http.StatusCreated, recipes[0])
+}
+
+// updateRecipe replaces a recipe, ingredients included. Diet entries
+// already logged keep the nutrients they were logged with.
+func updateRecipe(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "recipe")
+	if !ok {
+		return
+	}
+	stored, err := loadRecipe(id)
+	if err != nil || stored.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	var r Recipe
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r.ID, r.UserID, r.CreatedAt = stored.ID, userID, stored.CreatedAt
+	units := userUnits(userID)
+	if err := prepareRecipe(&r, userID, units); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Ingredients").Save(&r).Error; err != nil {
+			return err
+		}
+		return saveRecipeIngredients(tx, &r)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recipes := []Recipe{r}
+	if err := recipeNutrition(recipes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	displayRecipe(&recipes[0], units)
+	c.JSON(http.StatusOK, recipes[0])
+}
+
+func deleteRecipe(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, ok := paramID(c, "recipe")
+	if !ok {
+		return
+	}
+	var r Recipe
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&r).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&r).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("recipe_id = ?", id).Delete(&RecipeIngredient{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("recipe_id = ?", id).Delete(&PlannedMeal{}).Error; err != nil {
+			return err
+		}
+		// Entries logged from it, by the author or friends, keep their values.
+		return tx.Model(&DietEntry{}).Where("recipe_id = ?", id).Update("recipe_id", nil).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Recipe deleted"})
+}
+
+// resolveDietRecipe computes the nutrients of Servings portions of the
+// entry's recipe (1 when not given). As with foods, an update that keeps
+// the recipe and servings keeps the logged values.
+func resolveDietRecipe(entry *DietEntry, stored *DietEntry) error {
+	if entry.Servings == 0 {
+		entry.Servings = 1
+	}
+	if entry.Servings < 0 || entry.Servings > maxRecipeServings {
+		return fmt.Errorf("servings must be more than 0 and at most %d", maxRecipeServings)
+	}
+	if stored != nil && stored.RecipeID != nil && *stored.RecipeID == *entry.RecipeID && stored.Servings == entry.Servings {
+		entry.Food = stored.Food
+		entry.setNutrition(stored.nutrition())
+		return nil
+	}
+	r, err := loadRecipe(*entry.RecipeID)
+	if err != nil || !recipeVisible(entry.UserID, r) {
+		return errors.New("recipe not found")
+	}
+	foods, err := recipeFoods([]Recipe{r})
+	if err != nil {
+		return err
+	}
+	n := recipeTotal(r, foods).scaled(entry.Servings / float64(r.Servings)).rounded()
+	entry.Food = r.Name
+	entry.setNutrition(n)
+	return nil
+}
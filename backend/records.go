@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Kinds of personal record. Scope is the workout type for the first three
+// and the exercise ID for the lifting records.
+const (
+	RecordLongestDuration = "longest_duration" // minutes
+	RecordFastest5K       = "fastest_5k"       // seconds
+	RecordFastest10K      = "fastest_10k"      // seconds
+	RecordHeaviestLift    = "heaviest_lift"    // kg
+	RecordBest1RM         = "best_1rm"         // kg
+)
+
+// effortDistances are the distances, in metres, whose fastest split is
+// kept for imported recordings.
+var effortDistances = map[int]string{
+	5000:  RecordFastest5K,
+	10000: RecordFastest10K,
+}
+
+// PersonalRecord is the current best of one kind and scope, pointing at
+// the workout that set it.
+type PersonalRecord struct {
+	ID         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID     int       `json:"user_id" gorm:"not null;uniqueIndex:idx_personal_records_key"`
+	Kind       string    `json:"kind" gorm:"type:varchar(32);not null;uniqueIndex:idx_personal_records_key"`
+	Scope      string    `json:"scope" gorm:"type:varchar(64);not null;uniqueIndex:idx_personal_records_key"`
+	Value      float64   `json:"value" gorm:"not null"`
+	WorkoutID  int       `json:"workout_id" gorm:"index;not null"`
+	AchievedAt time.Time `json:"achieved_at" gorm:"not null"`
+	UpdatedAt  time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// WorkoutEffort is the fastest time over a set distance inside one imported
+// recording, worked out once at import so records need not re-read tracks.
+type WorkoutEffort struct {
+	ID        int `json:"id" gorm:"primaryKey;autoIncrement"`
+	WorkoutID int `json:"workout_id" gorm:"index;not null"`
+	Distance  int `json:"distance" gorm:"not null"` // metres
+	Seconds   int `json:"seconds" gorm:"not null"`
+}
+
+func recordKey(kind, scope string) string {
+	return kind + "/" + scope
+}
+
+func lowerIsBetter(kind string) bool {
+	return kind == RecordFastest5K || kind == RecordFastest10K
+}
+
+// beats reports whether a is a strictly better value than b for kind.
+func beats(kind string, a, b float64) bool {
+	if lowerIsBetter(kind) {
+		return a < b
+	}
+	return a > b
+}
+
+// bestEfforts finds the fastest time over each effort distance. Distance
+// comes from the device when every timed point has it, otherwise from the
+// positions; the start of each window is interpolated between samples.
+func bestEfforts(points []TrackPoint) map[int]int {
+	type sample struct{ t, d float64 }
+	var samples []sample
+	deviceDistance := true
+	for _, p := range points {
+		if p.Time != nil && p.Distance == nil {
+			deviceDistance = false
+			break
+		}
+	}
+	var start *time.Time
+	var travelled float64
+	var prevLat, prevLon *float64
+	for _, p := range points {
+		if !deviceDistance && p.Lat != nil && p.Lon != nil {
+			if prevLat != nil {
+				travelled += haversine(*prevLat, *prevLon, *p.Lat, *p.Lon)
+			}
+			prevLat, prevLon = p.Lat, p.Lon
+		}
+		if p.Time == nil {
+			continue
+		}
+		if start == nil {
+			start = p.Time
+		}
+		d := travelled
+		if deviceDistance {
+			d = *p.Distance
+		}
+		samples = append(samples, sample{t: p.Time.Sub(*start).Seconds(), d: d})
+	}
+
+	efforts := map[int]int{}
+	for distance := range effortDistances {
+		target := float64(distance)
+		best := math.Inf(1)
+		i := 0
+		for j := range samples {
+			for i+1 < j && samples[j].d-samples[i+1].d >= target {
+				i++
+			}
+			covered := samples[j].d - samples[i].d
+			if covered < target {
+				continue
+			}
+			// Move the start forward to where exactly target remains.
+			t0 := samples[i].t
+			if next := samples[i+1]; next.d > samples[i].d {
+				frac := (covered - target) / (next.d - samples[i].d)
+				t0 += frac * (next.t - samples[i].t)
+			}
+			if elapsed := samples[j].t - t0; elapsed > 0 && elapsed < best {
+				best = elapsed
+			}
+		}
+		if !math.IsInf(best, 1) {
+			efforts[distance] = int(math.Round(best))
+		}
+	}
+	return efforts
+}
+
+func createWorkoutEfforts(tx *gorm.DB, workoutID int, points []TrackPoint) error {
+	efforts := bestEfforts(points)
+	if len(efforts) == 0 {
+		return nil
+	}
+	rows := make([]WorkoutEffort, 0, len(efforts))
+	for distance, seconds := range efforts {
+		rows = append(rows, WorkoutEffort{WorkoutID: workoutID, Distance: distance, Seconds: seconds})
+	}
+	return tx.Create(&rows).Error
+}
+
+// candidates keeps the best value seen so far for a record key; on ties the
+// earlier workout keeps the record.
+type candidates map[string]PersonalRecord
+
+func (cs candidates) offer(r PersonalRecord) {
+	key := recordKey(r.Kind, r.Scope)
+	cur, ok := cs[key]
+	if !ok || beats(r.Kind, r.Value, cur.Value) ||
+		(r.Value == cur.Value && r.AchievedAt.Before(cur.AchievedAt)) {
+		cs[key] = r
+	}
+}
+
+// computePersonalRecords derives every record from the user's workouts as
+// they are now.
+func computePersonalRecords(tx *gorm.DB, userID int) (candidates, error) {
+	best := candidates{}
+
+	var workouts []Workout
+	if err := tx.Select("id", "type", "duration", "created_at").
+		Where("user_id = ? AND duration > 0", userID).Find(&workouts).Error; err != nil {
+		return nil, err
+	}
+	for _, w := range workouts {
+		best.offer(PersonalRecord{UserID: userID, Kind: RecordLongestDuration, Scope: w.Type,
+			Value: float64(w.Duration), WorkoutID: w.ID, AchievedAt: w.CreatedAt})
+	}
+
+	var efforts []struct {
+		WorkoutID int
+		Type      string
+		Distance  int
+		Seconds   int
+		CreatedAt time.Time
+	}
+	if err := tx.Table("workout_efforts").
+		Select("workout_efforts.workout_id, workouts.type, workout_efforts.distance, workout_efforts.seconds, workouts.created_at").
+		Joins("JOIN workouts ON workouts.id = workout_efforts.workout_id").
+		Where("workouts.user_id = ?", userID).Scan(&efforts).Error; err != nil {
+		return nil, err
+	}
+	for _, e := range efforts {
+		if kind, ok := effortDistances[e.Distance]; ok {
+			best.offer(PersonalRecord{UserID: userID, Kind: kind, Scope: e.Type,
+				Value: float64(e.Seconds), WorkoutID: e.WorkoutID, AchievedAt: e.CreatedAt})
+		}
+	}
+
+	var sets []struct {
+		ExerciseSet
+		ExerciseID int
+		WorkoutID  int
+		CreatedAt  time.Time
+	}
+	if err := tx.Table("exercise_sets").
+		Select("exercise_sets.*, workout_exercises.exercise_id, workout_exercises.workout_id, workouts.created_at").
+		Joins("JOIN workout_exercises ON workout_exercises.id = exercise_sets.workout_exercise_id").
+		Joins("JOIN workouts ON workouts.id = workout_exercises.workout_id").
+		Where("workouts.user_id = ? AND exercise_sets.warmup = ? AND exercise_sets.reps > 0 AND exercise_sets.weight > 0", userID, false).
+		Scan(&sets).Error; err != nil {
+		return nil, err
+	}
+	for _, s := range sets {
+		scope := strconv.Itoa(s.ExerciseID)
+		best.offer(PersonalRecord{UserID: userID, Kind: RecordHeaviestLift, Scope: scope,
+			Value: s.Weight, WorkoutID: s.WorkoutID, AchievedAt: s.CreatedAt})
+		if e := estimateOneRepMax(s.ExerciseSet); e > 0 {
+			best.offer(PersonalRecord{UserID: userID, Kind: RecordBest1RM, Scope: scope,
+				Value: math.Round(e*10) / 10, WorkoutID: s.WorkoutID, AchievedAt: s.CreatedAt})
+		}
+	}
+	return best, nil
+}
+
+// syncPersonalRecords brings the stored records in line with the user's
+// workouts: new and changed records are written, records whose workouts are
+// gone are removed or handed to the next best. It returns the records that
+// workoutID took from an earlier workout, with the values they beat.
+func syncPersonalRecords(tx *gorm.DB, userID, workoutID int) ([]PersonalRecord, map[string]float64, error) {
+	best, err := computePersonalRecords(tx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var stored []PersonalRecord
+	if err := tx.Where("user_id = ?", userID).Find(&stored).Error; err != nil {
+		return nil, nil, err
+	}
+	storedByKey := map[string]PersonalRecord{}
+	for _, r := range stored {
+		storedByKey[recordKey(r.Kind, r.Scope)] = r
+	}
+
+	var broken []PersonalRecord
+	previous := map[string]float64{}
+	for key, r := range best {
+		old, had := storedByKey[key]
+		if had && old.WorkoutID == r.WorkoutID && old.Value == r.Value {
+			continue
+		}
+		if had {
+			r.ID = old.ID
+		}
+		if err := tx.Save(&r).Error; err != nil {
+			return nil, nil, err
+		}
+		if had && r.WorkoutID == workoutID && beats(r.Kind, r.Value, old.Value) {
+			broken = append(broken, r)
+			previous[key] = old.Value
+		}
+	}
+	var gone []int
+	for key, r := range storedByKey {
+		if _, ok := best[key]; !ok {
+			gone = append(gone, r.ID)
+		}
+	}
+	if len(gone) > 0 {
+		if err := tx.Delete(&PersonalRecord{}, gone).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	return broken, previous, nil
+}
+
+// updatePersonalRecords runs after a workout of the user was saved or
+// deleted (workoutID 0) and posts an activity for every record that fell.
+func updatePersonalRecords(userID, workoutID int) {
+	broken, previous, err := syncPersonalRecords(db, userID, workoutID)
+	if err != nil {
+		log.Printf("failed to update personal records for user %d: %v", userID, err)
+		return
+	}
+	for _, r := range broken {
+		data := map[string]interface{}{
+			"kind":       r.Kind,
+			"scope":      r.Scope,
+			"label":      recordLabel(r),
+			"value":      r.Value,
+			"unit":       recordUnit(r.Kind),
+			"workout_id": r.WorkoutID,
+			"previous":   previous[recordKey(r.Kind, r.Scope)],
+		}
+		raw, _ := json.Marshal(data)
+		if err := db.Create(&Activity{UserID: userID, Type: "personal_record", Data: string(raw), IsPublic: true}).Error; err != nil {
+			log.Printf("failed to post personal record activity: %v", err)
+		}
+	}
+}
+
+func recordUnit(kind string) string {
+	switch kind {
+	case RecordLongestDuration:
+		return "min"
+	case RecordFastest5K, RecordFastest10K:
+		return "s"
+	default:
+		return "kg"
+	}
+}
+
+func exerciseName(id string) string {
+	var exercise Exercise
+	if err := db.Select("name").Where("id = ?", id).First(&exercise).Error; err != nil {
+		return "exercise " + id
+	}
+	return exercise.Name
+}
+
+func recordLabel(r PersonalRecord) string {
+	switch r.Kind {
+	case RecordLongestDuration:
+		return fmt.Sprintf("Longest %s", r.Scope)
+	case RecordFastest5K:
+		return fmt.Sprintf("Fastest 5 km (%s)", r.Scope)
+	case RecordFastest10K:
+		return fmt.Sprintf("Fastest 10 km (%s)", r.Scope)
+	case RecordHeaviestLift:
+		return fmt.Sprintf("Heaviest %s", exerciseName(r.Scope))
+	default:
+		return fmt.Sprintf("Best estimated 1RM, %s", exerciseName(r.Scope))
+	}
+}
+
+// backfillPersonalRecords fills the records table for users who logged
+// workouts before records were tracked, working out the splits of earlier
+// imports first.
+func backfillPersonalRecords(tx *gorm.DB) error {
+	var imported []int
+	if err := tx.Model(&Workout{}).Where("source <> ?", "manual").Pluck("id", &imported).Error; err != nil {
+		return err
+	}
+	for _, id := range imported {
+		var points []TrackPoint
+		if err := tx.Where("workout_id = ?", id).Order("seq").Find(&points).Error; err != nil {
+			return err
+		}
+		if err := createWorkoutEfforts(tx, id, points); err != nil {
+			return err
+		}
+	}
+	var userIDs []int
+	if err := tx.Model(&Workout{}).Distinct("user_id").Pluck("user_id", &userIDs).Error; err != nil {
+		return err
+	}
+	for _, id := range userIDs {
+		if _, _, err := syncPersonalRecords(tx, id, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getPersonalRecords(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var records []PersonalRecord
+	query := db.Where("user_id = ?", userID)
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	if err := query.Find(&records).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].AchievedAt.After(records[j].AchievedAt) })
+	units := userUnits(userID)
+	views := make([]gin.H, 0, len(records))
+	for _, r := range records {
+		value, unit := r.Value, recordUnit(r.Kind)
+		if unit == "kg" {
+			value, unit = massUnits.display(value, units)
+		}
+		views = append(views, gin.H{
+			"id":          r.ID,
+			"kind":        r.Kind,
+			"scope":       r.Scope,
+			"label":       recordLabel(r),
+			"value":       value,
+			"unit":        unit,
+			"workout_id":  r.WorkoutID,
+			"achieved_at": r.AchievedAt,
+		})
+	}
+	c.JSON(http.StatusOK, views)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// Session is one signed-in device. The refresh token itself is never stored,
+// only its SHA-256 hash; the previous hash is kept so a replayed (already
+// rotated) refresh token can be detected and the session revoked.
+type Session struct {
+	ID                int        `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID            int        `json:"user_id" gorm:"index;not null"`
+	RefreshTokenHash  string     `json:"-" gorm:"uniqueIndex;not null"`
+	PreviousTokenHash string     `json:"-" gorm:"index"`
+	DeviceName        string     `json:"device_name"`
+	UserAgent         string     `json:"user_agent"`
+	IP                string     `json:"ip"`
+	CreatedAt         time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	LastUsedAt        time.Time  `json:"last_used_at"`
+	ExpiresAt         time.Time  `json:"expires_at" gorm:"not null"`
+	RevokedAt         *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (s Session) active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+func newRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAccessToken(userID, sessionID int) (string, error) {
+	claims := &Claims{
+		UserID:    userID,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    keys.issuer,
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
+		},
+	}
+	return keys.sign(claims)
+}
+
+func tokenResponse(accessToken, refreshToken string) gin.H {
+	return gin.H{
+		"token":         accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(accessTokenTTL.Seconds()),
+		"refresh_token": refreshToken,
+	}
+}
+
+// issueSession creates a new session for the user and returns the token pair
+// the client should store.
+func issueSession(c *gin.Context, userID int, deviceName string) (gin.H, error) {
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if deviceName == "" {
+		deviceName = c.Request.UserAgent()
+	}
+	session := Session{
+		UserID:           userID,
+		RefreshTokenHash: hashToken(refreshToken),
+		DeviceName:       deviceName,
+		UserAgent:        c.Request.UserAgent(),
+		IP:               c.ClientIP(),
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(refreshTokenTTL),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	accessToken, err := newAccessToken(userID, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return tokenResponse(accessToken, refreshToken), nil
+}
+
+func revokeSession(session *Session) error {
+	now := time.Now()
+	return db.Model(session).Where("revoked_at IS NULL").Update("revoked_at", now).Error
+}
+
+func revokeAllSessions(userID int) error {
+	return db.Model(&Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", time.Now()).Error
+}
+
+func refreshToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+		return
+	}
+	hash := hashToken(req.RefreshToken)
+	now := time.Now()
+
+	var session Session
+	if err := db.Where("refresh_token_hash = ?", hash).First(&session).Error; err != nil {
+		// A rotated token being presented again means it was copied; kill the session.
+		var reused Session
+		if err := db.Where("previous_token_hash = ?", hash).First(&reused).Error; err == nil {
+			revokeSession(&reused)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if !session.active(now) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired or revoked"})
+		return
+	}
+
+	newToken, err := newRefreshToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	res := db.Model(&Session{}).
+		Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL", session.ID, hash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash":  hashToken(newToken),
+			"previous_token_hash": hash,
+			"last_used_at":        now,
+			"expires_at":          now.Add(refreshTokenTTL),
+			"ip":                  c.ClientIP(),
+		})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+		return
+	}
+	if res.RowsAffected == 0 {
+		// Lost a race with another refresh using the same token.
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	accessToken, err := newAccessToken(session.UserID, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, tokenResponse(accessToken, newToken))
+}
+
+func logout(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var req struct {
+		All bool `json:"all"`
+	}
+	c.ShouldBindJSON(&req)
+	if req.All {
+		if err := revokeAllSessions(userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out from all devices"})
+		return
+	}
+	session := Session{ID: c.GetInt("session_id")}
+	if err := revokeSession(&session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+func getSessions(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	currentID := c.GetInt("session_id")
+	var sessions []Session
+	if err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at desc").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result := []gin.H{}
+	for _, s := range sessions {
+		result = append(result, gin.H{
+			"id":           s.ID,
+			"device_name":  s.DeviceName,
+			"user_agent":   s.UserAgent,
+			"ip":           s.IP,
+			"created_at":   s.CreatedAt,
+			"last_used_at": s.LastUsedAt,
+			"expires_at":   s.ExpiresAt,
+			"current":      s.ID == currentID,
+		})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func deleteSession(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	var session Session
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err := revokeSession(&session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxSetsPerWorkout = 200
+	// Rep counts past this say little about a one-rep max.
+	maxRepsFor1RM = 12
+)
+
+// Exercise is an entry in the catalog. Rows without a UserID ship with the
+// app; users can add their own.
+type Exercise struct {
+	ID          int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID      *int      `json:"user_id" gorm:"index"`
+	Name        string    `json:"name" gorm:"not null"`
+	Slug        string    `json:"slug" gorm:"type:varchar(64);not null"`
+	MuscleGroup string    `json:"muscle_group" gorm:"type:varchar(32)"` // chest, back, legs, shoulders, arms, core, full_body
+	Equipment   string    `json:"equipment" gorm:"type:varchar(32)"`    // barbell, dumbbell, machine, cable, bodyweight, kettlebell
+	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// WorkoutExercise places an exercise in a workout, in order.
+type WorkoutExercise struct {
+	ID         int           `json:"id" gorm:"primaryKey;autoIncrement"`
+	WorkoutID  int           `json:"workout_id" gorm:"index;not null"`
+	ExerciseID int           `json:"exercise_id" gorm:"index;not null"`
+	Position   int           `json:"position" gorm:"not null"`
+	Notes      string        `json:"notes"`
+	Sets       []ExerciseSet `json:"sets" gorm:"foreignKey:WorkoutExerciseID"`
+}
+
+// ExerciseSet is one set. Weight is the external load in kg; RPE is the
+// rate of perceived exertion on the 1-10 scale.
+type ExerciseSet struct {
+	ID                int      `json:"id" gorm:"primaryKey;autoIncrement"`
+	WorkoutExerciseID int      `json:"workout_exercise_id" gorm:"index;not null"`
+	Position          int      `json:"position" gorm:"not null"`
+	Reps              int      `json:"reps" gorm:"not null"`
+	Weight            float64  `json:"weight" gorm:"not null;default:0"`
+	WeightUnit        string   `json:"weight_unit,omitempty" gorm:"-"`
+	RPE               *float64 `json:"rpe" gorm:"column:rpe"`
+	RestSeconds       int      `json:"rest_seconds"`
+	Warmup            bool     `json:"warmup" gorm:"not null;default:false"`
+}
+
+// estimateOneRepMax uses the Epley formula. An RPE counts the reps left in
+// reserve, so 5 reps at RPE 8 is read as a 7 rep max.
+func estimateOneRepMax(s ExerciseSet) float64 {
+	if s.Reps <= 0 || s.Weight <= 0 || s.Warmup {
+		return 0
+	}
+	reps := float64(s.Reps)
+	if s.RPE != nil && *s.RPE < 10 {
+		reps += 10 - *s.RPE
+	}
+	if reps > maxRepsFor1RM {
+		return 0
+	}
+	if reps == 1 {
+		return s.Weight
+	}
+	return s.Weight * (1 + reps/30)
+}
+
+// setStats sums working-set volume (reps × load) and finds the best
+// estimated 1RM.
+func setStats(sets []ExerciseSet) (volume, best float64) {
+	for _, s := range sets {
+		if s.Warmup {
+			continue
+		}
+		volume += float64(s.Reps) * s.Weight
+		if e := estimateOneRepMax(s); e > best {
+			best = e
+		}
+	}
+	return volume, best
+}
+
+func exerciseSlug(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+// visibleExercises limits a query to the catalog plus the user's own
+// exercises.
+func visibleExercises(query *gorm.DB, userID int) *gorm.DB {
+	return query.Where("user_id IS NULL OR user_id = ?", userID)
+}
+
+func findExercise(c *gin.Context, userID int) (Exercise, bool) {
+	var exercise Exercise
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid exercise ID"})
+		return exercise, false
+	}
+	if err := visibleExercises(db, userID).Where("id = ?", id).First(&exercise).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Exercise not found"})
+		return exercise, false
+	}
+	return exercise, true
+}
+
+func getExercises(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	query := visibleExercises(db, userID)
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		query = query.Where("name ILIKE ?", "%"+q+"%")
+	}
+	if muscle := c.Query("muscle_group"); muscle != "" {
+		query = query.Where("muscle_group = ?", muscle)
+	}
+	if equipment := c.Query("equipment"); equipment != "" {
+		query = query.Where("equipment = ?", equipment)
+	}
+	var exercises []Exercise
+	if err := query.Order("name").Find(&exercises).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, exercises)
+}
+
+func createExercise(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	var exercise Exercise
+	if err := c.ShouldBindJSON(&exercise); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	exercise.ID = 0
+	exercise.UserID = &userID
+	exercise.Name = strings.TrimSpace(exercise.Name)
+	exercise.Slug = exerciseSlug(exercise.Name)
+	if exercise.Slug == "" || len(exercise.Slug) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Exercise name must contain letters or digits and be at most 64 characters"})
+		return
+	}
+	var count int64
+	visibleExercises(db.Model(&Exercise{}), userID).Where("slug = ?", exercise.Slug).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "An exercise with this name already exists"})
+		return
+	}
+	if err := db.Create(&exercise).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, exercise)
+}
+
+// loadWorkoutExercises returns a workout's exercises with their sets, in
+// order.
+func loadWorkoutExercises(workoutIDs ...int) ([]WorkoutExercise, error) {
+	var entries []WorkoutExercise
+	err := db.Where("workout_id IN ?", workoutIDs).
+		Preload("Sets", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).
+		Order("workout_id, position").Find(&entries).Error
+	return entries, err
+}
+
+func displaySets(sets []ExerciseSet, units string) {
+	for i := range sets {
+		sets[i].Weight, sets[i].WeightUnit = massUnits.display(sets[i].Weight, units)
+	}
+}
+
+// workoutExerciseView adds the names and per-exercise totals, in the user's
+// units.
+func workoutExerciseView(entries []WorkoutExercise, units string) []gin.H {
+	ids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.ExerciseID)
+	}
+	var exercises []Exercise
+	db.Where("id IN ?", ids).Find(&exercises)
+	names := map[int]string{}
+	for _, ex := range exercises {
+		names[ex.ID] = ex.Name
+	}
+	views := make([]gin.H, 0, len(entries))
+	for _, e := range entries {
+		volume, best := setStats(e.Sets)
+		volume, unit := massUnits.display(volume, units)
+		best, _ = massUnits.display(best, units)
+		displaySets(e.Sets, units)
+		views = append(views, gin.H{
+			"id":            e.ID,
+			"exercise_id":   e.ExerciseID,
+			"exercise":      names[e.ExerciseID],
+			"position":      e.Position,
+			"notes":         e.Notes,
+			"sets":          e.Sets,
+			"volume":        volume,
+			"estimated_1rm": best,
+			"weight_unit":   unit,
+			"working_sets":  countWorkingSets(e.Sets),
+		})
+	}
+	return views
+}
+
+func countWorkingSets(sets []ExerciseSet) int {
+	n := 0
+	for _, s := range sets {
+		if !s.Warmup {
+			n++
+		}
+	}
+	return n
+}
+
+func ownedWorkout(c *gin.Context, userID int) (Workout, bool) {
+	var workout Workout
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workout ID"})
+		return workout, false
+	}
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&workout).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workout not found"})
+		return workout, false
+	}
+	return workout, true
+}
+
+func getWorkoutExercises(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	workout, ok := ownedWorkout(c, userID)
+	if !ok {
+		return
+	}
+	entries, err := loadWorkoutExercises(workout.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, workoutExerciseView(entries, userUnits(userID)))
+}
+
+func validateSet(s *ExerciseSet, units string) error {
+	if s.Reps < 0 || s.Reps > 1000 {
+		return errors.New("reps must be between 0 and 1000")
+	}
+	weight, err := massUnits.toCanonical(s.Weight, s.WeightUnit, units)
+	if err != nil {
+		return err
+	}
+	if weight < 0 || weight > 1000 {
+		return errors.New("weight must be between 0 and 1000 kg")
+	}
+	s.Weight, s.WeightUnit = weight, ""
+	if s.RPE != nil && (*s.RPE < 1 || *s.RPE > 10) {
+		return errors.New("rpe must be between 1 and 10")
+	}
+	if s.RestSeconds < 0 || s.RestSeconds > 3600 {
+		return errors.New("rest_seconds must be between 0 and 3600")
+	}
+	return nil
+}
+
+// replaceWorkoutExercises swaps the whole exercise list of a workout for the
+// one in the body. Order in the arrays sets the positions; weights are read
+// in the user's units unless a set says otherwise.
+func replaceWorkoutExercises(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	workout, ok := ownedWorkout(c, userID)
+	if !ok {
+		return
+	}
+	var entries []WorkoutExercise
+	if err := c.ShouldBindJSON(&entries); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	units := userUnits(userID)
+	exerciseIDs := map[int]bool{}
+	totalSets := 0
+	for i := range entries {
+		e := &entries[i]
+		e.ID, e.WorkoutID, e.Position = 0, workout.ID, i+1
+		exerciseIDs[e.ExerciseID] = true
+		totalSets += len(e.Sets)
+		for j := range e.Sets {
+			s := &e.Sets[j]
+			s.ID, s.WorkoutExerciseID, s.Position = 0, 0, j+1
+			if err := validateSet(s, units); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("exercise %d, set %d: %v", i+1, j+1, err)})
+				return
+			}
+		}
+	}
+	if totalSets > maxSetsPerWorkout {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A workout can have at most %d sets", maxSetsPerWorkout)})
+		return
+	}
+	ids := make([]int, 0, len(exerciseIDs))
+	for id := range exerciseIDs {
+		ids = append(ids, id)
+	}
+	var known int64
+	visibleExercises(db.Model(&Exercise{}), userID).Where("id IN ?", ids).Count(&known)
+	if int(known) != len(ids) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown exercise"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("workout_exercise_id IN (?)",
+			tx.Model(&WorkoutExercise{}).Select("id").Where("workout_id = ?", workout.ID)).
+			Delete(&ExerciseSet{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("workout_id = ?", workout.ID).Delete(&WorkoutExercise{}).Error; err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		return tx.Create(&entries).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	updatePersonalRecords(userID, workout.ID)
+	c.JSON(http.StatusOK, workoutExerciseView(entries, units))
+}
+
+// deleteWorkoutExercises removes the strength log of deleted workouts.
+func deleteWorkoutExercises(tx *gorm.DB, workoutIDs ...int) error {
+	if err := tx.Where("workout_exercise_id IN (?)",
+		tx.Model(&WorkoutExercise{}).Select("id").Where("workout_id IN ?", workoutIDs)).
+		Delete(&ExerciseSet{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("workout_id IN ?", workoutIDs).Delete(&WorkoutExercise{}).Error
+}
+
+// exerciseSessions loads every logged session of an exercise for a user,
+// oldest first, with the workout each belongs to.
+func exerciseSessions(userID, exerciseID int) ([]WorkoutExercise, map[int]Workout, error) {
+	var workouts []Workout
+	if err := db.Where("user_id = ? AND id IN (?)", userID,
+		db.Model(&WorkoutExercise{}).Select("workout_id").Where("exercise_id = ?", exerciseID)).
+		Find(&workouts).Error; err != nil {
+		return nil, nil, err
+	}
+	byID := map[int]Workout{}
+	ids := make([]int, 0, len(workouts))
+	for _, w := range workouts {
+		byID[w.ID] = w
+		ids = append(ids, w.ID)
+	}
+	if len(ids) == 0 {
+		return nil, byID, nil
+	}
+	var entries []WorkoutExercise
+	if err := db.Where("exercise_id = ? AND workout_id IN ?", exerciseID, ids).
+		Preload("Sets", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).
+		Find(&entries).Error; err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := byID[entries[i].WorkoutID].CreatedAt, byID[entries[j].WorkoutID].CreatedAt
+		if a.Equal(b) {
+			return entries[i].Position < entries[j].Position
+		}
+		return a.Before(b)
+	})
+	return entries, byID, nil
+}
+
+// getExerciseHistory lists every session of an exercise, newest first, with
+// the sets done and their totals.
+func getExerciseHistory(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	exercise, ok := findExercise(c, userID)
+	if !ok {
+		return
+	}
+	entries, workouts, err := exerciseSessions(userID, exercise.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	units := userUnits(userID)
+	loc := userLocation(userID)
+	history := make([]gin.H, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		w := workouts[e.WorkoutID]
+		volume, best := setStats(e.Sets)
+		volume, unit := massUnits.display(volume, units)
+		best, _ = massUnits.display(best, units)
+		displaySets(e.Sets, units)
+		history = append(history, gin.H{
+			"workout_id":    w.ID,
+			"date":          localDate(w.CreatedAt, loc),
+			"notes":         e.Notes,
+			"sets":          e.Sets,
+			"volume":        volume,
+			"estimated_1rm": best,
+			"weight_unit":   unit,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"exercise": exercise, "sessions": history})
+}
+
+// getExerciseProgression returns one point per training day with the best
+// estimated 1RM, heaviest working set and total volume, plus the all-time
+// best 1RM.
+func getExerciseProgression(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	exercise, ok := findExercise(c, userID)
+	if !ok {
+		return
+	}
+	entries, workouts, err := exerciseSessions(userID, exercise.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	type day struct {
+		date                string
+		volume, best, heavy float64
+	}
+	loc := userLocation(userID)
+	var days []*day
+	byDate := map[string]*day{}
+	var allTime float64
+	for _, e := range entries {
+		date := localDate(workouts[e.WorkoutID].CreatedAt, loc)
+		d := byDate[date]
+		if d == nil {
+			d = &day{date: date}
+			byDate[date] = d
+			days = append(days, d)
+		}
+		volume, best := setStats(e.Sets)
+		d.volume += volume
+		d.best = math.Max(d.best, best)
+		for _, s := range e.Sets {
+			if !s.Warmup && s.Reps > 0 {
+				d.heavy = math.Max(d.heavy, s.Weight)
+			}
+		}
+		allTime = math.Max(allTime, best)
+	}
+	units := userUnits(userID)
+	unit := massUnits.preferredUnit(units)
+	points := make([]gin.H, 0, len(days))
+	for _, d := range days {
+		volume, _ := massUnits.display(d.volume, units)
+		best, _ := massUnits.display(d.best, units)
+		heavy, _ := massUnits.display(d.heavy, units)
+		points = append(points, gin.H{
+			"date":          d.date,
+			"estimated_1rm": best,
+			"top_weight":    heavy,
+			"volume":        volume,
+		})
+	}
+	best, _ := massUnits.display(allTime, units)
+	c.JSON(http.StatusOK, gin.H{
+		"exercise":    exercise,
+		"weight_unit": unit,
+		"best_1rm":    best,
+		"sessions":    len(entries),
+		"progression": points,
+	})
+}
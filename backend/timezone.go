@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTimeZone = "UTC"
+
+var locationCache = struct {
+	m map[string]*time.Location
+	sync.Mutex
+}{m: make(map[string]*time.Location)}
+
+// loadLocation resolves an IANA zone name, caching the result since the
+// zoneinfo lookup reads from disk.
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		name = defaultTimeZone
+	}
+	locationCache.Lock()
+	defer locationCache.Unlock()
+	if loc, ok := locationCache.m[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locationCache.m[name] = loc
+	return loc, nil
+}
+
+// validTimeZone accepts IANA names only; "Local" would mean the server's zone.
+func validTimeZone(name string) bool {
+	if name == "" || strings.EqualFold(name, "local") {
+		return false
+	}
+	_, err := loadLocation(name)
+	return err == nil
+}
+
+// locationOf falls back to UTC when a stored zone no longer resolves.
+func locationOf(name string) *time.Location {
+	loc, err := loadLocation(name)
+	if err != nil {
+		log.Printf("unknown time zone %q, using UTC", name)
+		return time.UTC
+	}
+	return loc
+}
+
+func userLocation(userID int) *time.Location {
+	var user User
+	if err := db.Select("id", "time_zone").First(&user, userID).Error; err != nil {
+		return time.UTC
+	}
+	return locationOf(user.TimeZone)
+}
+
+// startOfDay is local midnight of the day t falls on in loc. Days are built
+// with time.Date rather than by adding 24h so DST days come out as 23 or 25
+// hours long.
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// dayBounds returns the half-open range [start, end) of the local day that
+// lies offset days from t.
+func dayBounds(t time.Time, loc *time.Location, offset int) (time.Time, time.Time) {
+	t = t.In(loc)
+	start := time.Date(t.Year(), t.Month(), t.Day()+offset, 0, 0, 0, 0, loc)
+	end := time.Date(t.Year(), t.Month(), t.Day()+offset+1, 0, 0, 0, 0, loc)
+	return start, end
+}
+
+func localDate(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format(dateLayout)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newYork(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := loadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("zoneinfo not available: %v", err)
+	}
+	return loc
+}
+
+func TestDayBoundsAcrossDST(t *testing.T) {
+	loc := newYork(t)
+	tests := []struct {
+		name  string
+		at    time.Time
+		start string
+		end   string
+		hours float64
+	}{
+		{"spring forward", time.Date(2025, 3, 9, 12, 0, 0, 0, loc), "2025-03-09T00:00:00-05:00", "2025-03-10T00:00:00-04:00", 23},
+		{"fall back", time.Date(2025, 11, 2, 12, 0, 0, 0, loc), "2025-11-02T00:00:00-04:00", "2025-11-03T00:00:00-05:00", 25},
+		{"plain day", time.Date(2025, 6, 1, 12, 0, 0, 0, loc), "2025-06-01T00:00:00-04:00", "2025-06-02T00:00:00-04:00", 24},
+		{"late evening UTC input", time.Date(2025, 3, 10, 3, 30, 0, 0, time.UTC), "2025-03-09T00:00:00-05:00", "2025-03-10T00:00:00-04:00", 23},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := dayBounds(tt.at, loc, 0)
+			if got := start.Format(time.RFC3339); got != tt.start {
+				t.Errorf("start = %s, want %s", got, tt.start)
+			}
+			if got := end.Format(time.RFC3339); got != tt.end {
+				t.Errorf("end = %s, want %s", got, tt.end)
+			}
+			if got := end.Sub(start).Hours(); got != tt.hours {
+				t.Errorf("day is %v hours long, want %v", got, tt.hours)
+			}
+			if got := startOfDay(tt.at, loc); !got.Equal(start) {
+				t.Errorf("startOfDay = %s, want %s", got, start)
+			}
+		})
+	}
+}
+
+func TestDayBoundsOffsetAcrossDST(t *testing.T) {
+	loc := newYork(t)
+	// Counting back from the day after each change must land on its midnight.
+	start, end := dayBounds(time.Date(2025, 3, 10, 8, 0, 0, 0, loc), loc, -1)
+	if start.Format(time.RFC3339) != "2025-03-09T00:00:00-05:00" || end.Sub(start) != 23*time.Hour {
+		t.Errorf("spring day = [%s, %s)", start, end)
+	}
+	start, end = dayBounds(time.Date(2025, 11, 3, 8, 0, 0, 0, loc), loc, -1)
+	if start.Format(time.RFC3339) != "2025-11-02T00:00:00-04:00" || end.Sub(start) != 25*time.Hour {
+		t.Errorf("autumn day = [%s, %s)", start, end)
+	}
+}
+
+func TestLocalDateAcrossDST(t *testing.T) {
+	loc := newYork(t)
+	tests := []struct {
+		at   time.Time
+		want string
+	}{
+		{time.Date(2025, 3, 9, 4, 59, 0, 0, time.UTC), "2025-03-08"},  // 23:59 EST
+		{time.Date(2025, 3, 9, 5, 0, 0, 0, time.UTC), "2025-03-09"},   // 00:00 EST
+		{time.Date(2025, 3, 10, 3, 59, 0, 0, time.UTC), "2025-03-09"}, // 23:59 EDT
+		{time.Date(2025, 3, 10, 4, 0, 0, 0, time.UTC), "2025-03-10"},  // 00:00 EDT
+		{time.Date(2025, 11, 2, 3, 59, 0, 0, time.UTC), "2025-11-01"}, // 23:59 EDT
+		{time.Date(2025, 11, 2, 4, 0, 0, 0, time.UTC), "2025-11-02"},  // 00:00 EDT
+		{time.Date(2025, 11, 3, 4, 59, 0, 0, time.UTC), "2025-11-02"}, // 23:59 EST
+		{time.Date(2025, 11, 3, 5, 0, 0, 0, time.UTC), "2025-11-03"},  // 00:00 EST
+	}
+	for _, tt := range tests {
+		if got := localDate(tt.at, loc); got != tt.want {
+			t.Errorf("localDate(%s) = %s, want %s", tt.at.Format(time.RFC3339), got, tt.want)
+		}
+	}
+}
+
+// fires runs the reminder checker's loop minute by minute over the local
+// day holding day and returns when the reminder fired.
+func fires(r Reminder, loc *time.Location, day time.Time) []time.Time {
+	start, end := dayBounds(day, loc, 0)
+	var fired []time.Time
+	for since := start; since.Before(end); since = since.Add(time.Minute) {
+		now := since.Add(time.Minute)
+		if reminderDue(r, loc, since, now) {
+			fired = append(fired, now)
+		}
+	}
+	return fired
+}
+
+func TestReminderDueAcrossDST(t *testing.T) {
+	loc := newYork(t)
+	tests := []struct {
+		name string
+		time string
+		day  time.Time
+	}{
+		{"daily in the skipped hour", "02:30", time.Date(2025, 3, 9, 12, 0, 0, 0, loc)},
+		{"daily in the repeated hour", "01:30", time.Date(2025, 11, 2, 12, 0, 0, 0, loc)},
+		{"one-off in the skipped hour", "2025-03-09 02:30", time.Date(2025, 3, 9, 12, 0, 0, 0, loc)},
+		{"one-off in the repeated hour", "2025-11-02 01:30", time.Date(2025, 11, 2, 12, 0, 0, 0, loc)},
+		{"daily on a plain day", "07:00", time.Date(2025, 3, 9, 12, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fired := fires(Reminder{Time: tt.time}, loc, tt.day)
+			if len(fired) != 1 {
+				t.Fatalf("fired %d times (%v), want once", len(fired), fired)
+			}
+			if got := localDate(fired[0], loc); got != tt.day.Format(dateLayout) {
+				t.Errorf("fired on %s, want %s", got, tt.day.Format(dateLayout))
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxTrackUpload = 25 << 20
+	maxTrackPoints = 100000
+	earthRadius    = 6371008.8 // metres
+	// Climbs smaller than this are treated as GPS/barometer noise.
+	elevationNoise = 3.0
+)
+
+// TrackPoint is one sample of an imported workout's recording. Indoor
+// recordings have no position, only time and sensor values.
+type TrackPoint struct {
+	ID        int        `json:"-" gorm:"primaryKey;autoIncrement"`
+	WorkoutID int        `json:"-" gorm:"index;not null"`
+	Seq       int        `json:"seq" gorm:"not null"`
+	Time      *time.Time `json:"time"`
+	Lat       *float64   `json:"lat"`
+	Lon       *float64   `json:"lon"`
+	Elevation *float64   `json:"elevation"` // metres
+	HeartRate *int       `json:"heart_rate"`
+	Cadence   *int       `json:"cadence"`
+	Distance  *float64   `json:"distance"` // cumulative metres, as recorded by the device
+}
+
+// parsedTrack is what the GPX, TCX and FIT readers hand back.
+type parsedTrack struct {
+	Name   string
+	Sport  string
+	Points []TrackPoint
+}
+
+type trackStats struct {
+	Start         *time.Time
+	Seconds       int
+	Distance      float64
+	ElevationGain float64
+	AvgHeartRate  int
+	MaxHeartRate  int
+}
+
+type gpxFile struct {
+	Name   string `xml:"metadata>name"`
+	Tracks []struct {
+		Name     string `xml:"name"`
+		Type     string `xml:"type"`
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+type gpxPoint struct {
+	Lat       float64  `xml:"lat,attr"`
+	Lon       float64  `xml:"lon,attr"`
+	Elevation *float64 `xml:"ele"`
+	Time      string   `xml:"time"`
+	HeartRate *int     `xml:"extensions>TrackPointExtension>hr"`
+	Cadence   *int     `xml:"extensions>TrackPointExtension>cad"`
+}
+
+type tcxFile struct {
+	Activities []struct {
+		Sport string `xml:"Sport,attr"`
+		Laps  []struct {
+			Points []struct {
+				Time      string   `xml:"Time"`
+				Lat       *float64 `xml:"Position>LatitudeDegrees"`
+				Lon       *float64 `xml:"Position>LongitudeDegrees"`
+				Elevation *float64 `xml:"AltitudeMeters"`
+				Distance  *float64 `xml:"DistanceMeters"`
+				HeartRate *int     `xml:"HeartRateBpm>Value"`
+				Cadence   *int     `xml:"Cadence"`
+			} `xml:"Track>Trackpoint"`
+		} `xml:"Lap"`
+	} `xml:"Activities>Activity"`
+}
+
+// trackSports maps the activity names used by GPX and TCX writers to
+// workout types.
+var trackSports = map[string]string{
+	"running": "running", "run": "running", "trail_running": "running",
+	"biking": "cycling", "cycling": "cycling", "ride": "cycling", "bike": "cycling",
+	"walking": "walking", "walk": "walking",
+	"hiking": "hiking", "hike": "hiking",
+	"swimming": "swimming", "swim": "swimming",
+	"rowing": "rowing", "skiing": "skiing",
+}
+
+func parseTrackTime(s string) *time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+func parseGPX(data []byte) (*parsedTrack, error) {
+	var f gpxFile
+	if err := xml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid GPX file: %v", err)
+	}
+	track := &parsedTrack{Name: f.Name}
+	for _, trk := range f.Tracks {
+		if track.Name == "" {
+			track.Name = trk.Name
+		}
+		if track.Sport == "" {
+			track.Sport = trk.Type
+		}
+		for _, seg := range trk.Segments {
+			for _, p := range seg.Points {
+				lat, lon := p.Lat, p.Lon
+				track.Points = append(track.Points, TrackPoint{
+					Time: parseTrackTime(p.Time), Lat: &lat, Lon: &lon,
+					Elevation: p.Elevation, HeartRate: p.HeartRate, Cadence: p.Cadence,
+				})
+			}
+		}
+	}
+	return track, nil
+}
+
+func parseTCX(data []byte) (*parsedTrack, error) {
+	var f tcxFile
+	if err := xml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid TCX file: %v", err)
+	}
+	track := &parsedTrack{}
+	for _, a := range f.Activities {
+		if track.Sport == "" {
+			track.Sport = a.Sport
+		}
+		for _, lap := range a.Laps {
+			for _, p := range lap.Points {
+				track.Points = append(track.Points, TrackPoint{
+					Time: parseTrackTime(p.Time), Lat: p.Lat, Lon: p.Lon, Elevation: p.Elevation,
+					HeartRate: p.HeartRate, Cadence: p.Cadence, Distance: p.Distance,
+				})
+			}
+		}
+	}
+	return track, nil
+}
+
+// parseTrackFile picks the reader from the file name, or from the content
+// when the extension is missing or unfamiliar.
+func parseTrackFile(name string, data []byte) (*parsedTrack, string, error) {
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	if format != "gpx" && format != "tcx" && format != "fit" {
+		head := data
+		if len(head) > 512 {
+			head = head[:512]
+		}
+		switch {
+		case len(data) >= 12 && string(data[8:12]) == ".FIT":
+			format = "fit"
+		case bytes.Contains(head, []byte("<gpx")):
+			format = "gpx"
+		case bytes.Contains(head, []byte("<TrainingCenterDatabase")):
+			format = "tcx"
+		default:
+			return nil, "", errors.New("unsupported file, expected GPX, TCX or FIT")
+		}
+	}
+	var track *parsedTrack
+	var err error
+	switch format {
+	case "gpx":
+		track, err = parseGPX(data)
+	case "tcx":
+		track, err = parseTCX(data)
+	default:
+		track, err = parseFIT(data)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if len(track.Points) == 0 {
+		return nil, "", errors.New("file contains no track points")
+	}
+	if len(track.Points) > maxTrackPoints {
+		return nil, "", fmt.Errorf("file has more than %d track points", maxTrackPoints)
+	}
+	for i := range track.Points {
+		p := &track.Points[i]
+		p.Seq = i
+		if p.Lat != nil && p.Lon != nil && (math.Abs(*p.Lat) > 90 || math.Abs(*p.Lon) > 180) {
+			return nil, "", fmt.Errorf("track point %d has invalid coordinates", i)
+		}
+	}
+	return track, format, nil
+}
+
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// computeTrackStats derives the workout totals. Distance recorded by the
+// device (wheel sensor, footpod) wins over distance measured along the
+// positions.
+func computeTrackStats(points []TrackPoint) trackStats {
+	var s trackStats
+	var first, last *time.Time
+	var measured, firstDist, lastDist float64
+	haveDist := false
+	var prevLat, prevLon *float64
+	var ref *float64
+	hrSum, hrCount := 0, 0
+	for i := range points {
+		p := &points[i]
+		if p.Time != nil {
+			if first == nil {
+				first = p.Time
+			}
+			last = p.Time
+		}
+		if p.Lat != nil && p.Lon != nil {
+			if prevLat != nil {
+				measured += haversine(*prevLat, *prevLon, *p.Lat, *p.Lon)
+			}
+			prevLat, prevLon = p.Lat, p.Lon
+		}
+		if p.Distance != nil {
+			if !haveDist {
+				firstDist, haveDist = *p.Distance, true
+			}
+			lastDist = *p.Distance
+		}
+		if p.Elevation != nil {
+			switch {
+			case ref == nil || *p.Elevation < *ref:
+				ref = p.Elevation
+			case *p.Elevation-*ref >= elevationNoise:
+				s.ElevationGain += *p.Elevation - *ref
+				ref = p.Elevation
+			}
+		}
+		if p.HeartRate != nil && *p.HeartRate > 0 {
+			hrSum += *p.HeartRate
+			hrCount++
+			if *p.HeartRate > s.MaxHeartRate {
+				s.MaxHeartRate = *p.HeartRate
+			}
+		}
+	}
+	s.Distance = measured
+	if haveDist && lastDist > firstDist {
+		s.Distance = lastDist - firstDist
+	}
+	if first != nil {
+		s.Start = first
+		s.Seconds = int(last.Sub(*first).Seconds())
+	}
+	if hrCount > 0 {
+		s.AvgHeartRate = int(math.Round(float64(hrSum) / float64(hrCount)))
+	}
+	s.ElevationGain = math.Round(s.ElevationGain)
+	s.Distance = math.Round(s.Distance*10) / 10
+	return s
+}
+
+// importWorkout creates a workout from an uploaded GPX, TCX or FIT file.
+// Optional form fields type, category, intensity and location override what
+// the file says.
+func importWorkout(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxTrackUpload)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload the recording as the multipart field \"file\""})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	track, format, err := parseTrackFile(header.Filename, data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stats := computeTrackStats(track.Points)
+
+	workout := Workout{
+		UserID:        userID,
+		Type:          c.PostForm("type"),
+		Category:      c.DefaultPostForm("category", "cardio"),
+		Intensity:     c.DefaultPostForm("intensity", "medium"),
+		Location:      c.PostForm("location"),
+		Duration:      int(math.Round(float64(stats.Seconds) / 60)),
+		Distance:      stats.Distance,
+		ElevationGain: stats.ElevationGain,
+		AvgHeartRate:  stats.AvgHeartRate,
+		MaxHeartRate:  stats.MaxHeartRate,
+		ElapsedTime:   stats.Seconds,
+		Source:        format,
+		StartedAt:     stats.Start,
+	}
+	if workout.Type == "" {
+		workout.Type = trackSports[normalizeKey(track.Sport)]
+		if workout.Type == "" {
+			workout.Type = "other"
+		}
+	}
+	if workout.Location == "" {
+		workout.Location = track.Name
+	}
+	if workout.Location == "" {
+		workout.Location = "unspecified"
+	}
+	if stats.Start != nil {
+		// The workout belongs to the day it was recorded, not uploaded.
+		workout.CreatedAt = *stats.Start
+	}
+	var user User
+	if err := db.First(&user, userID).Error; err == nil {
+		applyCalorieEstimate(&workout, nil, user)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&workout).Error; err != nil {
+			return err
+		}
+		for i := range track.Points {
+			track.Points[i].WorkoutID = workout.ID
+		}
+		if err := tx.CreateInBatches(track.Points, 1000).Error; err != nil {
+			return err
+		}
+		return createWorkoutEfforts(tx, workout.ID, track.Points)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	checkAndAwardBadges(userID)
+	updatePersonalRecords(userID, workout.ID)
+	refreshCalorieGoal(userID, "workout")
+	linkScheduledSession(workout)
+	displayWorkout(&workout, userUnits(userID))
+	c.JSON(http.StatusCreated, workout)
+}
+
+// getWorkoutRoute returns the positions of an imported workout as a GeoJSON
+// LineString feature. max_points thins long recordings evenly.
+func getWorkoutRoute(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workout ID"})
+		return
+	}
+	var workout Workout
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&workout).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workout not found"})
+		return
+	}
+	var points []TrackPoint
+	if err := db.Where("workout_id = ? AND lat IS NOT NULL AND lon IS NOT NULL", workout.ID).
+		Order("seq").Find(&points).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(points) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workout has no route"})
+		return
+	}
+	if max, err := strconv.Atoi(c.Query("max_points")); err == nil && max >= 2 && len(points) > max {
+		thinned := make([]TrackPoint, 0, max)
+		step := float64(len(points)-1) / float64(max-1)
+		for i := 0; i < max; i++ {
+			thinned = append(thinned, points[int(math.Round(float64(i)*step))])
+		}
+		points = thinned
+	}
+
+	coords := make([][]float64, 0, len(points))
+	times := make([]*time.Time, 0, len(points))
+	minLon, minLat, maxLon, maxLat := 180.0, 90.0, -180.0, -90.0
+	for _, p := range points {
+		coord := []float64{*p.Lon, *p.Lat}
+		if p.Elevation != nil {
+			coord = append(coord, *p.Elevation)
+		}
+		coords = append(coords, coord)
+		times = append(times, p.Time)
+		minLon, maxLon = math.Min(minLon, *p.Lon), math.Max(maxLon, *p.Lon)
+		minLat, maxLat = math.Min(minLat, *p.Lat), math.Max(maxLat, *p.Lat)
+	}
+	displayWorkout(&workout, userUnits(userID))
+	c.JSON(http.StatusOK, gin.H{
+		"type": "Feature",
+		"bbox": []float64{minLon, minLat, maxLon, maxLat},
+		"geometry": gin.H{
+			"type":        "LineString",
+			"coordinates": coords,
+		},
+		"properties": gin.H{
+			"workout_id":     workout.ID,
+			"workout_type":   workout.Type,
+			"distance":       workout.Distance,
+			"distance_unit":  workout.DistanceUnit,
+			"elevation_gain": workout.ElevationGain,
+			"elevation_unit": workout.ElevationUnit,
+			"started_at":     workout.StartedAt,
+			"times":          times,
+		},
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Unit systems a user can pick in Settings. Values are always stored in the
+// canonical metric unit of their quantity and converted at the edges.
+const (
+	UnitsMetric   = "metric"
+	UnitsImperial = "imperial"
+)
+
+// quantity converts between the units accepted for one kind of value.
+// factors maps each unit to its size in canonical units.
+type quantity struct {
+	name      string
+	canonical string
+	metric    string // unit shown to metric users
+	imperial  string // unit shown to imperial users
+	precision int    // decimals kept when displaying
+	factors   map[string]float64
+}
+
+var (
+	massUnits = quantity{
+		name: "weight", canonical: "kg", metric: "kg", imperial: "lb", precision: 1,
+		factors: map[string]float64{"kg": 1, "lb": 0.45359237},
+	}
+	heightUnits = quantity{
+		name: "height", canonical: "cm", metric: "cm", imperial: "in", precision: 1,
+		factors: map[string]float64{"cm": 1, "m": 100, "in": 2.54, "ft": 30.48},
+	}
+	volumeUnits = quantity{
+		name: "volume", canonical: "ml", metric: "ml", imperial: "fl_oz", precision: 1,
+		factors: map[string]float64{"ml": 1, "l": 1000, "fl_oz": 29.5735295625},
+	}
+	distanceUnits = quantity{
+		name: "distance", canonical: "m", metric: "km", imperial: "mi", precision: 2,
+		factors: map[string]float64{"m": 1, "km": 1000, "mi": 1609.344, "yd": 0.9144},
+	}
+	elevationUnits = quantity{
+		name: "elevation", canonical: "m", metric: "m", imperial: "ft", precision: 0,
+		factors: map[string]float64{"m": 1, "ft": 0.3048},
+	}
+)
+
+func validUnits(units string) bool {
+	return units == UnitsMetric || units == UnitsImperial
+}
+
+// preferredUnit is the display unit of q for the given unit system.
+func (q quantity) preferredUnit(units string) string {
+	if units == UnitsImperial {
+		return q.imperial
+	}
+	return q.metric
+}
+
+// toCanonical reads v given in unit, or in the user's preferred unit when
+// the payload did not say.
+func (q quantity) toCanonical(v float64, unit, units string) (float64, error) {
+	if unit == "" {
+		unit = q.preferredUnit(units)
+	}
+	factor, ok := q.factors[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported %s unit %q", q.name, unit)
+	}
+	return v * factor, nil
+}
+
+// fromInput is toCanonical for updates: when the client echoes back exactly
+// what display showed for the stored value, the stored value is kept so a
+// round trip through another unit does not drift.
+func (q quantity) fromInput(v float64, unit, units string, stored *float64) (float64, error) {
+	if stored != nil {
+		shown, shownUnit := q.display(*stored, units)
+		if v == shown && (unit == "" || unit == shownUnit) {
+			return *stored, nil
+		}
+	}
+	return q.toCanonical(v, unit, units)
+}
+
+// display converts a canonical value to the preferred unit, rounded for
+// presentation.
+func (q quantity) display(v float64, units string) (float64, string) {
+	unit := q.preferredUnit(units)
+	return roundTo(v/q.factors[unit], q.precision), unit
+}
+
+func roundTo(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
+
+// userUnits returns the unit system from the user's settings, metric by
+// default.
+func userUnits(userID int) string {
+	var settings Settings
+	if err := db.Select("user_id", "units").Where("user_id = ?", userID).Limit(1).Find(&settings).Error; err != nil || !validUnits(settings.Units) {
+		return UnitsMetric
+	}
+	return settings.Units
+}
+
+// feetAndInches renders a height in cm as e.g. 5'9".
+func feetAndInches(cm float64) string {
+	inches := int(math.Round(cm / 2.54))
+	return fmt.Sprintf("%d'%d\"", inches/12, inches%12)
+}
+
+// displayUser converts a stored user to the viewer's units.
+func displayUser(u *User, units string) {
+	height := u.Height
+	u.Weight, u.WeightUnit = massUnits.display(u.Weight, units)
+	u.Height, u.HeightUnit = heightUnits.display(height, units)
+	if units == UnitsImperial {
+		u.HeightFtIn = feetAndInches(height)
+	}
+}
+
+// canonicalUser converts weight and height from the annotated (or preferred)
+// units back to kg and cm; prev is the stored user on updates. HeightFt and
+// HeightIn, when given, take precedence over Height.
+func canonicalUser(u *User, prev *User, units string) error {
+	var storedWeight, storedHeight *float64
+	if prev != nil {
+		storedWeight, storedHeight = &prev.Weight, &prev.Height
+	}
+	var err error
+	if u.Weight, err = massUnits.fromInput(u.Weight, u.WeightUnit, units, storedWeight); err != nil {
+		return err
+	}
+	if u.HeightFt != 0 || u.HeightIn != 0 {
+		u.Height = (u.HeightFt*12 + u.HeightIn) * heightUnits.factors["in"]
+	} else if u.Height, err = heightUnits.fromInput(u.Height, u.HeightUnit, units, storedHeight); err != nil {
+		return err
+	}
+	u.WeightUnit, u.HeightUnit, u.HeightFtIn, u.HeightFt, u.HeightIn = "", "", "", 0, 0
+	return nil
+}
+
+func displayWater(w *WaterIntake, units string) {
+	w.Amount, w.Unit = volumeUnits.display(w.Amount, units)
+}
+
+func canonicalWater(w *WaterIntake, prev *WaterIntake, units string) error {
+	var stored *float64
+	if prev != nil {
+		stored = &prev.Amount
+	}
+	var err error
+	w.Amount, err = volumeUnits.fromInput(w.Amount, w.Unit, units, stored)
+	w.Unit = ""
+	return err
+}
+
+// displayWorkout converts distance and climb, and adds the average pace
+// (seconds per km or mile) when the workout covered a distance.
+func displayWorkout(w *Workout, units string) {
+	metres := w.Distance
+	w.Distance, w.DistanceUnit = distanceUnits.display(metres, units)
+	w.ElevationGain, w.ElevationUnit = elevationUnits.display(w.ElevationGain, units)
+	seconds := w.ElapsedTime
+	if seconds == 0 {
+		seconds = w.Duration * 60
+	}
+	if metres > 0 && seconds > 0 {
+		w.Pace = math.Round(float64(seconds) / (metres / distanceUnits.factors[w.DistanceUnit]))
+		w.PaceUnit = "s/" + w.DistanceUnit
+	}
+}
+
+func canonicalWorkout(w *Workout, prev *Workout, units string) error {
+	var storedDistance, storedElevation *float64
+	if prev != nil {
+		storedDistance, storedElevation = &prev.Distance, &prev.ElevationGain
+		// A hand-edited duration replaces the recorded one.
+		if w.Duration != prev.Duration && w.ElapsedTime == prev.ElapsedTime {
+			w.ElapsedTime = 0
+		}
+	}
+	var err error
+	if w.Distance, err = distanceUnits.fromInput(w.Distance, w.DistanceUnit, units, storedDistance); err != nil {
+		return err
+	}
+	w.ElevationGain, err = elevationUnits.fromInput(w.ElevationGain, w.ElevationUnit, units, storedElevation)
+	w.DistanceUnit, w.ElevationUnit, w.Pace, w.PaceUnit = "", "", 0, ""
+	return err
+}
+
+// displayHealthRecord converts metrics that have an imperial unit; the rest
+// are shown as stored.
+func displayHealthRecord(r *HealthRecord, units string) {
+	def, ok := lookupMetric(r.Type)
+	if !ok || def.convert == nil || r.NumericValue == nil {
+		return
+	}
+	v, unit := def.convert.display(*r.NumericValue, units)
+	r.NumericValue = &v
+	r.Value = formatMetricNumber(v)
+	r.Unit = unit
+}
+
+// displaySettings shows the water goal in the settings' own unit system,
+// rounded to a whole number.
+func displaySettings(s *Settings) {
+	if !validUnits(s.Units) {
+		s.Units = UnitsMetric
+	}
+	goal, unit := volumeUnits.display(float64(s.WaterGoal), s.Units)
+	s.WaterGoal, s.WaterGoalUnit = int(math.Round(goal)), unit
+}
+
+// canonicalWaterGoal reads a water goal shown by displaySettings back to ml.
+func canonicalWaterGoal(goal int, unit string, stored Settings) (int, error) {
+	units := stored.Units
+	if !validUnits(units) {
+		units = UnitsMetric
+	}
+	shown, shownUnit := volumeUnits.display(float64(stored.WaterGoal), units)
+	if float64(goal) == math.Round(shown) && (unit == "" || unit == shownUnit) {
+		return stored.WaterGoal, nil
+	}
+	ml, err := volumeUnits.toCanonical(float64(goal), unit, units)
+	return int(math.Round(ml)), err
+}
@@ -70,6 +70,7 @@ class _MyAppState extends State<MyApp> {
   Future<void> _logout() async {
     final prefs = await SharedPreferences.getInstance();
     await prefs.remove('jwt');
+    await prefs.remove('refresh_token');
     setState(() {
       _isAuthenticated = false;
       _showLogin = true;
@@ -125,16 +125,50 @@ class Reminder {
   };
 }
 
+// Access tokens are short-lived. When a request with a bearer token comes
+// back 401 the client trades the stored refresh token for a new pair once
+// and retries the request with the new access token.
+class _AuthClient extends http.BaseClient {
+  final http.Client _inner = http.Client();
+  Future<String?>? _refreshing;
+
+  @override
+  Future<http.StreamedResponse> send(http.BaseRequest request) async {
+    final body = request is http.Request ? request.bodyBytes : null;
+    final response = await _inner.send(request);
+    if (response.statusCode != 401 ||
+        body == null ||
+        !request.headers.containsKey('Authorization')) {
+      return response;
+    }
+    // Requests that fail together share one refresh: the old refresh token
+    // is spent by the first.
+    final token = await (_refreshing ??= ApiService()
+        ._refreshTokens()
+        .whenComplete(() => _refreshing = null));
+    if (token == null) {
+      return response;
+    }
+    await response.stream.drain();
+    final retry = http.Request(request.method, request.url)
+      ..headers.addAll(request.headers)
+      ..headers['Authorization'] = 'Bearer $token'
+      ..bodyBytes = body;
+    return _inner.send(retry);
+  }
+}
+
 class ApiService {
   static final ApiService _instance = ApiService._internal();
   factory ApiService() => _instance;
   ApiService._internal();
 
   static const String baseUrl = 'http://localhost:8080';
+  final http.Client _http = _AuthClient();
   int? currentUserId;
 
   Future<bool> register(String name, String email, String password) async {
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/register'),
       headers: {'Content-Type': 'application/json'},
       body: json.encode({'name': name, 'email': email, 'password': password}),
@@ -143,7 +177,7 @@ class ApiService {
   }
 
   Future<String?> login(String email, String password) async {
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/login'),
       headers: {'Content-Type': 'application/json'},
       body: json.encode({'email': email, 'password': password}),
@@ -151,8 +185,7 @@ class ApiService {
     if (response.statusCode == 200) {
       final data = json.decode(response.body);
       final token = data['token'];
-      final prefs = await SharedPreferences.getInstance();
-      await prefs.setString('jwt', token);
+      await _saveTokens(data);
       print('Token saved: $token'); // Debug print
       return token;
     } else {
@@ -161,6 +194,39 @@ class ApiService {
     }
   }
 
+  Future<void> _saveTokens(Map<String, dynamic> data) async {
+    final prefs = await SharedPreferences.getInstance();
+    await prefs.setString('jwt', data['token']);
+    if (data['refresh_token'] != null) {
+      await prefs.setString('refresh_token', data['refresh_token']);
+    }
+  }
+
+  // _refreshTokens swaps the stored refresh token for a new token pair and
+  // returns the new access token, or null when the session is gone.
+  Future<String?> _refreshTokens() async {
+    final prefs = await SharedPreferences.getInstance();
+    final refreshToken = prefs.getString('refresh_token');
+    if (refreshToken == null) {
+      return null;
+    }
+    final response = await http.post(
+      Uri.parse('$baseUrl/token/refresh'),
+      headers: {'Content-Type': 'application/json'},
+      body: json.encode({'refresh_token': refreshToken}),
+    );
+    if (response.statusCode != 200) {
+      print('Token refresh failed with status: ${response.statusCode}'); // Debug print
+      if (response.statusCode == 401) {
+        await prefs.remove('refresh_token');
+      }
+      return null;
+    }
+    final data = json.decode(response.body);
+    await _saveTokens(data);
+    return data['token'];
+  }
+
   Future<String?> getToken() async {
     final prefs = await SharedPreferences.getInstance();
     final token = prefs.getString('jwt');
@@ -170,8 +236,8 @@ class ApiService {
 
   Future<List<User>> fetchUsers() async {
     final token = await getToken();
-    final response = await http.get(
-      Uri.parse('$baseUrl/users'),
+    final response = await _http.get(
+      Uri.parse('$baseUrl/admin/users'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
     if (response.statusCode == 200) {
@@ -184,7 +250,7 @@ class ApiService {
 
   Future<List<Workout>> fetchWorkouts() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/workouts'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -198,7 +264,7 @@ class ApiService {
 
   Future<List<WaterIntake>> fetchWaterIntakes() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/water'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -212,7 +278,7 @@ class ApiService {
 
   Future<List<DietEntry>> fetchDietEntries() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/diet'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -226,7 +292,7 @@ class ApiService {
 
   Future<List<Period>> fetchPeriods() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/periods'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -240,7 +306,7 @@ class ApiService {
 
   Future<List<Award>> fetchAwards() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/awards'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -256,7 +322,7 @@ class ApiService {
 
   Future<List<HealthRecord>> fetchHealthRecords() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/healthrecords'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -270,7 +336,7 @@ class ApiService {
 
   Future<Reminder?> createReminder(Reminder reminder) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/reminders'),
       headers: {
         'Content-Type': 'application/json',
@@ -287,7 +353,7 @@ class ApiService {
 
   Future<Reminder?> updateReminder(Reminder reminder) async {
     final token = await getToken();
-    final response = await http.put(
+    final response = await _http.put(
       Uri.parse('$baseUrl/reminders/${reminder.id}'),
       headers: {
         'Content-Type': 'application/json',
@@ -308,7 +374,7 @@ class ApiService {
 
   Future<bool> deleteReminder(int id) async {
     final token = await getToken();
-    final response = await http.delete(
+    final response = await _http.delete(
       Uri.parse('$baseUrl/reminders/$id'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -317,7 +383,7 @@ class ApiService {
 
   Future<User?> getMe() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/me'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -330,7 +396,7 @@ class ApiService {
 
   Future<User?> updateMe(String name, String email, double weight, int age, String sex, double height) async {
     final token = await getToken();
-    final response = await http.put(
+    final response = await _http.put(
       Uri.parse('$baseUrl/me'),
       headers: {
         'Content-Type': 'application/json',
@@ -354,7 +420,7 @@ class ApiService {
   Future<Settings?> getSettings() async {
     final token = await getToken();
     print('Getting settings with token: $token'); // Debug print
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/settings'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -369,7 +435,7 @@ class ApiService {
 
   Future<Settings?> updateSettings(Settings settings) async {
     final token = await getToken();
-    final response = await http.put(
+    final response = await _http.put(
       Uri.parse('$baseUrl/settings'),
       headers: {
         'Content-Type': 'application/json',
@@ -386,7 +452,7 @@ class ApiService {
 
   Future<Workout?> createWorkout(Workout workout) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/workouts'),
       headers: {
         'Content-Type': 'application/json',
@@ -421,7 +487,7 @@ class ApiService {
 
   Future<Workout?> updateWorkout(Workout workout) async {
     final token = await getToken();
-    final response = await http.put(
+    final response = await _http.put(
       Uri.parse('$baseUrl/workouts/${workout.id}'),
       headers: {
         'Content-Type': 'application/json',
@@ -444,7 +510,7 @@ class ApiService {
 
   Future<bool> deleteWorkout(int id) async {
     final token = await getToken();
-    final response = await http.delete(
+    final response = await _http.delete(
       Uri.parse('$baseUrl/workouts/$id'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -453,7 +519,7 @@ class ApiService {
 
   Future<WaterIntake?> createWaterIntake(WaterIntake waterIntake) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/water'),
       headers: {
         'Content-Type': 'application/json',
@@ -472,7 +538,7 @@ class ApiService {
 
   Future<WaterIntake?> updateWaterIntake(WaterIntake waterIntake) async {
     final token = await getToken();
-    final response = await http.put(
+    final response = await _http.put(
       Uri.parse('$baseUrl/water/${waterIntake.id}'),
       headers: {
         'Content-Type': 'application/json',
@@ -491,7 +557,7 @@ class ApiService {
 
   Future<bool> deleteWaterIntake(int id) async {
     final token = await getToken();
-    final response = await http.delete(
+    final response = await _http.delete(
       Uri.parse('$baseUrl/water/$id'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -500,7 +566,7 @@ class ApiService {
 
   Future<DietEntry?> createDietEntry(DietEntry dietEntry) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/diet'),
       headers: {
         'Content-Type': 'application/json',
@@ -531,7 +597,7 @@ class ApiService {
 
   Future<DietEntry?> updateDietEntry(DietEntry dietEntry) async {
     final token = await getToken();
-    final response = await http.put(
+    final response = await _http.put(
       Uri.parse('$baseUrl/diet/${dietEntry.id}'),
       headers: {
         'Content-Type': 'application/json',
@@ -552,7 +618,7 @@ class ApiService {
 
   Future<bool> deleteDietEntry(int id) async {
     final token = await getToken();
-    final response = await http.delete(
+    final response = await _http.delete(
       Uri.parse('$baseUrl/diet/$id'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -561,7 +627,7 @@ class ApiService {
 
   Future<Period?> createPeriod(Period period) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/periods'),
       headers: {
         'Content-Type': 'application/json',
@@ -581,7 +647,7 @@ class ApiService {
 
   Future<Period?> updatePeriod(Period period) async {
     final token = await getToken();
-    final response = await http.put(
+    final response = await _http.put(
       Uri.parse('$baseUrl/periods/${period.id}'),
       headers: {
         'Content-Type': 'application/json',
@@ -601,7 +667,7 @@ class ApiService {
 
   Future<bool> deletePeriod(int id) async {
     final token = await getToken();
-    final response = await http.delete(
+    final response = await _http.delete(
       Uri.parse('$baseUrl/periods/$id'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -610,7 +676,7 @@ class ApiService {
 
   Future<HealthRecord?> createHealthRecord(HealthRecord record) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/healthrecords'),
       headers: {
         'Content-Type': 'application/json',
@@ -631,7 +697,7 @@ class ApiService {
 
   Future<HealthRecord?> updateHealthRecord(HealthRecord record) async {
     final token = await getToken();
-    final response = await http.put(
+    final response = await _http.put(
       Uri.parse('$baseUrl/healthrecords/${record.id}'),
       headers: {
         'Content-Type': 'application/json',
@@ -652,7 +718,7 @@ class ApiService {
 
   Future<bool> deleteHealthRecord(int id) async {
     final token = await getToken();
-    final response = await http.delete(
+    final response = await _http.delete(
       Uri.parse('$baseUrl/healthrecords/$id'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -661,7 +727,7 @@ class ApiService {
 
   Future<List<User>> searchUsers(String query) async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('${ApiService.baseUrl}/users/search?q=$query'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -677,7 +743,7 @@ class ApiService {
     final token = await getToken();
     print('Sending friend request with token: $token'); // Debug print
     print('Request body: ${json.encode({'to_user_id': toUserId})}'); // Debug print
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('${ApiService.baseUrl}/friends/request'),
       headers: {
         'Content-Type': 'application/json',
@@ -694,7 +760,7 @@ class ApiService {
 
   Future<Map<String, dynamic>> getFriendRequests() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('${ApiService.baseUrl}/friends/requests'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -707,7 +773,7 @@ class ApiService {
 
   Future<void> acceptFriendRequest(int requestId) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('${ApiService.baseUrl}/friends/accept'),
       headers: {
         'Content-Type': 'application/json',
@@ -722,7 +788,7 @@ class ApiService {
 
   Future<void> rejectFriendRequest(int requestId) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('${ApiService.baseUrl}/friends/reject'),
       headers: {
         'Content-Type': 'application/json',
@@ -737,7 +803,7 @@ class ApiService {
 
   Future<List<User>> getFriendsList() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('${ApiService.baseUrl}/friends/list'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -751,7 +817,7 @@ class ApiService {
 
   Future<List<dynamic>> getFriendsFeed() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('${ApiService.baseUrl}/feed/friends'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -764,7 +830,7 @@ class ApiService {
 
   Future<List<Message>> getChatHistory(int friendId) async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/chat/$friendId'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -778,7 +844,7 @@ class ApiService {
 
   Future<void> sendChatMessage(int friendId, String content) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/chat/$friendId'),
       headers: {
         'Content-Type': 'application/json',
@@ -793,7 +859,7 @@ class ApiService {
 
   Future<List<Streak>> fetchStreaks() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/streaks'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -807,7 +873,7 @@ class ApiService {
 
   Future<Map<String, dynamic>?> fetchStreakRanking(String streakType) async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/streaks/rankings?type=$streakType'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -820,7 +886,7 @@ class ApiService {
 
   Future<List<Reminder>> fetchReminders() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/reminders'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -834,7 +900,7 @@ class ApiService {
 
   Future<HealthRecord?> createStepsRecord(int steps) async {
     final token = await getToken();
-    final response = await http.post(
+    final response = await _http.post(
       Uri.parse('$baseUrl/healthrecords'),
       headers: {
         'Content-Type': 'application/json',
@@ -855,7 +921,7 @@ class ApiService {
 
   Future<List<Friend>> fetchFriends() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/friends'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -868,7 +934,7 @@ class ApiService {
 
   Future<void> postActivity({required String type, required Map<String, dynamic> data, bool isPublic = true}) async {
     final token = await getToken();
-    await http.post(
+    await _http.post(
       Uri.parse('$baseUrl/activity'),
       headers: {
         'Content-Type': 'application/json',
@@ -884,7 +950,7 @@ class ApiService {
 
   Future<Map<String, dynamic>> fetchWeeklySummary() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/summary/weekly'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -897,7 +963,7 @@ class ApiService {
 
   Future<Map<String, dynamic>> fetchMonthlySummary() async {
     final token = await getToken();
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('$baseUrl/summary/monthly'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -913,7 +979,7 @@ extension ApiServiceSettings on ApiService {
   Future<Settings?> fetchSettings() async {
     final token = await getToken();
     print('Getting settings with token: $token'); // Debug print
-    final response = await http.get(
+    final response = await _http.get(
       Uri.parse('${ApiService.baseUrl}/settings'),
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -928,7 +994,7 @@ extension ApiServiceSettings on ApiService {
 
   Future<Settings?> updateSettings(Settings settings) async {
     final token = await getToken();
-    final response = await http.put(
+    final response = await _http.put(
       Uri.parse('${ApiService.baseUrl}/settings'),
       headers: {
         'Content-Type': 'application/json',
@@ -954,7 +1020,7 @@ extension ApiServiceWorkouts on ApiService {
   Future<List<Workout>> fetchWorkoutsWithParams(Map<String, String> params) async {
     final token = await getToken();
     final uri = Uri.parse('${ApiService.baseUrl}/workouts').replace(queryParameters: params);
-    final response = await http.get(
+    final response = await _http.get(
       uri,
       headers: token != null ? {'Authorization': 'Bearer $token'} : {},
     );
@@ -1078,7 +1144,7 @@ class WaterIntake {
     return WaterIntake(
       id: json['id'],
       userId: json['user_id'],
-      amount: json['amount'],
+      amount: (json['amount'] as num).round(),
     );
   }
 }